@@ -0,0 +1,277 @@
+package analysis
+
+import (
+	"sort"
+)
+
+const (
+	// most keys of a request, and of the request preceding it, whose pairs
+	// are counted.  Every get is counted on a single goroutine, so this
+	// bounds the work for each to 100 keys and pairs.
+	maxGroupKeys = 8
+	// number of keys and of key pairs whose counts are kept
+	affinityKeys  = 10000
+	affinityPairs = 20000
+	// least affinity of the pairs joining keys into a cluster
+	clusterAffinity = 0.5
+)
+
+// KeyPair describes two keys requested together.
+type KeyPair struct {
+	// the two keys, in lexical order
+	Keys [2]string
+	// number of times the keys were requested together
+	Together int
+	// fraction of the requests for either key that were for both, from 0
+	// to 1
+	Affinity float64
+}
+
+// KeyCluster is a group of keys joined by pairs that are usually requested
+// together.
+type KeyCluster struct {
+	// keys in the cluster, in lexical order
+	Keys []string
+	// number of times the pairs joining the keys were requested together
+	Together int
+}
+
+// AffinityReport describes which keys were requested together, either in a
+// single multi-get or in gets following one another closely on a connection.
+// Counts are estimates, and may be low for keys that are rarely requested.
+type AffinityReport struct {
+	// pairs in descending order by Together
+	Pairs []KeyPair
+	// clusters of three or more keys in descending order by Together
+	Clusters []KeyCluster
+}
+
+// keyPair identifies a pair of keys, or a single key if b is empty.
+type keyPair struct {
+	a, b string
+}
+
+// sketch counts the most frequent of an unbounded number of items using a
+// bounded number of counters, as described by Misra and Gries.  Counts are
+// underestimated by at most the number of items added divided by capacity.
+type sketch struct {
+	capacity int
+	counts   map[keyPair]int
+}
+
+func newSketch(capacity int) sketch {
+	return sketch{capacity: capacity, counts: make(map[keyPair]int)}
+}
+
+func (s *sketch) add(p keyPair) {
+	if _, ok := s.counts[p]; ok || len(s.counts) < s.capacity {
+		s.counts[p]++
+		return
+	}
+	// no room for p, so count it against every item instead.  Each of these
+	// costly passes follows at least capacity additions.
+	for q, n := range s.counts {
+		if n <= 1 {
+			delete(s.counts, q)
+		} else {
+			s.counts[q] = n - 1
+		}
+	}
+}
+
+func (s *sketch) reset() {
+	s.counts = make(map[keyPair]int)
+}
+
+// keyGroup holds the keys of a get request and of the request preceding it
+// on the same connection.
+type keyGroup struct {
+	keys, preceding []string
+}
+
+// affinity accumulates the keys requested together.
+type affinity struct {
+	keys  sketch
+	pairs sketch
+	// channel for the keys of requests
+	groupChan chan keyGroup
+	// channel for requests for a report of at most the given size
+	reportRequest chan int
+	// channel for results of report requests
+	reportReply chan AffinityReport
+	// channel for requests to forget all keys
+	resetRequest chan bool
+}
+
+func newAffinity() *affinity {
+	a := &affinity{
+		keys:          newSketch(affinityKeys),
+		pairs:         newSketch(affinityPairs),
+		groupChan:     make(chan keyGroup, 1024),
+		reportRequest: make(chan int),
+		reportReply:   make(chan AffinityReport),
+		resetRequest:  make(chan bool),
+	}
+	go a.loop()
+	return a
+}
+
+// handleKeys asynchronously records the keys of a request and the request
+// preceding it.  handleKeys is threadsafe.
+func (a *affinity) handleKeys(keys, preceding []string) error {
+	select {
+	case a.groupChan <- keyGroup{keys, preceding}:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// report returns at most k of the strongest pairs and clusters.  report is
+// threadsafe.
+func (a *affinity) report(k int) AffinityReport {
+	a.reportRequest <- k
+	return <-a.reportReply
+}
+
+// reset forgets all keys.  reset is threadsafe.
+func (a *affinity) reset() {
+	a.resetRequest <- true
+}
+
+func (a *affinity) loop() {
+	for {
+		select {
+		case g := <-a.groupChan:
+			a.add(g)
+
+		case k := <-a.reportRequest:
+			a.reportReply <- a.build(k)
+
+		case <-a.resetRequest:
+			a.keys.reset()
+			a.pairs.reset()
+		}
+	}
+}
+
+func (a *affinity) add(g keyGroup) {
+	for i, key := range g.keys {
+		a.keys.add(keyPair{a: key})
+		for _, other := range g.keys[i+1:] {
+			a.addPair(key, other)
+		}
+		for _, other := range g.preceding {
+			a.addPair(key, other)
+		}
+	}
+}
+
+func (a *affinity) addPair(x, y string) {
+	if x == y {
+		return
+	}
+	if y < x {
+		x, y = y, x
+	}
+	a.pairs.add(keyPair{x, y})
+}
+
+// build reports at most k of the pairs requested together most often, and of
+// the clusters they form.
+func (a *affinity) build(k int) AffinityReport {
+	pairs := make([]KeyPair, 0, len(a.pairs.counts))
+	for p, together := range a.pairs.counts {
+		pairs = append(pairs, KeyPair{
+			Keys:     [2]string{p.a, p.b},
+			Together: together,
+			Affinity: a.affinity(p, together),
+		})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Together != pairs[j].Together {
+			return pairs[i].Together > pairs[j].Together
+		}
+		if pairs[i].Affinity != pairs[j].Affinity {
+			return pairs[i].Affinity > pairs[j].Affinity
+		}
+		return pairs[i].Keys[0]+"\x00"+pairs[i].Keys[1] < pairs[j].Keys[0]+"\x00"+pairs[j].Keys[1]
+	})
+
+	rep := AffinityReport{Clusters: clusters(pairs)}
+	if len(pairs) > k {
+		pairs = pairs[:k]
+	}
+	rep.Pairs = pairs
+	if len(rep.Clusters) > k {
+		rep.Clusters = rep.Clusters[:k]
+	}
+	return rep
+}
+
+// affinity returns the Jaccard index of the requests for the keys of p, given
+// the number of requests for both.
+func (a *affinity) affinity(p keyPair, together int) float64 {
+	either := a.keys.counts[keyPair{a: p.a}] + a.keys.counts[keyPair{a: p.b}] - together
+	if either <= together {
+		// the counts of the keys were underestimated
+		return 1
+	}
+	return float64(together) / float64(either)
+}
+
+// clusters joins the keys of pairs with high affinity that were requested
+// together more than once, returning the clusters of three keys or more.
+func clusters(pairs []KeyPair) []KeyCluster {
+	parent := make(map[string]string)
+	var find func(key string) string
+	find = func(key string) string {
+		p, ok := parent[key]
+		if !ok || p == key {
+			return key
+		}
+		root := find(p)
+		parent[key] = root
+		return root
+	}
+
+	var joined []KeyPair
+	for _, p := range pairs {
+		if p.Together < 2 || p.Affinity < clusterAffinity {
+			continue
+		}
+		joined = append(joined, p)
+		a, b := find(p.Keys[0]), find(p.Keys[1])
+		parent[a], parent[b] = a, a
+	}
+
+	byRoot := make(map[string]*KeyCluster)
+	for key := range parent {
+		root := find(key)
+		c, ok := byRoot[root]
+		if !ok {
+			c = &KeyCluster{}
+			byRoot[root] = c
+		}
+		c.Keys = append(c.Keys, key)
+	}
+	for _, p := range joined {
+		byRoot[find(p.Keys[0])].Together += p.Together
+	}
+
+	var cs []KeyCluster
+	for _, c := range byRoot {
+		if len(c.Keys) < 3 {
+			continue
+		}
+		sort.Strings(c.Keys)
+		cs = append(cs, *c)
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Together != cs[j].Together {
+			return cs[i].Together > cs[j].Together
+		}
+		return cs[i].Keys[0] < cs[j].Keys[0]
+	})
+	return cs
+}
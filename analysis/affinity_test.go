@@ -0,0 +1,43 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAffinity(t *testing.T) {
+	a := &affinity{keys: newSketch(affinityKeys), pairs: newSketch(affinityPairs)}
+	for i := 0; i < 3; i++ {
+		// a multi-get, followed closely by a get on the same connection
+		a.add(keyGroup{keys: []string{"user", "prefs"}})
+		a.add(keyGroup{keys: []string{"avatar"}, preceding: []string{"user", "prefs"}})
+	}
+	a.add(keyGroup{keys: []string{"user", "session"}})
+	a.add(keyGroup{keys: []string{"user"}})
+
+	rep := a.build(2)
+	expected := []KeyPair{
+		{Keys: [2]string{"avatar", "prefs"}, Together: 3, Affinity: 1},
+		{Keys: [2]string{"avatar", "user"}, Together: 3, Affinity: 0.6},
+	}
+	if !reflect.DeepEqual(rep.Pairs, expected) {
+		t.Error("got pairs", rep.Pairs, "expected", expected)
+	}
+	// session was requested with user only once
+	clusters := []KeyCluster{{Keys: []string{"avatar", "prefs", "user"}, Together: 9}}
+	if !reflect.DeepEqual(rep.Clusters, clusters) {
+		t.Error("got clusters", rep.Clusters, "expected", clusters)
+	}
+}
+
+func TestSketchBounded(t *testing.T) {
+	s := newSketch(2)
+	for _, key := range []string{"a", "a", "a", "b", "c", "d"} {
+		s.add(keyPair{a: key})
+	}
+	// c was counted against a and b, and d takes the room left by b
+	expected := map[keyPair]int{{a: "a"}: 2, {a: "d"}: 1}
+	if !reflect.DeepEqual(s.counts, expected) {
+		t.Error("got counts", s.counts, "expected", expected)
+	}
+}
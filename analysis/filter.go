@@ -27,6 +27,21 @@ func (f *filter) filterEvents(rs []model.Event) []model.Event {
 	return matches
 }
 
+// filterKeys returns a copy of at most max of the keys matching the filter.
+func (f *filter) filterKeys(keys []string, max int) []string {
+	re := f.regex()
+	matches := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if len(matches) == max {
+			break
+		}
+		if re == nil || re.MatchString(key) {
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
 func (f *filter) regex() *regexp.Regexp {
 	f.RLock()
 	defer f.RUnlock()
@@ -21,6 +21,13 @@ type Pool struct {
 	workers    []worker
 	filter     filter
 	stats      Stats
+	// keys requested together
+	affinity *affinity
+	// slab classes in which keys are reported to be stored
+	slabs *slabLayout
+	// activity per capture interface, indexed like interfaceNames
+	interfaceNames []string
+	interfaces     []interfaceCounter
 }
 
 // Stats contains performance metrics for a Pool.
@@ -29,6 +36,8 @@ type Stats struct {
 	EventsHandled int64
 	// number of events sent to HandleEvents that were discarded
 	EventsDropped int64
+	// number of requests sent to HandleKeys that were discarded
+	RequestsDropped int64
 }
 
 func (s *Stats) addHandled(n int) {
@@ -40,6 +49,25 @@ func (s *Stats) addDropped(n int) {
 
 }
 
+// interfaceCounter accumulates the get hits seen on a single capture
+// interface, and the bytes of the values they returned.
+type interfaceCounter struct {
+	requests int64
+	traffic  int64
+}
+
+func (ic *interfaceCounter) add(evts []model.Event) {
+	var requests, traffic int64
+	for _, evt := range evts {
+		if evt.Type == model.EventGetHit {
+			requests++
+			traffic += int64(evt.Size)
+		}
+	}
+	atomic.AddInt64(&ic.requests, requests)
+	atomic.AddInt64(&ic.traffic, traffic)
+}
+
 // New returns a new Pool.
 //
 // numWorkers determines the number of workers to hotlists to create.  More
@@ -47,11 +75,19 @@ func (s *Stats) addDropped(n int) {
 // memory consumption.
 //
 // reportSize determines the number of entries returned from Report.
-func New(numWorkers, reportSize int) *Pool {
+//
+// interfaces names the capture interfaces for which activity is reported
+// separately.  Events are attributed to an interface by HandleInterfaceEvents.
+func New(numWorkers, reportSize int, interfaces []string) *Pool {
 	c := &Pool{
-		reportSize: reportSize,
-		workers:    make([]worker, numWorkers),
+		reportSize:     reportSize,
+		workers:        make([]worker, numWorkers),
+		interfaceNames: interfaces,
+		interfaces:     make([]interfaceCounter, len(interfaces)),
+		affinity:       newAffinity(),
 	}
+	// the default configuration is always valid
+	c.slabs, _ = newSlabLayout(DefaultSlabConfig)
 
 	for i := 0; i < numWorkers; i++ {
 		c.workers[i] = newWorker()
@@ -68,7 +104,40 @@ func New(numWorkers, reportSize int) *Pool {
 //
 // HandleEvents is threadsafe.
 func (p *Pool) HandleEvents(evts []model.Event) {
-	perWorkerEvents := p.partitionEvents(p.filter.filterEvents(evts))
+	p.dispatch(p.filter.filterEvents(evts))
+}
+
+// HandleInterfaceEvents is like HandleEvents, additionally attributing the
+// events to the capture interface with index iface.
+//
+// HandleInterfaceEvents is threadsafe.
+func (p *Pool) HandleInterfaceEvents(iface int, evts []model.Event) {
+	evts = p.filter.filterEvents(evts)
+	if iface >= 0 && iface < len(p.interfaces) {
+		p.interfaces[iface].add(evts)
+	}
+	p.dispatch(evts)
+}
+
+// HandleKeys records the keys of a get request, along with the keys of the
+// request preceding it on the same connection if it closely preceded it, to
+// find the keys that are requested together.  Only the first few keys of
+// large multi-gets are considered.
+//
+// HandleKeys is threadsafe, and does not retain keys or preceding.
+func (p *Pool) HandleKeys(keys, preceding []string) {
+	keys = p.filter.filterKeys(keys, maxGroupKeys)
+	preceding = p.filter.filterKeys(preceding, maxGroupKeys)
+	if len(keys) == 0 {
+		return
+	}
+	if p.affinity.handleKeys(keys, preceding) == errQueueFull {
+		atomic.AddInt64(&p.stats.RequestsDropped, 1)
+	}
+}
+
+func (p *Pool) dispatch(evts []model.Event) {
+	perWorkerEvents := p.partitionEvents(evts)
 	for i, events := range perWorkerEvents {
 		if len(events) > 0 {
 			err := p.workers[i].handleEvents(events)
@@ -104,6 +173,19 @@ func (p *Pool) SetFilterPattern(pattern string) error {
 	return nil
 }
 
+// SetSlabConfig sets the memcached configuration used to estimate the slab
+// classes in which keys are stored, returning an error if cfg is invalid.
+// SetSlabConfig is not threadsafe, and should be called before the Pool is
+// used.
+func (p *Pool) SetSlabConfig(cfg SlabConfig) error {
+	l, err := newSlabLayout(cfg)
+	if err != nil {
+		return err
+	}
+	p.slabs = l
+	return nil
+}
+
 // Reset clears all recorded activity from this Pool.  This operation is
 // asynchronous, and may still be in progress when Reset returns.  New data
 // added by calling HandleGetResponse after Reset returns may be lost, and
@@ -113,6 +195,11 @@ func (p *Pool) Reset() {
 	for _, w := range p.workers {
 		w.reset()
 	}
+	p.affinity.reset()
+	for i := range p.interfaces {
+		atomic.StoreInt64(&p.interfaces[i].requests, 0)
+		atomic.StoreInt64(&p.interfaces[i].traffic, 0)
+	}
 }
 
 // Stats returns a record of total activity reported to this Pool, including
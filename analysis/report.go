@@ -3,6 +3,7 @@ package analysis
 import (
 	"github.com/box/memsniff/hotlist"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +17,20 @@ type KeyReport struct {
 	RequestsEstimate int
 	// amount of bandwidth consumed by traffic for this cache key in bytes
 	TrafficEstimate int
+	// sizes of all values of this cache key, which may have changed
+	Sizes ValueSizes
+}
+
+// InterfaceReport contains activity information for a single capture
+// interface.
+type InterfaceReport struct {
+	// name of the network interface
+	Name string
+	// number of gets returning a value seen on this interface.  Misses and
+	// sets are not counted.
+	RequestsEstimate int
+	// amount of bandwidth consumed by responses on this interface in bytes
+	TrafficEstimate int
 }
 
 // Report represents key activity submitted to a Pool since the last call to
@@ -25,6 +40,16 @@ type Report struct {
 	Timestamp time.Time
 	// key reports in descending order by TrafficEstimate
 	Keys []KeyReport
+	// activity per capture interface, in the order given to New
+	Interfaces []InterfaceReport
+	// keys requested together
+	Affinity AffinityReport
+	// sizes of all values
+	Sizes ValueSizes
+	// sizes of values by key group, the groups with the most values first
+	Groups []GroupSizes
+	// estimated use of memcached's slab classes by the keys seen
+	Slabs SlabReport
 }
 
 // Len implements sort.Interface for Report.
@@ -57,12 +82,23 @@ func (r Report) Swap(i, j int) {
 // lost entirely.
 func (p *Pool) Report(shouldReset bool) Report {
 	allEntries := make([]hotlist.Entry, 0, p.reportSize*len(p.workers))
+	keySizes := make(map[string]ValueSizes)
+	groups := make(map[string]*ValueSizes)
+	var sizes ValueSizes
+	slabs := newSlabCounts(p.slabs)
 	for _, w := range p.workers {
-		workerEntries := w.top(p.reportSize)
+		res := w.top(p.reportSize, p.slabs)
 		if shouldReset {
 			w.reset()
 		}
-		allEntries = append(allEntries, workerEntries...)
+		allEntries = append(allEntries, res.entries...)
+		// each key is handled by a single worker
+		for name, ks := range res.keySizes {
+			keySizes[name] = ks
+		}
+		sizes.merge(res.all)
+		mergeGroups(groups, res.groups)
+		slabs.merge(res.slabs)
 	}
 
 	reportSize := len(allEntries)
@@ -71,12 +107,22 @@ func (p *Pool) Report(shouldReset bool) Report {
 	}
 
 	ret := Report{
-		Timestamp: time.Now(),
-		Keys:      make([]KeyReport, 0, reportSize),
+		Timestamp:  time.Now(),
+		Keys:       make([]KeyReport, 0, reportSize),
+		Interfaces: p.interfaceReports(shouldReset),
+		Affinity:   p.affinity.report(p.reportSize),
+		Sizes:      sizes,
+		Groups:     groupReports(groups, p.reportSize),
+		Slabs:      slabs.report(p.slabs),
+	}
+	if shouldReset {
+		p.affinity.reset()
 	}
 
 	for _, e := range allEntries {
-		ret.Keys = append(ret.Keys, keyReport(e))
+		kr := keyReport(e)
+		kr.Sizes = keySizes[kr.Name]
+		ret.Keys = append(ret.Keys, kr)
 	}
 
 	sort.Sort(ret)
@@ -84,6 +130,27 @@ func (p *Pool) Report(shouldReset bool) Report {
 	return ret
 }
 
+func (p *Pool) interfaceReports(shouldReset bool) []InterfaceReport {
+	reports := make([]InterfaceReport, len(p.interfaces))
+	for i := range p.interfaces {
+		ic := &p.interfaces[i]
+		var requests, traffic int64
+		if shouldReset {
+			requests = atomic.SwapInt64(&ic.requests, 0)
+			traffic = atomic.SwapInt64(&ic.traffic, 0)
+		} else {
+			requests = atomic.LoadInt64(&ic.requests)
+			traffic = atomic.LoadInt64(&ic.traffic)
+		}
+		reports[i] = InterfaceReport{
+			Name:             p.interfaceNames[i],
+			RequestsEstimate: int(requests),
+			TrafficEstimate:  int(traffic),
+		}
+	}
+	return reports
+}
+
 func keyReport(e hotlist.Entry) KeyReport {
 	ki := e.Item().(keyInfo)
 	return KeyReport{
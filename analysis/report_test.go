@@ -0,0 +1,35 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/box/memsniff/protocol/model"
+)
+
+func TestInterfaceReports(t *testing.T) {
+	p := New(1, 10, []string{"eth0", "eth1"})
+	p.HandleInterfaceEvents(1, []model.Event{
+		{Type: model.EventGetHit, Key: "a", Size: 10},
+		{Type: model.EventGetHit, Key: "b", Size: 5},
+		{Type: model.EventGetMiss, Key: "c"},
+	})
+	// out of range interfaces are not attributed
+	p.HandleInterfaceEvents(2, []model.Event{{Type: model.EventGetHit, Key: "d", Size: 1}})
+
+	rep := p.Report(true)
+	if len(rep.Interfaces) != 2 {
+		t.Fatal("got", len(rep.Interfaces), "interface reports, expected 2")
+	}
+	if rep.Interfaces[0].RequestsEstimate != 0 {
+		t.Error("unexpected requests on eth0:", rep.Interfaces[0])
+	}
+	ir := rep.Interfaces[1]
+	if ir.Name != "eth1" || ir.RequestsEstimate != 2 || ir.TrafficEstimate != 15 {
+		t.Error("got", ir)
+	}
+
+	rep = p.Report(true)
+	if rep.Interfaces[1].RequestsEstimate != 0 {
+		t.Error("interface report not reset:", rep.Interfaces[1])
+	}
+}
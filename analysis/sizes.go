@@ -0,0 +1,189 @@
+package analysis
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// SizeBuckets is the number of buckets in a SizeHistogram.
+	SizeBuckets = 16
+	// smallestBucket is the largest size counted by the first bucket.
+	smallestBucket = 64
+	// characters ending the prefix of a key that names its group
+	groupDelimiters = ":|"
+	// most key groups tracked by each worker, beyond which keys are counted
+	// in OtherGroup
+	maxGroups = 1000
+)
+
+// OtherGroup is the group of keys without a prefix, or whose prefix could
+// not be tracked.
+const OtherGroup = ""
+
+// SizeHistogram counts values by size.  Bucket i counts values of up to
+// 64<<i bytes that are larger than those of bucket i-1, so the last bucket
+// counts values over 1 MiB.
+type SizeHistogram [SizeBuckets]int
+
+// SizeBucketBounds returns the smallest and largest sizes counted by bucket
+// i.  The largest size of the last bucket is zero, since it has no bound.
+func SizeBucketBounds(i int) (min, max int) {
+	if i > 0 {
+		min = smallestBucket<<uint(i-1) + 1
+	}
+	if i < SizeBuckets-1 {
+		max = smallestBucket << uint(i)
+	}
+	return
+}
+
+func (h *SizeHistogram) add(size int) {
+	i := 0
+	for i < SizeBuckets-1 && size > smallestBucket<<uint(i) {
+		i++
+	}
+	h[i]++
+}
+
+func (h *SizeHistogram) merge(o SizeHistogram) {
+	for i, n := range o {
+		h[i] += n
+	}
+}
+
+// Count returns the number of values counted.
+func (h SizeHistogram) Count() int {
+	var n int
+	for _, c := range h {
+		n += c
+	}
+	return n
+}
+
+// ValueSizes counts the sizes of the values returned by gets and sent by
+// storage commands such as set.
+type ValueSizes struct {
+	Gets SizeHistogram
+	Sets SizeHistogram
+}
+
+func (vs *ValueSizes) add(ke keyEvent) {
+	if ke.set {
+		vs.Sets.add(ke.size)
+	} else {
+		vs.Gets.add(ke.size)
+	}
+}
+
+func (vs *ValueSizes) merge(o ValueSizes) {
+	vs.Gets.merge(o.Gets)
+	vs.Sets.merge(o.Sets)
+}
+
+// Count returns the number of values counted.
+func (vs ValueSizes) Count() int {
+	return vs.Gets.Count() + vs.Sets.Count()
+}
+
+// GroupSizes counts the sizes of the values of a group of keys sharing a
+// prefix.
+type GroupSizes struct {
+	// the prefix of the keys up to the first ':' or '|', or OtherGroup
+	Group string
+	ValueSizes
+}
+
+// keyGroupName returns the group of key, the prefix before the first
+// delimiter.
+func keyGroupName(key string) string {
+	i := strings.IndexAny(key, groupDelimiters)
+	if i <= 0 {
+		return OtherGroup
+	}
+	return key[:i]
+}
+
+// keySizes counts the sizes of the values of a single key.
+type keySizes struct {
+	ValueSizes
+	// size of the most recent value
+	size int
+	// bytes of all values gotten and set
+	traffic int
+}
+
+// workerSizes counts the sizes of the values of the keys handled by a worker.
+type workerSizes struct {
+	all    ValueSizes
+	groups map[string]*ValueSizes
+	keys   map[string]*keySizes
+}
+
+func newWorkerSizes() workerSizes {
+	return workerSizes{
+		groups: make(map[string]*ValueSizes),
+		keys:   make(map[string]*keySizes),
+	}
+}
+
+func (ws *workerSizes) add(ke keyEvent) {
+	ws.all.add(ke)
+	group := keyGroupName(ke.name)
+	gs, ok := ws.groups[group]
+	if !ok {
+		if len(ws.groups) >= maxGroups {
+			group = OtherGroup
+		}
+		gs, ok = ws.groups[group]
+		if !ok {
+			gs = &ValueSizes{}
+			ws.groups[group] = gs
+		}
+	}
+	gs.add(ke)
+	ks, ok := ws.keys[ke.name]
+	if !ok {
+		ks = &keySizes{}
+		ws.keys[ke.name] = ks
+	}
+	ks.add(ke)
+	ks.size = ke.size
+	ks.traffic += ke.size
+}
+
+// mergeGroups adds the group sizes of ws to groups.
+func (ws *workerSizes) mergeGroups(groups map[string]*ValueSizes) {
+	mergeGroups(groups, ws.groups)
+}
+
+// mergeGroups adds the sizes of from to groups.
+func mergeGroups(groups map[string]*ValueSizes, from map[string]*ValueSizes) {
+	for group, vs := range from {
+		merged, ok := groups[group]
+		if !ok {
+			merged = &ValueSizes{}
+			groups[group] = merged
+		}
+		merged.merge(*vs)
+	}
+}
+
+// groupReports returns at most k of groups with the most values counted.
+func groupReports(groups map[string]*ValueSizes, k int) []GroupSizes {
+	reports := make([]GroupSizes, 0, len(groups))
+	for group, vs := range groups {
+		reports = append(reports, GroupSizes{Group: group, ValueSizes: *vs})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		ci, cj := reports[i].Count(), reports[j].Count()
+		if ci != cj {
+			return ci > cj
+		}
+		return reports[i].Group < reports[j].Group
+	})
+	if len(reports) > k {
+		reports = reports[:k]
+	}
+	return reports
+}
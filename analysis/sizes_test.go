@@ -0,0 +1,56 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	var h SizeHistogram
+	for _, size := range []int{0, 64, 65, 1000, 1024 * 1024, 1024*1024 + 1} {
+		h.add(size)
+	}
+	expected := SizeHistogram{0: 2, 1: 1, 4: 1, 14: 1, 15: 1}
+	if h != expected {
+		t.Error("got", h, "expected", expected)
+	}
+	for i, bounds := range [][2]int{{0, 64}, {65, 128}, {513, 1024}, {1024*1024 + 1, 0}} {
+		b := []int{0, 1, 4, 15}[i]
+		if min, max := SizeBucketBounds(b); min != bounds[0] || max != bounds[1] {
+			t.Error("bucket", b, "got bounds", min, max, "expected", bounds)
+		}
+	}
+}
+
+func TestWorkerSizes(t *testing.T) {
+	ws := newWorkerSizes()
+	for _, ke := range []keyEvent{
+		{keyInfo: keyInfo{"user:1", 100}},
+		{keyInfo: keyInfo{"user:1", 100}},
+		{keyInfo: keyInfo{"user:2", 5000}, set: true},
+		{keyInfo: keyInfo{"session|a", 10}},
+		{keyInfo: keyInfo{"plain", 10}},
+	} {
+		ws.add(ke)
+	}
+	if ws.all.Gets.Count() != 4 || ws.all.Sets.Count() != 1 {
+		t.Error("got all sizes", ws.all)
+	}
+	if ks := ws.keys["user:1"]; ks.Gets[1] != 2 || ks.Sets.Count() != 0 {
+		t.Error("got key sizes", ks)
+	}
+
+	groups := make(map[string]*ValueSizes)
+	ws.mergeGroups(groups)
+	ws.mergeGroups(groups)
+	var names []string
+	for _, g := range groupReports(groups, 2) {
+		names = append(names, g.Group)
+	}
+	if expected := []string{"user", OtherGroup}; !reflect.DeepEqual(names, expected) {
+		t.Error("got groups", names, "expected", expected)
+	}
+	if user := groups["user"]; user.Gets[1] != 4 || user.Sets[7] != 2 {
+		t.Error("got user group sizes", user)
+	}
+}
@@ -0,0 +1,213 @@
+package analysis
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	// most slab classes memcached creates, including the largest
+	maxSlabClasses = 63
+	// alignment of memcached's chunk sizes
+	chunkAlign = 8
+	// bytes of the CAS value memcached stores with each item unless started
+	// with -C
+	casSize = 8
+	// number of growth factors compared with the configured one, from 1.05 to
+	// 2 in steps of 0.05
+	candidateFactors = 20
+)
+
+// SlabConfig describes how memcached divides its memory into slab classes.
+type SlabConfig struct {
+	// smallest space for the key, value and flags of an item, set by
+	// memcached's -n option
+	MinSpace int
+	// growth factor of the chunk sizes of successive classes, set by
+	// memcached's -f option
+	Factor float64
+	// bytes of each item's header
+	ItemOverhead int
+	// size of the chunks of the largest class.  Larger items are split
+	// across several chunks.
+	LargestChunk int
+}
+
+// DefaultSlabConfig matches the defaults of a 64-bit memcached 1.5 or later.
+var DefaultSlabConfig = SlabConfig{
+	MinSpace:     48,
+	Factor:       1.25,
+	ItemOverhead: 48,
+	LargestChunk: 512 * 1024,
+}
+
+// SlabClass describes the values stored in a single slab class.
+type SlabClass struct {
+	// memcached's number for the class, from 1
+	ID int
+	// size of each chunk of the class in bytes
+	ChunkSize int
+	// number of gets and sets of values stored in the class
+	Requests int
+	// bytes of the values gotten and set
+	Traffic int
+	// number of distinct keys whose most recent value is stored in the class
+	Keys int
+	// bytes of chunks used by the keys
+	Memory int
+	// bytes of the keys' chunks left unused by their items
+	Wasted int
+}
+
+func (sc *SlabClass) merge(o SlabClass) {
+	sc.Requests += o.Requests
+	sc.Traffic += o.Traffic
+	sc.Keys += o.Keys
+	sc.Memory += o.Memory
+	sc.Wasted += o.Wasted
+}
+
+// SlabReport estimates how the values seen would be stored by a memcached
+// server with the configuration given to SetSlabConfig.  Each key is placed
+// in a class by the size of its key and most recent value.
+type SlabReport struct {
+	Config SlabConfig
+	// classes storing any of the keys, in ascending order by chunk size
+	Classes []SlabClass
+	// items too large for a single chunk, whose ID and ChunkSize are zero
+	Large SlabClass
+	// bytes of chunks left unused by items in all classes
+	Wasted int
+	// growth factor that would waste the least memory storing the keys seen,
+	// which is Config.Factor unless another factor wastes less
+	SuggestedFactor float64
+	// bytes that would be wasted using SuggestedFactor
+	SuggestedWasted int
+}
+
+// slabLayout holds the chunk sizes of the classes of a configuration, and of
+// the same configuration with each of the candidate growth factors.
+type slabLayout struct {
+	config     SlabConfig
+	chunks     []int
+	candidates [candidateFactors][]int
+}
+
+func newSlabLayout(cfg SlabConfig) (*slabLayout, error) {
+	if cfg.MinSpace <= 0 {
+		return nil, errors.New("slab minimum space must be positive")
+	}
+	if cfg.ItemOverhead < 0 {
+		return nil, errors.New("item overhead must not be negative")
+	}
+	if cfg.Factor <= 1 {
+		return nil, errors.New("slab growth factor must be greater than 1")
+	}
+	if cfg.LargestChunk < cfg.MinSpace+cfg.ItemOverhead {
+		return nil, errors.New("largest slab chunk is smaller than the smallest item")
+	}
+	l := &slabLayout{config: cfg, chunks: chunkSizes(cfg)}
+	for i := range l.candidates {
+		c := cfg
+		c.Factor = candidateFactor(i)
+		l.candidates[i] = chunkSizes(c)
+	}
+	return l, nil
+}
+
+func candidateFactor(i int) float64 {
+	return 1 + float64(i+1)/candidateFactors
+}
+
+// chunkSizes returns the chunk size of each slab class as memcached computes
+// them.
+func chunkSizes(cfg SlabConfig) []int {
+	var chunks []int
+	size := cfg.ItemOverhead + cfg.MinSpace
+	for len(chunks) < maxSlabClasses-1 && float64(size) < float64(cfg.LargestChunk)/cfg.Factor {
+		if size%chunkAlign != 0 {
+			size += chunkAlign - size%chunkAlign
+		}
+		chunks = append(chunks, size)
+		size = int(float64(size) * cfg.Factor)
+	}
+	return append(chunks, cfg.LargestChunk)
+}
+
+// itemSize returns the memory memcached uses for an item, including the
+// line ending stored after its value.
+func (l *slabLayout) itemSize(key string, valueSize int) int {
+	return l.config.ItemOverhead + casSize + len(key) + 1 + valueSize + 2
+}
+
+// slabCounts is a worker's contribution to a SlabReport.
+type slabCounts struct {
+	// indexed like slabLayout.chunks, followed by the items too large for a
+	// single chunk
+	classes []SlabClass
+	// bytes wasted with each of the candidate growth factors
+	wasted [candidateFactors]int
+}
+
+func newSlabCounts(l *slabLayout) slabCounts {
+	return slabCounts{classes: make([]SlabClass, len(l.chunks)+1)}
+}
+
+func (sc *slabCounts) merge(o slabCounts) {
+	for i := range sc.classes {
+		sc.classes[i].merge(o.classes[i])
+	}
+	for i, w := range o.wasted {
+		sc.wasted[i] += w
+	}
+}
+
+// slabCounts places the keys of ws in the classes of l.
+func (ws *workerSizes) slabCounts(l *slabLayout) slabCounts {
+	sc := newSlabCounts(l)
+	for name, ks := range ws.keys {
+		item := l.itemSize(name, ks.size)
+		i := sort.SearchInts(l.chunks, item)
+		c := &sc.classes[i]
+		c.Requests += ks.Count()
+		c.Traffic += ks.traffic
+		c.Keys++
+		if i == len(l.chunks) {
+			c.Memory += item
+			continue
+		}
+		c.Memory += l.chunks[i]
+		c.Wasted += l.chunks[i] - item
+		for j, chunks := range l.candidates {
+			if k := sort.SearchInts(chunks, item); k < len(chunks) {
+				sc.wasted[j] += chunks[k] - item
+			}
+		}
+	}
+	return sc
+}
+
+// report summarizes the counts of all workers.
+func (sc slabCounts) report(l *slabLayout) SlabReport {
+	rep := SlabReport{
+		Config:          l.config,
+		Large:           sc.classes[len(l.chunks)],
+		SuggestedFactor: l.config.Factor,
+	}
+	for i, size := range l.chunks {
+		c := sc.classes[i]
+		rep.Wasted += c.Wasted
+		if c.Keys == 0 {
+			continue
+		}
+		c.ID, c.ChunkSize = i+1, size
+		rep.Classes = append(rep.Classes, c)
+	}
+	rep.SuggestedWasted = rep.Wasted
+	for i, wasted := range sc.wasted {
+		if wasted < rep.SuggestedWasted {
+			rep.SuggestedFactor, rep.SuggestedWasted = candidateFactor(i), wasted
+		}
+	}
+	return rep
+}
@@ -0,0 +1,80 @@
+package analysis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkSizes(t *testing.T) {
+	chunks := chunkSizes(DefaultSlabConfig)
+	// as listed by memcached -vv
+	expected := []int{96, 120, 152, 192, 240, 304, 384, 480, 600, 752, 944, 1184}
+	if !reflect.DeepEqual(chunks[:len(expected)], expected) {
+		t.Error("got chunk sizes", chunks[:len(expected)], "expected", expected)
+	}
+	if len(chunks) != 39 || chunks[38] != 512*1024 {
+		t.Error("got", len(chunks), "classes, largest", chunks[len(chunks)-1])
+	}
+
+	cfg := DefaultSlabConfig
+	cfg.Factor = 1.01
+	if chunks := chunkSizes(cfg); len(chunks) != maxSlabClasses {
+		t.Error("got", len(chunks), "classes with a small growth factor")
+	}
+}
+
+func TestSlabConfig(t *testing.T) {
+	p := New(1, 10, nil)
+	for _, cfg := range []SlabConfig{
+		{MinSpace: 0, Factor: 1.25, ItemOverhead: 48, LargestChunk: 1024},
+		{MinSpace: 48, Factor: 1, ItemOverhead: 48, LargestChunk: 1024},
+		{MinSpace: 48, Factor: 1.25, ItemOverhead: 48, LargestChunk: 64},
+	} {
+		if p.SetSlabConfig(cfg) == nil {
+			t.Error("accepted", cfg)
+		}
+	}
+	if err := p.SetSlabConfig(DefaultSlabConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSlabReport(t *testing.T) {
+	ws := newWorkerSizes()
+	// items of 96 bytes, exactly filling the smallest chunk
+	for i := 0; i < 5; i++ {
+		ws.add(keyEvent{keyInfo: keyInfo{"k" + strings.Repeat("x", i), 36 - i}})
+	}
+	// a second get of the same key
+	ws.add(keyEvent{keyInfo: keyInfo{"k", 36}})
+	// an item of 97 bytes, wasting 23 bytes of a 120 byte chunk
+	ws.add(keyEvent{keyInfo: keyInfo{"big", 35}, set: true})
+	// too large for any chunk
+	ws.add(keyEvent{keyInfo: keyInfo{"huge", 1024 * 1024}})
+
+	l, err := newSlabLayout(DefaultSlabConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newSlabCounts(l)
+	sc.merge(ws.slabCounts(l))
+	rep := sc.report(l)
+	expected := []SlabClass{
+		{ID: 1, ChunkSize: 96, Requests: 6, Traffic: 206, Keys: 5, Memory: 480},
+		{ID: 2, ChunkSize: 120, Requests: 1, Traffic: 35, Keys: 1, Memory: 120, Wasted: 23},
+	}
+	if !reflect.DeepEqual(rep.Classes, expected) {
+		t.Error("got classes", rep.Classes, "expected", expected)
+	}
+	if rep.Large.Keys != 1 || rep.Large.Traffic != 1024*1024 {
+		t.Error("got large items", rep.Large)
+	}
+	if rep.Wasted != 23 {
+		t.Error("got", rep.Wasted, "bytes wasted")
+	}
+	// a factor of 1.05 gives a chunk of 104 bytes after the smallest
+	if rep.SuggestedFactor != 1.05 || rep.SuggestedWasted != 7 {
+		t.Error("got suggestion", rep.SuggestedFactor, rep.SuggestedWasted)
+	}
+}
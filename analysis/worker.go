@@ -10,12 +10,14 @@ import (
 type worker struct {
 	// hotlist of the busiest cache keys tracked by this worker
 	hl hotlist.HotList
+	// sizes of the values of the keys tracked by this worker
+	sizes workerSizes
 	// channel for reports of cache key activity
-	kisChan chan []keyInfo
+	kesChan chan []keyEvent
 	// channel for requests for the current contents of the hotlist
-	topRequest chan int
+	topRequest chan topRequest
 	// channel for results of top() requests
-	topReply chan []hotlist.Entry
+	topReply chan topResult
 	// channel for requests to reset the hotlist to an empty state
 	resetRequest chan bool
 }
@@ -33,6 +35,32 @@ func (ki keyInfo) Weight() int {
 	return ki.size
 }
 
+// keyEvent is a value retrieved by a get or sent by a storage command.
+type keyEvent struct {
+	keyInfo
+	set bool
+}
+
+// topRequest asks for the k busiest keys, and for the slab classes of slabs
+// storing all keys.
+type topRequest struct {
+	k     int
+	slabs *slabLayout
+}
+
+// topResult is the reply to a top() request.
+type topResult struct {
+	entries []hotlist.Entry
+	// sizes of the values of the keys in entries
+	keySizes map[string]ValueSizes
+	// sizes of all values tracked by the worker
+	all ValueSizes
+	// sizes of values by key group, copied from the worker
+	groups map[string]*ValueSizes
+	// slab classes storing the keys tracked by the worker
+	slabs slabCounts
+}
+
 // errQueueFull is returned by handleGetResponse if the worker cannot keep
 // up with incoming calls.
 var errQueueFull = errors.New("analysis worker queue full")
@@ -40,9 +68,10 @@ var errQueueFull = errors.New("analysis worker queue full")
 func newWorker() worker {
 	w := worker{
 		hl:           hotlist.NewPerfect(),
-		kisChan:      make(chan []keyInfo, 1024),
-		topRequest:   make(chan int),
-		topReply:     make(chan []hotlist.Entry),
+		sizes:        newWorkerSizes(),
+		kesChan:      make(chan []keyEvent, 1024),
+		topRequest:   make(chan topRequest),
+		topReply:     make(chan topResult),
 		resetRequest: make(chan bool),
 	}
 	go w.loop()
@@ -56,25 +85,28 @@ func newWorker() worker {
 func (w *worker) handleEvents(evts []model.Event) error {
 	// Make sure we copy r.Key before we return, since it may be a pointer
 	// into a buffer that will be overwritten.
-	kis := make([]keyInfo, 0, len(evts))
-	for i, evt := range evts {
-		if evt.Type == model.EventGetHit {
-			kis = kis[:i+1]
-			kis[i] = keyInfo{evt.Key, evt.Size}
+	kes := make([]keyEvent, 0, len(evts))
+	for _, evt := range evts {
+		switch evt.Type {
+		case model.EventGetHit:
+			kes = append(kes, keyEvent{keyInfo: keyInfo{evt.Key, evt.Size}})
+		case model.EventSet:
+			kes = append(kes, keyEvent{keyInfo: keyInfo{evt.Key, evt.Size}, set: true})
 		}
 	}
 	select {
-	case w.kisChan <- kis:
+	case w.kesChan <- kes:
 		return nil
 	default:
 		return errQueueFull
 	}
 }
 
-// top returns the current contents of the hotlist for this worker.
-// top is threadsafe.
-func (w *worker) top(k int) []hotlist.Entry {
-	w.topRequest <- k
+// top returns the current contents of the hotlist for this worker, along
+// with the sizes of values and the slab classes of slabs storing them.  top is
+// threadsafe.
+func (w *worker) top(k int, slabs *slabLayout) topResult {
+	w.topRequest <- topRequest{k, slabs}
 	return <-w.topReply
 }
 
@@ -88,25 +120,49 @@ func (w *worker) reset() {
 // close exits this worker. Calls to handleGetResponse after calling close
 // will panic.
 func (w *worker) close() {
-	close(w.kisChan)
+	close(w.kesChan)
 }
 
 func (w *worker) loop() {
 	for {
 		select {
-		case kis, ok := <-w.kisChan:
+		case kes, ok := <-w.kesChan:
 			if !ok {
 				return
 			}
-			for _, ki := range kis {
-				w.hl.AddWeighted(ki)
+			for _, ke := range kes {
+				if !ke.set {
+					w.hl.AddWeighted(ke.keyInfo)
+				}
+				w.sizes.add(ke)
 			}
 
-		case k := <-w.topRequest:
-			w.topReply <- w.hl.Top(k)
+		case req := <-w.topRequest:
+			w.topReply <- w.topResult(req)
 
 		case <-w.resetRequest:
 			w.hl.Reset()
+			w.sizes = newWorkerSizes()
+		}
+	}
+}
+
+// topResult returns the busiest keys, the sizes of values and their slab
+// classes.
+func (w *worker) topResult(req topRequest) topResult {
+	res := topResult{
+		entries:  w.hl.Top(req.k),
+		keySizes: make(map[string]ValueSizes),
+		all:      w.sizes.all,
+		groups:   make(map[string]*ValueSizes),
+		slabs:    w.sizes.slabCounts(req.slabs),
+	}
+	for _, e := range res.entries {
+		name := e.Item().(keyInfo).name
+		if ks, ok := w.sizes.keys[name]; ok {
+			res.keySizes[name] = ks.ValueSizes
 		}
 	}
+	w.sizes.mergeGroups(res.groups)
+	return res
 }
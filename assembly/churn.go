@@ -0,0 +1,183 @@
+package assembly
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of the most recent second in a client's baseline connect rate
+	churnBaselineWeight = 0.1
+	// a client's connect rate is a spike if it is this many times its
+	// baseline and at least churnSpikeMinimum per second
+	churnSpikeFactor  = 4
+	churnSpikeMinimum = 10
+	// clients whose baseline falls below this are forgotten
+	churnForgetBelow = 0.01
+	// longest gap in traffic, in seconds, over which baselines are decayed
+	churnMaxGap = 60
+	// no spikes are reported until baselines have been learned for this long
+	churnWarmup = 10 * time.Second
+)
+
+// ChurnReport counts TCP connections opened and closed during the most recent
+// complete second of capture time.
+type ChurnReport struct {
+	// Second is the start of the second counted.
+	Second time.Time
+	Opens  int
+	Closes int
+	// Clients lists the clients that opened or closed connections, with
+	// the most opens first.
+	Clients []ClientChurn
+}
+
+// ClientChurn counts the connections opened and closed by a single client.
+type ClientChurn struct {
+	Client string
+	Opens  int
+	Closes int
+	// Baseline is the client's usual rate of opens per second, not
+	// including this second.
+	Baseline float64
+	// Spike is true if Opens is well above Baseline.
+	Spike bool
+}
+
+type clientCounts struct {
+	opens, closes int
+	baseline      float64
+}
+
+// churnTracker counts connections opened and closed per second of capture
+// time, overall and per client.  It is shared by all workers.
+type churnTracker struct {
+	mu sync.Mutex
+	// start of the first second counted
+	started time.Time
+	// start of the second being counted
+	second  time.Time
+	opens   int
+	closes  int
+	clients map[string]*clientCounts
+	last    ChurnReport
+}
+
+func newChurnTracker() *churnTracker {
+	return &churnTracker{clients: make(map[string]*clientCounts)}
+}
+
+// opened counts a connection opened by client at timestamp.
+func (ct *churnTracker) opened(client string, timestamp time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.advance(timestamp)
+	ct.opens++
+	ct.client(client).opens++
+}
+
+// closed counts a connection to client closed at timestamp.
+func (ct *churnTracker) closed(client string, timestamp time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.advance(timestamp)
+	ct.closes++
+	ct.client(client).closes++
+}
+
+func (ct *churnTracker) client(client string) *clientCounts {
+	cc, ok := ct.clients[client]
+	if !ok {
+		cc = &clientCounts{}
+		ct.clients[client] = cc
+	}
+	return cc
+}
+
+// advance finishes the second being counted if timestamp is later.
+func (ct *churnTracker) advance(timestamp time.Time) {
+	second := timestamp.Truncate(time.Second)
+	if ct.second.IsZero() {
+		ct.started = second
+		ct.second = second
+		return
+	}
+	if !second.After(ct.second) {
+		return
+	}
+	ct.finish()
+	// decay the baselines over any seconds without traffic
+	gap := int(second.Sub(ct.second)/time.Second) - 1
+	if gap > 0 {
+		ct.last = ChurnReport{Second: second.Add(-time.Second)}
+	}
+	if gap > churnMaxGap {
+		gap = churnMaxGap
+	}
+	for i := 0; i < gap; i++ {
+		for client, cc := range ct.clients {
+			cc.baseline *= 1 - churnBaselineWeight
+			if cc.baseline < churnForgetBelow {
+				delete(ct.clients, client)
+			}
+		}
+	}
+	ct.second = second
+}
+
+// finish reports the second being counted and folds it into the baselines.
+func (ct *churnTracker) finish() {
+	rep := ChurnReport{Second: ct.second, Opens: ct.opens, Closes: ct.closes}
+	warm := ct.second.Sub(ct.started) >= churnWarmup
+	for client, cc := range ct.clients {
+		if cc.opens > 0 || cc.closes > 0 {
+			rep.Clients = append(rep.Clients, ClientChurn{
+				Client:   client,
+				Opens:    cc.opens,
+				Closes:   cc.closes,
+				Baseline: cc.baseline,
+				Spike:    warm && isSpike(cc.opens, cc.baseline),
+			})
+		}
+		cc.baseline += churnBaselineWeight * (float64(cc.opens) - cc.baseline)
+		cc.opens, cc.closes = 0, 0
+		if cc.baseline < churnForgetBelow {
+			delete(ct.clients, client)
+		}
+	}
+	sort.Slice(rep.Clients, func(i, j int) bool {
+		if rep.Clients[i].Opens != rep.Clients[j].Opens {
+			return rep.Clients[i].Opens > rep.Clients[j].Opens
+		}
+		return rep.Clients[i].Client < rep.Clients[j].Client
+	})
+	ct.last = rep
+	ct.opens, ct.closes = 0, 0
+}
+
+func isSpike(opens int, baseline float64) bool {
+	return opens >= churnSpikeMinimum && float64(opens) >= churnSpikeFactor*baseline
+}
+
+// reset forgets the counts and baselines, so that counting starts over from
+// the next connection seen.
+func (ct *churnTracker) reset() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.started, ct.second = time.Time{}, time.Time{}
+	ct.opens, ct.closes = 0, 0
+	ct.clients = make(map[string]*clientCounts)
+	ct.last = ChurnReport{}
+}
+
+// report returns the counts for the most recent second completed by now, in
+// capture time.
+func (ct *churnTracker) report(now time.Time) ChurnReport {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if !ct.second.IsZero() {
+		ct.advance(now)
+	}
+	return ct.last
+}
@@ -0,0 +1,74 @@
+package assembly
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChurnPerSecond(t *testing.T) {
+	ct := newChurnTracker()
+	start := time.Unix(1000, 0)
+	ct.opened("10.0.0.2", start)
+	ct.opened("10.0.0.3", start.Add(100*time.Millisecond))
+	ct.opened("10.0.0.3", start.Add(200*time.Millisecond))
+	ct.closed("10.0.0.2", start.Add(900*time.Millisecond))
+
+	rep := ct.report(start.Add(1500 * time.Millisecond))
+	if rep.Second != start || rep.Opens != 3 || rep.Closes != 1 {
+		t.Error("got report", rep)
+	}
+	expected := []ClientChurn{
+		{Client: "10.0.0.3", Opens: 2},
+		{Client: "10.0.0.2", Opens: 1, Closes: 1},
+	}
+	if len(rep.Clients) != len(expected) {
+		t.Fatal("got clients", rep.Clients, "expected", expected)
+	}
+	for i, cc := range expected {
+		if rep.Clients[i] != cc {
+			t.Error("got client", rep.Clients[i], "expected", cc)
+		}
+	}
+
+	// a quiet second follows
+	if rep := ct.report(start.Add(5 * time.Second)); rep.Opens != 0 || len(rep.Clients) != 0 {
+		t.Error("got report", rep, "for quiet second")
+	}
+}
+
+func TestChurnSpike(t *testing.T) {
+	ct := newChurnTracker()
+	start := time.Unix(1000, 0)
+	// a steady 2 connections per second establishes the baseline
+	for s := 0; s < 30; s++ {
+		for i := 0; i < 2; i++ {
+			ct.opened("10.0.0.2", start.Add(time.Duration(s)*time.Second))
+		}
+	}
+	rep := ct.report(start.Add(30 * time.Second))
+	if len(rep.Clients) != 1 || rep.Clients[0].Spike {
+		t.Fatal("got report", rep, "expected steady client")
+	}
+
+	for i := 0; i < 50; i++ {
+		ct.opened("10.0.0.2", start.Add(30*time.Second))
+	}
+	rep = ct.report(start.Add(31 * time.Second))
+	if len(rep.Clients) != 1 || !rep.Clients[0].Spike || rep.Clients[0].Opens != 50 {
+		t.Error("got report", rep, "expected spike")
+	}
+	if b := rep.Clients[0].Baseline; b < 1.5 || b > 2 {
+		t.Error("got baseline", b, "expected about 2")
+	}
+}
+
+func TestChurnWarmup(t *testing.T) {
+	ct := newChurnTracker()
+	start := time.Unix(1000, 0)
+	for i := 0; i < 50; i++ {
+		ct.opened("10.0.0.2", start)
+	}
+	if rep := ct.report(start.Add(time.Second)); rep.Clients[0].Spike {
+		t.Error("reported spike before learning baselines")
+	}
+}
@@ -0,0 +1,35 @@
+package assembly
+
+import "container/list"
+
+// most clients, or servers, tracked individually by each tracker.  Beyond
+// this, the least recently seen are forgotten, though they are still counted
+// in the totals.
+const maxClients = 1024
+
+// clientLRU orders the endpoints known to a tracker from the most to the
+// least recently seen, to find those to forget.
+type clientLRU struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newClientLRU() clientLRU {
+	return clientLRU{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// touch marks endpoint as the most recently seen, and returns the endpoint
+// to forget if there are now more than maxClients.
+func (l clientLRU) touch(endpoint string) (forget string, ok bool) {
+	if e, ok := l.elems[endpoint]; ok {
+		l.order.MoveToFront(e)
+		return "", false
+	}
+	l.elems[endpoint] = l.order.PushFront(endpoint)
+	if l.order.Len() <= maxClients {
+		return "", false
+	}
+	forget = l.order.Remove(l.order.Back()).(string)
+	delete(l.elems, forget)
+	return forget, true
+}
@@ -0,0 +1,30 @@
+package assembly
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLatencyClientsBounded(t *testing.T) {
+	lt := newLatencyTracker()
+	for i := 0; i < maxClients; i++ {
+		lt.addRequest(strconv.Itoa(i), 1)
+	}
+	// the first client is seen again, so the second is the least recent
+	lt.addRequest("0", 1)
+	lt.addRequest("new", 1)
+	if len(lt.clients) != maxClients {
+		t.Error("tracking", len(lt.clients), "clients, expected", maxClients)
+	}
+	if _, ok := lt.clients["1"]; ok {
+		t.Error("least recently seen client not forgotten")
+	}
+	for _, c := range []string{"0", "new"} {
+		if _, ok := lt.clients[c]; !ok {
+			t.Error("client", c, "forgotten")
+		}
+	}
+	if rep := lt.report(); rep.All.Request.Count != maxClients+2 {
+		t.Error("got total", rep.All.Request.Count, "expected", maxClients+2)
+	}
+}
@@ -0,0 +1,177 @@
+package assembly
+
+import (
+	"sync"
+	"time"
+
+	"github.com/box/memsniff/protocol/model"
+	"github.com/google/gopacket/layers"
+)
+
+// Connection describes the activity on a single TCP connection between a
+// memcached client and server.
+type Connection struct {
+	// Client and Server are the endpoints of the connection, as address:port.
+	Client string
+	Server string
+	// Start is the capture time of the first packet seen.
+	Start time.Time
+	// LastActivity is the capture time of the most recent packet seen.
+	LastActivity time.Time
+	// ClientBytes and ServerBytes count payload bytes sent by each side.
+	ClientBytes int
+	ServerBytes int
+	// Requests counts the client requests parsed.
+	Requests int
+	// Desyncs counts the times parsing lost track of the conversation.
+	Desyncs int
+	// Health counts signs of trouble in the packets sent each way.
+	Health
+}
+
+// connection is an entry in a connTable.
+type connection struct {
+	Connection
+	// parses the conversation, once the stream factory has created it
+	consumer *model.Consumer
+	// true once either side has sent a FIN or RST
+	closed bool
+	// sequence numbers sent by the client and server
+	clientSeq seqTracker
+	serverSeq seqTracker
+	// capture time of the server's SYN-ACK, while awaiting the client's ACK
+	synAck time.Time
+	// true if the SYN-ACK was sent more than once, so that the ACK cannot
+	// be matched to it
+	synAckRepeated bool
+}
+
+// sync copies the counts kept by the consumer.
+func (c *connection) sync() {
+	if c.consumer != nil {
+		c.Requests = c.consumer.Requests
+		c.Desyncs = c.consumer.Desyncs
+	}
+}
+
+// connTable tracks the TCP connections handled by a single assembly worker.
+// It is updated by the worker and read by the UI, so mu must be held while
+// accessing conns.
+type connTable struct {
+	mu    sync.Mutex
+	conns map[connectionKey]*connection
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[connectionKey]*connection)}
+}
+
+// connEvent is a change in the state of a connection.
+type connEvent int
+
+const (
+	connUnchanged connEvent = iota
+	// the client sent a SYN
+	connOpened
+	// either side sent the first FIN or RST
+	connClosed
+)
+
+// trackResult describes what a single packet revealed about its connection.
+type trackResult struct {
+	event connEvent
+	// signs of trouble in the packet
+	health Health
+	// the handshake round trip time, if the packet completed the handshake
+	rtt time.Duration
+}
+
+// track records a TCP packet on the connection ck, which is oriented from
+// the server to the client, and returns the connection and what the packet
+// revealed about it.  truncated is the number of payload bytes that were not
+// captured.
+func (t *connTable) track(ck connectionKey, fromServer bool, tcp *layers.TCP, truncated int, timestamp time.Time) (*connection, trackResult) {
+	var res trackResult
+	if tcp.SYN && !tcp.ACK {
+		res.event = connOpened
+	}
+	c, ok := t.conns[ck]
+	if !ok || (c.closed && tcp.SYN) {
+		c = &connection{
+			Connection: Connection{
+				Client: ck.DstString(),
+				Server: ck.SrcString(),
+				Start:  timestamp,
+			},
+		}
+		t.conns[ck] = c
+	}
+	c.LastActivity = timestamp
+	if fromServer {
+		c.ServerBytes += len(tcp.Payload) + truncated
+		res.health = checkHealth(tcp, truncated, &c.serverSeq)
+	} else {
+		c.ClientBytes += len(tcp.Payload) + truncated
+		res.health = checkHealth(tcp, truncated, &c.clientSeq)
+	}
+	c.Health.add(res.health)
+	res.rtt = c.handshake(fromServer, tcp, timestamp)
+	if (tcp.FIN || tcp.RST) && !c.closed {
+		c.closed = true
+		if res.event == connUnchanged {
+			res.event = connClosed
+		}
+	}
+	return c, res
+}
+
+// handshake follows the TCP handshake, returning the round trip time from
+// the server's SYN-ACK to the client's ACK once the ACK arrives, or zero.
+func (c *connection) handshake(fromServer bool, tcp *layers.TCP, timestamp time.Time) time.Duration {
+	switch {
+	case fromServer && tcp.SYN && tcp.ACK:
+		if !c.synAck.IsZero() {
+			c.synAckRepeated = true
+		}
+		c.synAck = timestamp
+	case !fromServer && tcp.ACK && !tcp.SYN && !c.synAck.IsZero():
+		rtt := timestamp.Sub(c.synAck)
+		repeated := c.synAckRepeated
+		c.synAck = time.Time{}
+		if !repeated && rtt > 0 {
+			return rtt
+		}
+	}
+	return 0
+}
+
+// setConsumer records the consumer parsing the connection ck, if it is being
+// tracked.  mu must be held.
+func (t *connTable) setConsumer(ck connectionKey, consumer *model.Consumer) {
+	if c, ok := t.conns[ck]; ok {
+		c.consumer = consumer
+	}
+}
+
+// flushOlderThan forgets connections with no activity since before cutoff.
+func (t *connTable) flushOlderThan(cutoff time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ck, c := range t.conns {
+		if c.LastActivity.Before(cutoff) {
+			delete(t.conns, ck)
+		}
+	}
+}
+
+// appendOpen appends the connections that have not been closed to conns.
+func (t *connTable) appendOpen(conns []Connection) []Connection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.conns {
+		if !c.closed {
+			conns = append(conns, c.Connection)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,72 @@
+package assembly
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/box/memsniff/decode"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestConnectionTable(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	start := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string, ts time.Time) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 40000, 11211, 1024
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, ts))
+	}
+	fromServer := func(tcp layers.TCP, data string, ts time.Time) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 11211, 40000, 1024
+		w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, ts))
+	}
+
+	fromClient(layers.TCP{Seq: 100, SYN: true}, "", start)
+	fromServer(layers.TCP{Seq: 500, SYN: true, ACK: true}, "", start)
+	fromClient(layers.TCP{Seq: 101, ACK: true}, "get foo\r\n", start.Add(time.Second))
+	fromServer(layers.TCP{Seq: 501, ACK: true}, "END\r\n", start.Add(2*time.Second))
+
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatal("got connections", conns, "expected 1")
+	}
+	expected := Connection{
+		Client:       "10.0.0.2:40000",
+		Server:       "10.0.0.1:11211",
+		Start:        start,
+		LastActivity: start.Add(2 * time.Second),
+		ClientBytes:  9,
+		ServerBytes:  5,
+		Requests:     1,
+	}
+	if conns[0] != expected {
+		t.Error("got connection", conns[0], "expected", expected)
+	}
+
+	fromClient(layers.TCP{Seq: 110, FIN: true, ACK: true}, "", start.Add(3*time.Second))
+	if conns := p.Connections(); len(conns) != 0 {
+		t.Error("closed connection still listed:", conns)
+	}
+	w.conns.flushOlderThan(start.Add(time.Hour))
+	if len(w.conns.conns) != 0 {
+		t.Error("idle connection not flushed")
+	}
+}
+
+// tcpPacket returns a decoded TCP packet with the flags and sequence number
+// of tcp, and data as its payload.
+func tcpPacket(t *testing.T, src, dst string, tcp layers.TCP, data string, ts time.Time) *decode.DecodedPacket {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &tcp, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	dp := &decode.DecodedPacket{
+		Info:    gopacket.CaptureInfo{Timestamp: ts},
+		NetFlow: gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(src).To4(), net.ParseIP(dst).To4()),
+	}
+	if err := dp.TCP.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return dp
+}
@@ -0,0 +1,94 @@
+package assembly
+
+import (
+	"sync"
+
+	"github.com/box/memsniff/protocol/model"
+)
+
+// number of recent offending lines kept for each cause of desync
+const desyncSamples = 5
+
+// DesyncCause counts the times parsing lost track of conversations for a
+// single reason.
+type DesyncCause struct {
+	Cause string
+	Count int
+	// Skipped is the number of bytes lost or discarded before parsing
+	// resumed.
+	Skipped int
+	// Samples are the most recent lines or requests being parsed when the
+	// conversation was lost, oldest first.
+	Samples []string
+}
+
+// DesyncReport counts the times parsing lost track of conversations since
+// capture started, by cause.
+type DesyncReport struct {
+	Causes []DesyncCause
+}
+
+type desyncCounts struct {
+	count   int
+	skipped int
+	samples []string
+	next    int
+}
+
+func (dc *desyncCounts) add(d model.Desync) {
+	dc.count++
+	dc.skipped += d.Skipped
+	if d.Sample == "" {
+		return
+	}
+	if len(dc.samples) < desyncSamples {
+		dc.samples = append(dc.samples, d.Sample)
+	} else {
+		dc.samples[dc.next] = d.Sample
+		dc.next = (dc.next + 1) % desyncSamples
+	}
+}
+
+// orderedSamples returns the samples oldest first.
+func (dc *desyncCounts) orderedSamples() []string {
+	samples := make([]string, 0, len(dc.samples))
+	samples = append(samples, dc.samples[dc.next:]...)
+	return append(samples, dc.samples[:dc.next]...)
+}
+
+// desyncTracker collects the desyncs of consumers from all workers.
+type desyncTracker struct {
+	mu     sync.Mutex
+	causes [model.NumDesyncCauses]desyncCounts
+}
+
+func (dt *desyncTracker) add(d model.Desync) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if d.Cause >= 0 && d.Cause < model.NumDesyncCauses {
+		dt.causes[d.Cause].add(d)
+	}
+}
+
+// reset forgets every desync counted so far.
+func (dt *desyncTracker) reset() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.causes = [model.NumDesyncCauses]desyncCounts{}
+}
+
+func (dt *desyncTracker) report() DesyncReport {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	rep := DesyncReport{Causes: make([]DesyncCause, len(dt.causes))}
+	for i := range dt.causes {
+		dc := &dt.causes[i]
+		rep.Causes[i] = DesyncCause{
+			Cause:   model.DesyncCause(i).String(),
+			Count:   dc.count,
+			Skipped: dc.skipped,
+			Samples: dc.orderedSamples(),
+		}
+	}
+	return rep
+}
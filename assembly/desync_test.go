@@ -0,0 +1,29 @@
+package assembly
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/box/memsniff/protocol/model"
+)
+
+func TestDesyncTracker(t *testing.T) {
+	dt := &desyncTracker{}
+	dt.add(model.Desync{Cause: model.DesyncLostData, Skipped: 100})
+	for _, sample := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		dt.add(model.Desync{Cause: model.DesyncProtocol, Skipped: 1, Sample: sample})
+	}
+
+	rep := dt.report()
+	if len(rep.Causes) != int(model.NumDesyncCauses) {
+		t.Fatal("got causes", rep.Causes)
+	}
+	expected := DesyncCause{Cause: "lost data", Count: 1, Skipped: 100, Samples: []string{}}
+	if !reflect.DeepEqual(rep.Causes[model.DesyncLostData], expected) {
+		t.Error("got", rep.Causes[model.DesyncLostData], "expected", expected)
+	}
+	expected = DesyncCause{Cause: "protocol desync", Count: 7, Skipped: 7, Samples: []string{"c", "d", "e", "f", "g"}}
+	if !reflect.DeepEqual(rep.Causes[model.DesyncProtocol], expected) {
+		t.Error("got", rep.Causes[model.DesyncProtocol], "expected", expected)
+	}
+}
@@ -0,0 +1,236 @@
+package assembly
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Health counts signs of trouble in TCP packets.
+type Health struct {
+	// Retransmits counts segments carrying only data already sent.
+	Retransmits int
+	// ZeroWindows counts packets advertising a zero receive window,
+	// meaning the sender is not reading data as fast as it arrives.
+	ZeroWindows int
+	// Resets counts packets with the RST flag.
+	Resets int
+}
+
+func (h *Health) add(o Health) {
+	h.Retransmits += o.Retransmits
+	h.ZeroWindows += o.ZeroWindows
+	h.Resets += o.Resets
+}
+
+// Total returns the count of all signs of trouble.
+func (h Health) Total() int {
+	return h.Retransmits + h.ZeroWindows + h.Resets
+}
+
+// most gaps in the sequence numbers seen that each seqTracker remembers
+const maxSeqHoles = 16
+
+// seqTracker follows the sequence numbers sent by one side of a connection.
+type seqTracker struct {
+	// the sequence numbers from low up to next have been seen, except for
+	// those in holes, which are in ascending order
+	low, next uint32
+	holes     []seqRange
+	valid     bool
+}
+
+// retransmit returns true if tcp carries any sequence numbers that have
+// already been seen, and records them.  Packets arriving out of order into a
+// gap are not retransmissions.  truncated is the number of payload bytes
+// beyond those captured.
+func (s *seqTracker) retransmit(tcp *layers.TCP, truncated int) bool {
+	n := len(tcp.Payload) + truncated
+	if tcp.SYN {
+		n++
+	}
+	if tcp.FIN {
+		n++
+	}
+	if n == 0 {
+		// a pure ACK, which does not advance the sequence number
+		return false
+	}
+	start, end := tcp.Seq, tcp.Seq+uint32(n)
+	if !s.valid {
+		s.low, s.next, s.valid = start, end, true
+		return false
+	}
+	seen := s.seen(start, end)
+	s.add(start, end)
+	return seen
+}
+
+// seen returns true if any sequence number from start up to end has been seen.
+func (s *seqTracker) seen(start, end uint32) bool {
+	if int32(start-s.low) < 0 {
+		start = s.low
+	}
+	if int32(end-s.next) > 0 {
+		end = s.next
+	}
+	for _, h := range s.holes {
+		if int32(end-start) <= 0 {
+			return false
+		}
+		if int32(h.end()-start) <= 0 {
+			continue
+		}
+		if int32(h.start-start) > 0 {
+			// seen from start up to the hole
+			return true
+		}
+		start = h.end()
+	}
+	return int32(end-start) > 0
+}
+
+// add records the sequence numbers from start up to end as seen.
+func (s *seqTracker) add(start, end uint32) {
+	if int32(start-s.low) < 0 {
+		if int32(end-s.low) < 0 {
+			s.holes = append([]seqRange{{end, int(s.low - end)}}, s.holes...)
+		}
+		s.low = start
+	}
+	if int32(end-s.next) > 0 {
+		if int32(start-s.next) > 0 {
+			s.holes = append(s.holes, seqRange{s.next, int(start - s.next)})
+		}
+		s.next = end
+	}
+	if len(s.holes) > 0 {
+		holes := make([]seqRange, 0, len(s.holes)+1)
+		for _, h := range s.holes {
+			if int32(h.end()-start) <= 0 || int32(end-h.start) <= 0 {
+				holes = append(holes, h)
+				continue
+			}
+			if int32(start-h.start) > 0 {
+				holes = append(holes, seqRange{h.start, int(start - h.start)})
+			}
+			if int32(h.end()-end) > 0 {
+				holes = append(holes, seqRange{end, int(h.end() - end)})
+			}
+		}
+		s.holes = holes
+	}
+	for len(s.holes) > maxSeqHoles {
+		// forget what was seen before the oldest gap rather than take
+		// the data that fills it for retransmissions
+		s.low = s.holes[0].end()
+		s.holes = s.holes[1:]
+	}
+}
+
+// checkHealth returns the signs of trouble in a single TCP packet, using seq
+// to recognize retransmissions.
+func checkHealth(tcp *layers.TCP, truncated int, seq *seqTracker) Health {
+	var h Health
+	if seq.retransmit(tcp, truncated) {
+		h.Retransmits++
+	}
+	if tcp.RST {
+		h.Resets++
+	} else if tcp.Window == 0 {
+		h.ZeroWindows++
+	}
+	return h
+}
+
+// EndpointHealth counts the signs of trouble in packets sent by a single
+// client or server.
+type EndpointHealth struct {
+	Endpoint string
+	Health
+}
+
+// HealthReport counts signs of trouble in TCP packets since capture started.
+type HealthReport struct {
+	Total Health
+	// Clients and Servers count trouble by the sender of the packets, with
+	// the most troubled first.  Clients are identified by address, and
+	// servers by address:port.
+	Clients []EndpointHealth
+	Servers []EndpointHealth
+}
+
+// healthTracker aggregates the signs of trouble found by all workers.
+type healthTracker struct {
+	mu      sync.Mutex
+	total   Health
+	clients map[string]*Health
+	servers map[string]*Health
+	// the most recently seen of clients and servers
+	clientLRU, serverLRU clientLRU
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		clients:   make(map[string]*Health),
+		servers:   make(map[string]*Health),
+		clientLRU: newClientLRU(),
+		serverLRU: newClientLRU(),
+	}
+}
+
+// add counts the trouble in a packet sent by client to server, or by server
+// to client if fromServer is true.
+func (ht *healthTracker) add(client, server string, fromServer bool, h Health) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.total.add(h)
+	m, endpoint, lru := ht.clients, client, ht.clientLRU
+	if fromServer {
+		m, endpoint, lru = ht.servers, server, ht.serverLRU
+	}
+	if forget, ok := lru.touch(endpoint); ok {
+		delete(m, forget)
+	}
+	eh, ok := m[endpoint]
+	if !ok {
+		eh = &Health{}
+		m[endpoint] = eh
+	}
+	eh.add(h)
+}
+
+// reset forgets everything counted so far.
+func (ht *healthTracker) reset() {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.total = Health{}
+	ht.clients = make(map[string]*Health)
+	ht.servers = make(map[string]*Health)
+	ht.clientLRU, ht.serverLRU = newClientLRU(), newClientLRU()
+}
+
+func (ht *healthTracker) report() HealthReport {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	return HealthReport{
+		Total:   ht.total,
+		Clients: sortedHealth(ht.clients),
+		Servers: sortedHealth(ht.servers),
+	}
+}
+
+func sortedHealth(m map[string]*Health) []EndpointHealth {
+	ehs := make([]EndpointHealth, 0, len(m))
+	for endpoint, h := range m {
+		ehs = append(ehs, EndpointHealth{endpoint, *h})
+	}
+	sort.Slice(ehs, func(i, j int) bool {
+		if ehs[i].Total() != ehs[j].Total() {
+			return ehs[i].Total() > ehs[j].Total()
+		}
+		return ehs[i].Endpoint < ehs[j].Endpoint
+	})
+	return ehs
+}
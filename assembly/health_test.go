@@ -0,0 +1,77 @@
+package assembly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestHealth(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	ts := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort = 40000, 11211
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, ts))
+	}
+	fromServer := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort = 11211, 40000
+		w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, ts))
+	}
+
+	fromClient(layers.TCP{Seq: 101, ACK: true, Window: 1024}, "get foo\r\n")
+	// the request is sent again
+	fromClient(layers.TCP{Seq: 101, ACK: true, Window: 1024}, "get foo\r\n")
+	// a pure ACK is not a retransmission
+	fromClient(layers.TCP{Seq: 110, ACK: true, Window: 1024}, "")
+	fromClient(layers.TCP{Seq: 110, ACK: true, Window: 1024}, "")
+	// the server stops reading
+	fromServer(layers.TCP{Seq: 501, ACK: true}, "")
+	if conns := p.Connections(); len(conns) != 1 || conns[0].Health != (Health{Retransmits: 1, ZeroWindows: 1}) {
+		t.Error("got connections", conns)
+	}
+	fromClient(layers.TCP{Seq: 110, RST: true}, "")
+
+	rep := p.Health()
+	if rep.Total != (Health{Retransmits: 1, ZeroWindows: 1, Resets: 1}) {
+		t.Error("got total", rep.Total)
+	}
+	expectedClients := []EndpointHealth{{"10.0.0.2", Health{Retransmits: 1, Resets: 1}}}
+	expectedServers := []EndpointHealth{{"10.0.0.1:11211", Health{ZeroWindows: 1}}}
+	if len(rep.Clients) != 1 || rep.Clients[0] != expectedClients[0] {
+		t.Error("got clients", rep.Clients, "expected", expectedClients)
+	}
+	if len(rep.Servers) != 1 || rep.Servers[0] != expectedServers[0] {
+		t.Error("got servers", rep.Servers, "expected", expectedServers)
+	}
+}
+
+func TestRetransmitOutOfOrder(t *testing.T) {
+	var s seqTracker
+	for _, tc := range []struct {
+		seq        uint32
+		data       string
+		retransmit bool
+	}{
+		{110, "bar\r\n", false},
+		// arriving late, before the first packet seen
+		{101, "get foo\r\n", false},
+		{120, "baz\r\n", false},
+		// filling part of the gap, then the rest of it
+		{115, "ge", false},
+		{117, "t ", false},
+		{119, "x", false},
+		// overlapping data already seen
+		{113, "\r\nget", true},
+		{125, "get qux\r\n", false},
+		{125, "get qux\r\n", true},
+	} {
+		tcp := layers.TCP{Seq: tc.seq, BaseLayer: layers.BaseLayer{Payload: []byte(tc.data)}}
+		if got := s.retransmit(&tcp, 0); got != tc.retransmit {
+			t.Error("packet at", tc.seq, "got retransmit", got, "expected", tc.retransmit)
+		}
+	}
+	if len(s.holes) != 0 {
+		t.Error("got holes", s.holes)
+	}
+}
@@ -0,0 +1,153 @@
+package assembly
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of recent samples kept for each client
+const latencySamples = 256
+
+// Percentiles summarizes a set of durations.
+type Percentiles struct {
+	// Count is the number of durations measured, which may be more than
+	// the number of recent samples the percentiles are computed from.
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// ClientLatency summarizes the round trip times and request latencies of a
+// single client, or of all clients.
+type ClientLatency struct {
+	Client string
+	// RTT is the network round trip time measured during TCP handshakes,
+	// from the server's SYN-ACK to the client's ACK.
+	RTT Percentiles
+	// Request is the time from each memcached request to the start of its
+	// response.
+	Request Percentiles
+}
+
+// LatencyReport summarizes the latencies measured since capture started.
+type LatencyReport struct {
+	All ClientLatency
+	// Clients lists each client by address, with the slowest requests
+	// first.
+	Clients []ClientLatency
+}
+
+// sampleRing keeps the most recent durations measured.
+type sampleRing struct {
+	samples []time.Duration
+	next    int
+	count   int
+}
+
+func (r *sampleRing) add(d time.Duration) {
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+		r.next = (r.next + 1) % latencySamples
+	}
+	r.count++
+}
+
+func (r *sampleRing) percentiles() Percentiles {
+	p := Percentiles{Count: r.count}
+	if len(r.samples) == 0 {
+		return p
+	}
+	sorted := append([]time.Duration(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	p.P50, p.P90, p.P99 = at(0.5), at(0.9), at(0.99)
+	return p
+}
+
+type latencySamplesByKind struct {
+	rtt, request sampleRing
+}
+
+func (s *latencySamplesByKind) report(client string) ClientLatency {
+	return ClientLatency{
+		Client:  client,
+		RTT:     s.rtt.percentiles(),
+		Request: s.request.percentiles(),
+	}
+}
+
+// latencyTracker collects handshake round trip times and request latencies
+// from all workers.
+type latencyTracker struct {
+	mu      sync.Mutex
+	all     latencySamplesByKind
+	clients map[string]*latencySamplesByKind
+	lru     clientLRU
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{clients: make(map[string]*latencySamplesByKind), lru: newClientLRU()}
+}
+
+func (lt *latencyTracker) client(client string) *latencySamplesByKind {
+	if forget, ok := lt.lru.touch(client); ok {
+		delete(lt.clients, forget)
+	}
+	s, ok := lt.clients[client]
+	if !ok {
+		s = &latencySamplesByKind{}
+		lt.clients[client] = s
+	}
+	return s
+}
+
+// addRTT records a handshake round trip time to client.
+func (lt *latencyTracker) addRTT(client string, rtt time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.all.rtt.add(rtt)
+	lt.client(client).rtt.add(rtt)
+}
+
+// addRequest records the latency of a request from client.
+func (lt *latencyTracker) addRequest(client string, latency time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.all.request.add(latency)
+	lt.client(client).request.add(latency)
+}
+
+// reset forgets every sample taken so far.
+func (lt *latencyTracker) reset() {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.all = latencySamplesByKind{}
+	lt.clients = make(map[string]*latencySamplesByKind)
+	lt.lru = newClientLRU()
+}
+
+func (lt *latencyTracker) report() LatencyReport {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	rep := LatencyReport{
+		All:     lt.all.report(""),
+		Clients: make([]ClientLatency, 0, len(lt.clients)),
+	}
+	for client, s := range lt.clients {
+		rep.Clients = append(rep.Clients, s.report(client))
+	}
+	sort.Slice(rep.Clients, func(i, j int) bool {
+		a, b := rep.Clients[i], rep.Clients[j]
+		if a.Request.P99 != b.Request.P99 {
+			return a.Request.P99 > b.Request.P99
+		}
+		return a.Client < b.Client
+	})
+	return rep
+}
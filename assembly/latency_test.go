@@ -0,0 +1,53 @@
+package assembly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestHandshakeAndRequestLatency(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	start := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string, after time.Duration) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 40000, 11211, 1024
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, start.Add(after)))
+	}
+	fromServer := func(tcp layers.TCP, data string, after time.Duration) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 11211, 40000, 1024
+		w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, start.Add(after)))
+	}
+
+	fromClient(layers.TCP{Seq: 100, SYN: true}, "", 0)
+	fromServer(layers.TCP{Seq: 500, SYN: true, ACK: true}, "", time.Millisecond)
+	fromClient(layers.TCP{Seq: 101, ACK: true}, "", 6*time.Millisecond)
+	fromClient(layers.TCP{Seq: 101, ACK: true}, "get foo\r\n", 10*time.Millisecond)
+	fromServer(layers.TCP{Seq: 501, ACK: true}, "END\r\n", 12*time.Millisecond)
+
+	rep := p.Latency()
+	expected := ClientLatency{
+		Client:  "10.0.0.2",
+		RTT:     Percentiles{Count: 1, P50: 5 * time.Millisecond, P90: 5 * time.Millisecond, P99: 5 * time.Millisecond},
+		Request: Percentiles{Count: 1, P50: 2 * time.Millisecond, P90: 2 * time.Millisecond, P99: 2 * time.Millisecond},
+	}
+	if len(rep.Clients) != 1 || rep.Clients[0] != expected {
+		t.Error("got clients", rep.Clients, "expected", expected)
+	}
+	expected.Client = ""
+	if rep.All != expected {
+		t.Error("got overall", rep.All, "expected", expected)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var r sampleRing
+	for i := 1; i <= 2*latencySamples; i++ {
+		r.add(time.Duration(i))
+	}
+	p := r.percentiles()
+	// only the most recent samples are kept
+	if p.Count != 2*latencySamples || p.P50 != 385 || p.P90 != 487 || p.P99 != 509 {
+		t.Error("got percentiles", p)
+	}
+}
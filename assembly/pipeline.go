@@ -0,0 +1,208 @@
+package assembly
+
+import (
+	"sort"
+	"sync"
+)
+
+// histogramBuckets is the number of buckets in a histogram.  The first
+// bucket counts values up to 1, each following bucket values up to twice
+// those of the one before, and the last bucket everything larger.
+const histogramBuckets = 11
+
+// Bucket counts the values from Min to Max inclusive.  Max is zero for the
+// last bucket, which has no upper bound.
+type Bucket struct {
+	Min   int
+	Max   int
+	Count int
+}
+
+// Distribution summarizes a histogram of counts.  Percentiles are
+// approximate, giving the upper bound of the bucket they fall in.
+type Distribution struct {
+	Count   int
+	Mean    float64
+	P50     int
+	P99     int
+	Max     int
+	Buckets []Bucket
+}
+
+// ClientPipeline describes how many keys a single client, or all clients,
+// asks for at once and how deeply it pipelines requests.
+type ClientPipeline struct {
+	Client string
+	// KeysPerGet counts the keys in each get request.
+	KeysPerGet Distribution
+	// Outstanding counts the requests sent but not yet answered on a
+	// connection when each response starts.  More than one means requests
+	// were pipelined, each waiting behind the ones before.
+	Outstanding Distribution
+}
+
+// PipelineReport describes multi-get fan-out and request pipelining since
+// capture started.
+type PipelineReport struct {
+	All ClientPipeline
+	// Clients lists each client by address, with the most deeply
+	// pipelined first.
+	Clients []ClientPipeline
+}
+
+// bucketBounds returns the smallest and largest values counted by bucket i.
+func bucketBounds(i int) (min, max int) {
+	if i == 0 {
+		return 1, 1
+	}
+	min = 1<<uint(i-1) + 1
+	if i < histogramBuckets-1 {
+		max = 1 << uint(i)
+	}
+	return
+}
+
+// histogram counts values in buckets of exponentially increasing size.
+type histogram struct {
+	buckets [histogramBuckets]int
+	count   int
+	sum     int
+	max     int
+}
+
+func (h *histogram) add(v int) {
+	i := 0
+	for i < histogramBuckets-1 && v > 1<<uint(i) {
+		i++
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// percentile returns the upper bound of the bucket holding quantile q, or
+// the largest value if that is smaller.
+func (h *histogram) percentile(q float64) int {
+	target := int(q*float64(h.count)+0.5) - 1
+	if target < 0 {
+		target = 0
+	}
+	var seen int
+	for i, n := range h.buckets {
+		seen += n
+		if seen > target {
+			_, max := bucketBounds(i)
+			if max == 0 || max > h.max {
+				return h.max
+			}
+			return max
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) distribution() Distribution {
+	d := Distribution{
+		Count:   h.count,
+		Max:     h.max,
+		Buckets: make([]Bucket, histogramBuckets),
+	}
+	for i, n := range h.buckets {
+		min, max := bucketBounds(i)
+		d.Buckets[i] = Bucket{Min: min, Max: max, Count: n}
+	}
+	if h.count > 0 {
+		d.Mean = float64(h.sum) / float64(h.count)
+		d.P50, d.P99 = h.percentile(0.5), h.percentile(0.99)
+	}
+	return d
+}
+
+type pipelineHistograms struct {
+	keysPerGet, outstanding histogram
+}
+
+func (ph *pipelineHistograms) report(client string) ClientPipeline {
+	return ClientPipeline{
+		Client:      client,
+		KeysPerGet:  ph.keysPerGet.distribution(),
+		Outstanding: ph.outstanding.distribution(),
+	}
+}
+
+// pipelineTracker collects the keys per get and outstanding requests from
+// all workers.
+type pipelineTracker struct {
+	mu      sync.Mutex
+	all     pipelineHistograms
+	clients map[string]*pipelineHistograms
+	lru     clientLRU
+}
+
+func newPipelineTracker() *pipelineTracker {
+	return &pipelineTracker{clients: make(map[string]*pipelineHistograms), lru: newClientLRU()}
+}
+
+func (pt *pipelineTracker) client(client string) *pipelineHistograms {
+	if forget, ok := pt.lru.touch(client); ok {
+		delete(pt.clients, forget)
+	}
+	ph, ok := pt.clients[client]
+	if !ok {
+		ph = &pipelineHistograms{}
+		pt.clients[client] = ph
+	}
+	return ph
+}
+
+// addGet records a get request for keys keys from client.
+func (pt *pipelineTracker) addGet(client string, keys int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.all.keysPerGet.add(keys)
+	pt.client(client).keysPerGet.add(keys)
+}
+
+// addOutstanding records the requests outstanding on a connection from client
+// when a response started.
+func (pt *pipelineTracker) addOutstanding(client string, outstanding int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.all.outstanding.add(outstanding)
+	pt.client(client).outstanding.add(outstanding)
+}
+
+// reset forgets every measurement taken so far.
+func (pt *pipelineTracker) reset() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.all = pipelineHistograms{}
+	pt.clients = make(map[string]*pipelineHistograms)
+	pt.lru = newClientLRU()
+}
+
+func (pt *pipelineTracker) report() PipelineReport {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	rep := PipelineReport{
+		All:     pt.all.report(""),
+		Clients: make([]ClientPipeline, 0, len(pt.clients)),
+	}
+	for client, ph := range pt.clients {
+		rep.Clients = append(rep.Clients, ph.report(client))
+	}
+	sort.Slice(rep.Clients, func(i, j int) bool {
+		a, b := rep.Clients[i], rep.Clients[j]
+		if a.Outstanding.P99 != b.Outstanding.P99 {
+			return a.Outstanding.P99 > b.Outstanding.P99
+		}
+		if a.KeysPerGet.P99 != b.KeysPerGet.P99 {
+			return a.KeysPerGet.P99 > b.KeysPerGet.P99
+		}
+		return a.Client < b.Client
+	})
+	return rep
+}
@@ -0,0 +1,37 @@
+package assembly
+
+import "testing"
+
+func TestPipelineTracker(t *testing.T) {
+	pt := newPipelineTracker()
+	for i := 0; i < 98; i++ {
+		pt.addGet("10.0.0.2", 1)
+		pt.addOutstanding("10.0.0.2", 1)
+	}
+	pt.addGet("10.0.0.2", 500)
+	pt.addGet("10.0.0.2", 500)
+	pt.addOutstanding("10.0.0.3", 3)
+	pt.addOutstanding("10.0.0.3", 40)
+
+	rep := pt.report()
+	if len(rep.Clients) != 2 || rep.Clients[0].Client != "10.0.0.3" {
+		t.Fatal("got clients", rep.Clients, "expected the deepest pipeline first")
+	}
+	keys := rep.Clients[1].KeysPerGet
+	if keys.Count != 100 || keys.Mean != 10.98 || keys.P50 != 1 || keys.P99 != 500 || keys.Max != 500 {
+		t.Error("got keys per get", keys)
+	}
+	if b := keys.Buckets[9]; b != (Bucket{Min: 257, Max: 512, Count: 2}) {
+		t.Error("got bucket", b)
+	}
+	if b := keys.Buckets[histogramBuckets-1]; b != (Bucket{Min: 513}) {
+		t.Error("got last bucket", b)
+	}
+	outstanding := rep.Clients[0].Outstanding
+	if outstanding.Count != 2 || outstanding.P50 != 4 || outstanding.P99 != 40 {
+		t.Error("got outstanding", outstanding)
+	}
+	if all := rep.All.Outstanding; all.Count != 100 || all.P50 != 1 || all.P99 != 4 || all.Buckets[0].Count != 98 {
+		t.Error("got all outstanding", all)
+	}
+}
@@ -1,47 +1,203 @@
 package assembly
 
 import (
+	"net"
+	"sync"
+	"time"
+
 	"github.com/box/memsniff/analysis"
 	"github.com/box/memsniff/decode"
 	"github.com/box/memsniff/log"
 )
 
+// size of the pages in which tcpassembly buffers out-of-order data
+const pageSize = 1900
+
+// Buffering controls how long the workers wait for missing TCP segments and
+// idle connections.
+type Buffering struct {
+	// ReorderPackets is the number of out-of-order packets buffered for each
+	// connection while waiting for a missing one.  Once exceeded, the
+	// missing data is reported as lost and parsing carries on.
+	ReorderPackets int
+	// MaxMemory limits the bytes of out-of-order data buffered across all
+	// workers.  Once reached, missing data is skipped on every connection.
+	MaxMemory int
+	// IdleTimeout is how long, in capture time, a connection may go without
+	// packets before any data still missing is skipped and the connection
+	// is forgotten.
+	IdleTimeout time.Duration
+}
+
+// DefaultBuffering skips missing data immediately, so that lost packets do
+// not delay the data following them.
+var DefaultBuffering = Buffering{
+	ReorderPackets: 0,
+	MaxMemory:      16 * 1024 * 1024,
+	IdleTimeout:    time.Minute,
+}
+
+// pagesPerConnection returns the per-connection limit for tcpassembly, which
+// skips missing data as soon as a connection holds that many pages.
+func (b Buffering) pagesPerConnection() int {
+	if b.ReorderPackets < 0 {
+		return 1
+	}
+	return b.ReorderPackets + 1
+}
+
+// pagesPerWorker returns the share of MaxMemory given to each of numWorkers,
+// in pages.  It is always at least one, since tcpassembly treats zero as
+// unlimited.
+func (b Buffering) pagesPerWorker(numWorkers int) int {
+	pages := b.MaxMemory / pageSize / numWorkers
+	if pages < 1 {
+		return 1
+	}
+	return pages
+}
+
+// Stats counts the work done by the assembly workers.
+type Stats struct {
+	// Flushed counts TCP streams, one in each direction of a connection,
+	// that went idle for IdleTimeout and on which any data still missing
+	// was skipped.
+	Flushed int
+	// Closed counts the idle streams that were then closed.
+	Closed int
+	// PacketsDropped counts packets dropped because a worker's queue was
+	// full.
+	PacketsDropped int
+	// LostData counts gaps in TCP streams, where missing data had to be
+	// skipped, whether or not parsing lost track of the conversation as a
+	// result.
+	LostData int
+	// Resyncs counts the times parsing lost track of a conversation, due to
+	// lost data or otherwise, and resumed at the next command.
+	Resyncs int
+}
+
+func (s *Stats) add(o Stats) {
+	s.Flushed += o.Flushed
+	s.Closed += o.Closed
+	s.PacketsDropped += o.PacketsDropped
+	s.LostData += o.LostData
+	s.Resyncs += o.Resyncs
+}
+
+// workerStats holds the Stats of a single worker, which are updated by the
+// worker and read by the UI.
+type workerStats struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (ws *workerStats) add(s Stats) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.stats.add(s)
+}
+
+func (ws *workerStats) get() Stats {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.stats
+}
+
+func (ws *workerStats) reset() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.stats = Stats{}
+}
+
+// trackers gathers the measurements shared by all workers of a Pool.
+type trackers struct {
+	churn    *churnTracker
+	health   *healthTracker
+	latency  *latencyTracker
+	pipeline *pipelineTracker
+	desyncs  *desyncTracker
+}
+
+func newTrackers() trackers {
+	return trackers{
+		churn:    newChurnTracker(),
+		health:   newHealthTracker(),
+		latency:  newLatencyTracker(),
+		pipeline: newPipelineTracker(),
+		desyncs:  &desyncTracker{},
+	}
+}
+
 // Pool manages a set of workers each responsible for a set of TCP conversations (stream pairs).
 type Pool struct {
 	Logger  log.Logger
 	workers []worker
+	trackers
 }
 
 // New creates a new pool for reassembling TCP streams.
-func New(logger log.Logger, analysis *analysis.Pool, memcachePorts []int, numWorkers int) *Pool {
+//
+// servers, if not empty, lists the networks containing memcached servers and
+// is used to tell requests from responses.  buffering controls how long each
+// worker waits for missing data.
+func New(logger log.Logger, analysis *analysis.Pool, memcachePorts []int, servers []*net.IPNet,
+	buffering Buffering, numWorkers int) *Pool {
 	p := &Pool{
-		logger,
-		make([]worker, numWorkers),
+		Logger:   logger,
+		workers:  make([]worker, numWorkers),
+		trackers: newTrackers(),
 	}
 	for i := 0; i < numWorkers; i++ {
-		p.workers[i] = newWorker(logger, analysis, memcachePorts)
+		p.workers[i] = newWorker(logger, analysis, memcachePorts, servers, buffering, numWorkers, &p.trackers)
 	}
 	return p
 }
 
-// HandlePackets partitions packets by connection and dispatches them to assembly workers.
-func (p *Pool) HandlePackets(dps []*decode.DecodedPacket) (err error) {
+// HandlePackets partitions packets by connection and dispatches them to
+// assembly workers.  Packets for a worker whose queue is full are dropped and
+// counted in its Stats.
+func (p *Pool) HandlePackets(dps []*decode.DecodedPacket) {
 	perWorker := p.partition(dps)
 	doneCh := make(chan struct{}, len(p.workers))
 	var batchesSent int
 	for i, packets := range perWorker {
 		if len(packets) > 0 {
-			batchesSent++
-			err = p.workers[i].handlePackets(packets, doneCh)
+			err := p.workers[i].handlePackets(packets, doneCh)
 			if err != nil {
-				p.Logger.Log(err)
+				p.workers[i].stats.add(Stats{PacketsDropped: len(packets)})
+				continue
 			}
+			batchesSent++
 		}
 	}
 	for i := 0; i < batchesSent; i++ {
 		<-doneCh
 	}
-	return nil
+}
+
+// Reset forgets every connection and any data buffered for it, such as when
+// replay moves back to an earlier point in a capture, whose packets would
+// otherwise be taken for retransmissions.  Packets already queued for the
+// workers are assembled first, but packets still being decoded when Reset is
+// called may arrive after it.  Every measurement starts over, since the
+// packets replayed again would otherwise be counted twice.
+func (p *Pool) Reset() {
+	doneCh := make(chan struct{}, len(p.workers))
+	for _, w := range p.workers {
+		w.wiCh <- workItem{reset: true, doneCh: doneCh}
+	}
+	for range p.workers {
+		<-doneCh
+	}
+	for _, w := range p.workers {
+		w.stats.reset()
+	}
+	p.churn.reset()
+	p.health.reset()
+	p.latency.reset()
+	p.pipeline.reset()
+	p.desyncs.reset()
 }
 
 func (p *Pool) partition(dps []*decode.DecodedPacket) [][]*decode.DecodedPacket {
@@ -56,3 +212,60 @@ func (p *Pool) partition(dps []*decode.DecodedPacket) [][]*decode.DecodedPacket
 func (p *Pool) slot(dp *decode.DecodedPacket) int {
 	return int(dp.FlowHash % uint64(len(p.workers)))
 }
+
+// Connections returns the open TCP connections seen by all workers.
+func (p *Pool) Connections() []Connection {
+	var conns []Connection
+	for _, w := range p.workers {
+		conns = w.conns.appendOpen(conns)
+	}
+	return conns
+}
+
+// Churn returns the TCP connections opened and closed during the most recent
+// second of capture time completed by now.
+func (p *Pool) Churn(now time.Time) ChurnReport {
+	return p.churn.report(now)
+}
+
+// Health returns the signs of trouble found in TCP packets since capture
+// started.
+func (p *Pool) Health() HealthReport {
+	return p.health.report()
+}
+
+// Latency returns the handshake round trip times and request latencies
+// measured since capture started.
+func (p *Pool) Latency() LatencyReport {
+	return p.latency.report()
+}
+
+// Pipelining returns the keys per get and the requests outstanding when
+// each response started, measured since capture started.
+func (p *Pool) Pipelining() PipelineReport {
+	return p.pipeline.report()
+}
+
+// Stats returns the work done by all workers since capture started.
+func (p *Pool) Stats() Stats {
+	var s Stats
+	for _, ws := range p.WorkerStats() {
+		s.add(ws)
+	}
+	return s
+}
+
+// WorkerStats returns the work done by each worker since capture started.
+func (p *Pool) WorkerStats() []Stats {
+	stats := make([]Stats, len(p.workers))
+	for i, w := range p.workers {
+		stats[i] = w.stats.get()
+	}
+	return stats
+}
+
+// Desyncs returns the times parsing lost track of conversations since capture
+// started, by cause.
+func (p *Pool) Desyncs() DesyncReport {
+	return p.desyncs.report()
+}
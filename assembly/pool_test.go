@@ -0,0 +1,258 @@
+package assembly
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/box/memsniff/analysis"
+	"github.com/box/memsniff/decode"
+	"github.com/box/memsniff/protocol/model"
+	"github.com/google/gopacket/layers"
+)
+
+// newTestPool returns a Pool with a single worker for memcached on port 11211,
+// assembled from directly by tests.
+func newTestPool(buffering Buffering) (*Pool, worker) {
+	p := &Pool{trackers: newTrackers()}
+	w := newWorker(nil, analysis.New(1, 10, nil), []int{11211}, nil, buffering, 1, &p.trackers)
+	p.workers = []worker{w}
+	return p, w
+}
+
+func TestBuffering(t *testing.T) {
+	b := Buffering{ReorderPackets: 3, MaxMemory: 10 * pageSize, IdleTimeout: time.Minute}
+	if n := b.pagesPerConnection(); n != 4 {
+		t.Error("got pages per connection", n, "expected 4")
+	}
+	if n := b.pagesPerWorker(4); n != 2 {
+		t.Error("got pages per worker", n, "expected 2")
+	}
+	b.MaxMemory = 0
+	if n := b.pagesPerWorker(4); n != 1 {
+		t.Error("got pages per worker", n, "expected 1")
+	}
+}
+
+func TestReorderAndIdleFlush(t *testing.T) {
+	for _, tc := range []struct {
+		reorderPackets int
+		requests       int
+		desyncs        int
+	}{
+		{0, 1, 1},
+		{1, 2, 0},
+	} {
+		buffering := DefaultBuffering
+		buffering.ReorderPackets = tc.reorderPackets
+		p, w := newTestPool(buffering)
+		start := time.Unix(100, 0)
+		fromClient := func(tcp layers.TCP, data string) {
+			tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 40000, 11211, 1024, true
+			w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, start))
+		}
+		fromServer := func(tcp layers.TCP, data string) {
+			tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 11211, 40000, 1024, true
+			w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, start))
+		}
+
+		fromClient(layers.TCP{Seq: 101}, "get foo\r\n")
+		fromServer(layers.TCP{Seq: 501}, "END\r\n")
+		// the end of the second request arrives before its start
+		fromClient(layers.TCP{Seq: 114}, "bar\r\n")
+		fromClient(layers.TCP{Seq: 110}, "get ")
+		fromServer(layers.TCP{Seq: 506}, "END\r\n")
+
+		conns := p.Connections()
+		if len(conns) != 1 {
+			t.Fatal("got connections", conns, "expected 1")
+		}
+		if conns[0].Requests != tc.requests || conns[0].Desyncs != tc.desyncs {
+			t.Errorf("reordering %d packets: got %d requests %d desyncs, expected %d and %d",
+				tc.reorderPackets, conns[0].Requests, conns[0].Desyncs, tc.requests, tc.desyncs)
+		}
+
+		w.flushOlderThan(start.Add(time.Second))
+		// one stream in each direction, and a gap for each desync
+		expected := Stats{Flushed: 2, Closed: 2, LostData: tc.desyncs, Resyncs: tc.desyncs}
+		if s := p.Stats(); s != expected {
+			t.Error("got stats", s, "expected", expected)
+		}
+		if len(w.conns.conns) != 0 {
+			t.Error("idle connection not forgotten")
+		}
+		lost := p.Desyncs().Causes[model.DesyncLostData]
+		if lost.Count != tc.desyncs {
+			t.Error("got lost data desyncs", lost, "expected", tc.desyncs)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	start := time.Unix(100, 0)
+	replay := func() {
+		client := layers.TCP{SrcPort: 40000, DstPort: 11211, Seq: 101, ACK: true, Window: 1024}
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", client, "get foo\r\n", start))
+		server := layers.TCP{SrcPort: 11211, DstPort: 40000, Seq: 501, ACK: true, Window: 1024}
+		w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", server, "END\r\n", start))
+	}
+
+	replay()
+	p.Reset()
+	// the same packets are read again after seeking backward
+	replay()
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatal("got connections", conns, "expected 1")
+	}
+	if c := conns[0]; c.Requests != 1 || c.Retransmits != 0 {
+		t.Error("got connection", c)
+	}
+	// measurements count the replayed packets once
+	if n := p.Latency().All.Request.Count; n != 1 {
+		t.Error("got", n, "request latencies, expected 1")
+	}
+	if h := p.Health().Total; h != (Health{}) {
+		t.Error("got health", h)
+	}
+}
+
+// TestGapInValue checks that data lost within a value is counted, though the
+// value is skipped without losing track of the conversation.
+func TestGapInValue(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	start := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 40000, 11211, 1024, true
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, start))
+	}
+	fromServer := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 11211, 40000, 1024, true
+		w.assemble(tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, start))
+	}
+
+	fromClient(layers.TCP{Seq: 101}, "get foo\r\n")
+	fromServer(layers.TCP{Seq: 501}, "VALUE foo 0 10\r\nhello")
+	// three bytes of the value are never captured
+	fromServer(layers.TCP{Seq: 525}, "ab\r\nEND\r\n")
+	fromClient(layers.TCP{Seq: 110}, "get bar\r\n")
+	fromServer(layers.TCP{Seq: 534}, "END\r\n")
+
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatal("got connections", conns, "expected 1")
+	}
+	if c := conns[0]; c.Requests != 2 || c.Desyncs != 0 {
+		t.Error("got connection", c)
+	}
+	if s := p.Stats(); s.LostData != 1 || s.Resyncs != 0 {
+		t.Error("got stats", s)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	p := &Pool{workers: []worker{{stats: &workerStats{}, wiCh: make(chan workItem)}}}
+	dps := []*decode.DecodedPacket{{}, {}, {}}
+	p.HandlePackets(dps)
+	expected := []Stats{{PacketsDropped: 3}}
+	if s := p.WorkerStats(); len(s) != 1 || s[0] != expected[0] {
+		t.Error("got worker stats", s, "expected", expected)
+	}
+}
+
+func TestTruncatedPackets(t *testing.T) {
+	p, w := newTestPool(DefaultBuffering)
+	start := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 40000, 11211, 1024, true
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, start))
+	}
+	// fromServer sends data, capturing only the first snapLen bytes
+	fromServer := func(tcp layers.TCP, data string, snapLen int) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 11211, 40000, 1024, true
+		dp := tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, start)
+		if snapLen < len(data) {
+			dp.TCP.Payload = dp.TCP.Payload[:snapLen]
+			dp.Truncated = len(data) - snapLen
+		}
+		w.assemble(dp)
+	}
+
+	// a value spanning two packets, the first cut short within the value
+	value := strings.Repeat("x", 300)
+	fromClient(layers.TCP{Seq: 101}, "get foo\r\n")
+	fromServer(layers.TCP{Seq: 501}, "VALUE foo 0 300\r\n"+value[:250], 100)
+	fromServer(layers.TCP{Seq: 768}, value[250:]+"\r\nEND\r\n", 100)
+	// a response line beyond the snap length cannot be parsed
+	fromClient(layers.TCP{Seq: 110}, "get bar\r\n")
+	fromServer(layers.TCP{Seq: 825}, "VALUE bar 0 100\r\n"+value[:100]+"\r\nEND\r\n", 100)
+	fromClient(layers.TCP{Seq: 119}, "get baz\r\n")
+	fromServer(layers.TCP{Seq: 949}, "END\r\n", 100)
+
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatal("got connections", conns, "expected 1")
+	}
+	if c := conns[0]; c.Requests != 3 || c.Desyncs != 1 || c.ServerBytes != 453 || c.Retransmits != 0 {
+		t.Error("got connection", c)
+	}
+	truncated := p.Desyncs().Causes[model.DesyncTruncated]
+	if truncated.Count != 1 || truncated.Skipped != 5 {
+		t.Error("got truncated desyncs", truncated)
+	}
+	if s := p.Stats(); s.LostData != 0 || s.Resyncs != 1 {
+		t.Error("got stats", s)
+	}
+}
+
+func TestTruncatedOutOfOrder(t *testing.T) {
+	buffering := DefaultBuffering
+	buffering.ReorderPackets = 4
+	p, w := newTestPool(buffering)
+	start := time.Unix(100, 0)
+	fromClient := func(tcp layers.TCP, data string) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 40000, 11211, 1024, true
+		w.assemble(tcpPacket(t, "10.0.0.2", "10.0.0.1", tcp, data, start))
+	}
+	fromServer := func(tcp layers.TCP, data string, snapLen int) {
+		tcp.SrcPort, tcp.DstPort, tcp.Window, tcp.ACK = 11211, 40000, 1024, true
+		dp := tcpPacket(t, "10.0.0.1", "10.0.0.2", tcp, data, start)
+		if snapLen < len(data) {
+			dp.TCP.Payload = dp.TCP.Payload[:snapLen]
+			dp.Truncated = len(data) - snapLen
+		}
+		w.assemble(dp)
+	}
+
+	fromClient(layers.TCP{Seq: 100, SYN: true}, "")
+	fromServer(layers.TCP{Seq: 500, SYN: true}, "", 100)
+	fromClient(layers.TCP{Seq: 101}, "get foo\r\nget bar\r\n")
+	// the response to bar, whose end is not captured, is buffered until the
+	// response to foo arrives
+	fromServer(layers.TCP{Seq: 528}, "VALUE bar 0 100\r\n"+strings.Repeat("x", 100)+"\r\nEND\r\n", 100)
+	fromServer(layers.TCP{Seq: 501}, "VALUE foo 0 5\r\nhello\r\nEND\r\n", 100)
+	fromClient(layers.TCP{Seq: 119}, "get baz\r\n")
+	fromServer(layers.TCP{Seq: 652}, "END\r\n", 100)
+
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatal("got connections", conns, "expected 1")
+	}
+	if c := conns[0]; c.Requests != 3 || c.Desyncs != 1 {
+		t.Error("got connection", c)
+	}
+	// the uncaptured end of the value is skipped rather than parsed
+	causes := p.Desyncs().Causes
+	for cause, d := range causes {
+		if expected := model.DesyncCause(cause) == model.DesyncTruncated; (d.Count == 1) != expected {
+			t.Error("got desyncs", causes)
+		}
+	}
+	if s := p.Stats(); s.LostData != 0 || s.Resyncs != 1 {
+		t.Error("got stats", s)
+	}
+	if len(w.sf.streams) != 2 {
+		t.Error("got", len(w.sf.streams), "streams, expected 2")
+	}
+}
@@ -0,0 +1,60 @@
+package reader
+
+import "sync/atomic"
+
+// DefaultMemoryBudget is the number of bytes that Readers may buffer, across
+// all connections, beyond the BufferSize each is guaranteed.
+const DefaultMemoryBudget = 64 * 1024 * 1024
+
+// Budget limits the memory buffered by a set of Buffers beyond the capacity
+// each is guaranteed.  It is safe for concurrent use.
+type Budget struct {
+	max  int64
+	used int64
+}
+
+// NewBudget returns a Budget allowing max bytes to be borrowed.
+func NewBudget(max int) *Budget {
+	return &Budget{max: int64(max)}
+}
+
+// SetMax changes the number of bytes that may be borrowed.  Bytes already
+// borrowed beyond a lower limit are kept until they are returned.
+func (b *Budget) SetMax(max int) {
+	atomic.StoreInt64(&b.max, int64(max))
+}
+
+// Used returns the number of bytes borrowed.
+func (b *Budget) Used() int {
+	return int(atomic.LoadInt64(&b.used))
+}
+
+// borrow reserves n bytes, returning false if that would exceed the budget.
+func (b *Budget) borrow(n int) bool {
+	used := atomic.AddInt64(&b.used, int64(n))
+	if used > atomic.LoadInt64(&b.max) {
+		atomic.AddInt64(&b.used, -int64(n))
+		return false
+	}
+	return true
+}
+
+// giveBack returns n borrowed bytes.
+func (b *Budget) giveBack(n int) {
+	atomic.AddInt64(&b.used, -int64(n))
+}
+
+// sharedBudget is borrowed from by all Readers.
+var sharedBudget = NewBudget(DefaultMemoryBudget)
+
+// SetMemoryBudget sets the number of bytes that all Readers together may
+// buffer beyond BufferSize each.
+func SetMemoryBudget(max int) {
+	sharedBudget.SetMax(max)
+}
+
+// MemoryBorrowed returns the number of bytes that all Readers together have
+// buffered beyond BufferSize each.
+func MemoryBorrowed() int {
+	return sharedBudget.Used()
+}
@@ -13,6 +13,10 @@ type Buffer struct {
 	cap     int
 	blocks  []block
 	discard int
+	// if not nil, lends bytes beyond cap
+	budget *Budget
+	// bytes borrowed from budget
+	borrowed int
 }
 
 func NewBuffer(cap int) *Buffer {
@@ -21,11 +25,25 @@ func NewBuffer(cap int) *Buffer {
 	}
 }
 
+// NewBudgetBuffer returns a Buffer that holds up to cap bytes, and borrows
+// from budget to hold more.
+func NewBudgetBuffer(cap int, budget *Budget) *Buffer {
+	return &Buffer{
+		cap:    cap,
+		budget: budget,
+	}
+}
+
 func (b *Buffer) Reset() {
+	if b.buf.Cap() > 2*b.cap {
+		// let the memory borrowed for a large burst be freed
+		b.buf = bytes.Buffer{}
+	}
 	b.buf.Reset()
 	b.len = 0
 	b.blocks = b.blocks[:0]
 	b.discard = 0
+	b.giveBack()
 }
 
 func (b *Buffer) Write(skip int, data []byte) error {
@@ -46,7 +64,7 @@ func (b *Buffer) Write(skip int, data []byte) error {
 		skip = 0
 	}
 
-	if b.buf.Len()+len(data) > b.cap {
+	if !b.reserve(b.buf.Len() + len(data)) {
 		return io.ErrShortWrite
 	}
 	b.buf.Write(data)
@@ -54,12 +72,58 @@ func (b *Buffer) Write(skip int, data []byte) error {
 	if skip == 0 && len(b.blocks) > 0 {
 		b.blocks[len(b.blocks)-1].dataLen += len(data)
 	} else {
-		b.blocks = append(b.blocks, block{skip, len(data)})
+		b.blocks = append(b.blocks, block{gap: skip, dataLen: len(data)})
 	}
 	b.len += skip + len(data)
 	return nil
 }
 
+// reserve returns true if the buffer may hold n bytes, borrowing from the
+// budget if n is more than its capacity.
+func (b *Buffer) reserve(n int) bool {
+	over := n - b.cap - b.borrowed
+	if over <= 0 {
+		return true
+	}
+	if b.budget == nil || !b.budget.borrow(over) {
+		return false
+	}
+	b.borrowed += over
+	return true
+}
+
+// giveBack returns borrowed bytes that are no longer needed to the budget.
+func (b *Buffer) giveBack() {
+	needed := b.buf.Len() - b.cap
+	if needed < 0 {
+		needed = 0
+	}
+	if b.borrowed > needed {
+		b.budget.giveBack(b.borrowed - needed)
+		b.borrowed = needed
+	}
+}
+
+// WriteTruncated records n bytes that were not captured because they were
+// beyond the snap length, following skip bytes of lost data.  Unlike lost
+// data, they are a gap of known length.
+func (b *Buffer) WriteTruncated(skip int, n int) error {
+	if skip > 0 {
+		if err := b.Write(skip, nil); err != nil {
+			return err
+		}
+	}
+	if b.discard >= n {
+		b.discard -= n
+		return nil
+	}
+	n -= b.discard
+	b.discard = 0
+	b.blocks = append(b.blocks, block{gap: n, truncated: true})
+	b.len += n
+	return nil
+}
+
 func (b *Buffer) Len() int {
 	return b.len
 }
@@ -68,11 +132,11 @@ func (b *Buffer) ReadN(n int) (out []byte, err error) {
 	if b.len < n {
 		return nil, ErrShortRead
 	}
-	avail, gap := b.contiguousAvailable()
+	avail, gap, truncated := b.contiguousAvailable()
 	if avail < n {
 		out = b.buf.Bytes()[:avail]
 		b.Discard(avail + gap)
-		return out, ErrLostData{gap}
+		return out, gapError(gap, truncated)
 	}
 	out = b.buf.Bytes()[:n]
 	b.Discard(n)
@@ -83,38 +147,44 @@ func (b *Buffer) PeekN(n int) (out []byte, err error) {
 	if b.len < n {
 		return nil, ErrShortRead
 	}
-	avail, gap := b.contiguousAvailable()
+	avail, gap, truncated := b.contiguousAvailable()
 	if avail < n {
 		out = b.buf.Bytes()[:avail]
-		return out, ErrLostData{gap}
+		return out, gapError(gap, truncated)
 	}
 	out = b.buf.Bytes()[:n]
 	return
 }
 
 func (b *Buffer) IndexAny(chars string) (int, error) {
-	pos, avail, gap := b.indexAny(chars)
+	pos, avail, gap, truncated := b.indexAny(chars)
 	if pos < 0 {
 		if avail < b.len {
-			return pos, ErrLostData{gap}
+			return pos, gapError(gap, truncated)
+		}
+		if avail > b.cap {
+			return pos, ErrLineTooLong
 		}
 		return pos, ErrShortRead
 	}
 	return pos, nil
 }
 
-func (b *Buffer) indexAny(chars string) (pos, avail, gap int) {
-	avail, gap = b.contiguousAvailable()
+func (b *Buffer) indexAny(chars string) (pos, avail, gap int, truncated bool) {
+	avail, gap, truncated = b.contiguousAvailable()
 	pos = bytes.IndexAny(b.buf.Bytes()[:avail], chars)
 	return
 }
 
 func (b *Buffer) ReadLine() ([]byte, error) {
-	pos, avail, gap := b.indexAny("\n")
+	pos, avail, gap, truncated := b.indexAny("\n")
 	if pos < 0 {
 		if avail < b.len {
 			b.Discard(avail + gap)
-			return nil, ErrLostData{gap}
+			return nil, gapError(gap, truncated)
+		}
+		if avail > b.cap {
+			return nil, ErrLineTooLong
 		}
 		return nil, ErrShortRead
 	}
@@ -136,6 +206,7 @@ func (b *Buffer) Discard(n int) {
 		if l > toDiscard {
 			b.blocks[i].discard(b, toDiscard)
 			b.dropBlocks(i)
+			b.giveBack()
 			return
 		}
 		toDiscard -= l
@@ -144,18 +215,29 @@ func (b *Buffer) Discard(n int) {
 	b.len = 0
 	b.blocks = b.blocks[:0]
 	b.discard += toDiscard
+	b.giveBack()
 }
 
-func (b *Buffer) contiguousAvailable() (avail int, gap int) {
+// contiguousAvailable returns the data available before the first gap, and
+// the length of the gap and whether it was truncated rather than lost.
+func (b *Buffer) contiguousAvailable() (avail int, gap int, truncated bool) {
 	for _, block := range b.blocks {
 		if block.hasGap() {
-			return avail, block.gap
+			return avail, block.gap, block.truncated
 		}
 		avail += block.dataLen
 	}
 	return
 }
 
+// gapError returns the error for a read reaching a gap.
+func gapError(gap int, truncated bool) error {
+	if truncated {
+		return ErrTruncated{gap}
+	}
+	return ErrLostData{gap}
+}
+
 func (b *Buffer) totalData() (avail int) {
 	for _, block := range b.blocks {
 		avail += block.dataLen
@@ -187,6 +269,8 @@ type block struct {
 	gap int
 	// number of bytes of data
 	dataLen int
+	// true if the gap was not captured, rather than lost
+	truncated bool
 }
 
 func (b block) hasGap() bool {
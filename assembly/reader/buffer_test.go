@@ -233,3 +233,67 @@ func testReadN(t *testing.T, b *Buffer, expect string, remain int) {
 		t.Error(b.Len(), remain)
 	}
 }
+
+func TestWriteBorrowsFromBudget(t *testing.T) {
+	budget := NewBudget(8)
+	b := NewBudgetBuffer(8, budget)
+	if err := b.Write(0, []byte("hello world")); err != nil {
+		t.Error(err)
+	}
+	if budget.Used() != 3 {
+		t.Error(budget.Used(), 3)
+	}
+	if err := b.Write(0, []byte("!!!!!!")); err != io.ErrShortWrite {
+		t.Error(err, io.ErrShortWrite)
+	}
+	b.Discard(6)
+	if budget.Used() != 0 {
+		t.Error(budget.Used(), 0)
+	}
+	testReadN(t, b, "world", 0)
+}
+
+func TestLineTooLong(t *testing.T) {
+	b := NewBuffer(8)
+	b.Write(0, []byte("hello"))
+	if _, err := b.ReadLine(); err != ErrShortRead {
+		t.Error(err, ErrShortRead)
+	}
+	b.budget = NewBudget(8)
+	b.Write(0, []byte("world"))
+	if _, err := b.ReadLine(); err != ErrLineTooLong {
+		t.Error(err, ErrLineTooLong)
+	}
+	if _, err := b.IndexAny(" "); err != ErrLineTooLong {
+		t.Error(err, ErrLineTooLong)
+	}
+}
+
+func TestTruncatedGap(t *testing.T) {
+	b := NewBuffer(128)
+	b.Write(0, []byte("VALUE k 0 20\r\nhello"))
+	b.WriteTruncated(0, 15)
+	b.Write(0, []byte("\r\nEND\r\n"))
+
+	// discarding the value skips over the bytes that were not captured
+	if _, err := b.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	b.Discard(22)
+	testReadN(t, b, "END", 2)
+
+	b.Reset()
+	b.Write(0, []byte("VALUE k"))
+	b.WriteTruncated(3, 10)
+	o, err := b.ReadLine()
+	if err != (ErrLostData{3}) {
+		t.Error(string(o), err, ErrLostData{3})
+	}
+	o, err = b.ReadLine()
+	if err != (ErrTruncated{10}) {
+		t.Error(string(o), err, ErrTruncated{10})
+	}
+	if b.Len() != 0 {
+		t.Error(b.Len(), 0)
+	}
+}
@@ -5,6 +5,9 @@ import "fmt"
 var (
 	// ErrShortRead is returned if there is insufficient data in the buffer.
 	ErrShortRead = fmt.Errorf("Insufficient data to complete read")
+	// ErrLineTooLong is returned if more data than a Buffer's capacity is
+	// buffered without finding the delimiter searched for.
+	ErrLineTooLong = fmt.Errorf("Delimiter not found within buffer capacity")
 )
 
 // ErrLostData is returned when there is a gap in the TCP stream due to missing
@@ -20,3 +23,14 @@ func (e ErrLostData) Error() string {
 	}
 	return fmt.Sprint("lost ", e.Lost, " bytes from stream")
 }
+
+// ErrTruncated is returned when a read reaches payload that was not captured
+// because it was beyond the snap length.  Unlike ErrLostData, the length of
+// the gap is known exactly.  It is returned only once for each gap.
+type ErrTruncated struct {
+	Missing int
+}
+
+func (e ErrTruncated) Error() string {
+	return fmt.Sprint(e.Missing, " bytes of stream not captured")
+}
@@ -0,0 +1,22 @@
+package reader
+
+// filler stands in for payload that was not captured.  It is never written.
+var filler [65535]byte
+
+// Filler returns n bytes standing in for payload that was not captured
+// because it was beyond the snap length.  When the bytes reach a Reader, they
+// are recorded as a known gap rather than as data.
+func Filler(n int) []byte {
+	if n > len(filler) {
+		n = len(filler)
+	}
+	return filler[:n]
+}
+
+// IsFiller returns true if b was returned by Filler, or is part of a slice
+// that was.  Filler copied elsewhere, such as into tcpassembly's buffers for
+// out-of-order data, is not recognized, so callers must pass on Filler
+// itself after reassembly.
+func IsFiller(b []byte) bool {
+	return cap(b) > 0 && &b[:cap(b)][cap(b)-1] == &filler[len(filler)-1]
+}
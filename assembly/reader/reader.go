@@ -7,6 +7,8 @@ import (
 )
 
 const (
+	// BufferSize is the number of bytes each Reader may buffer without
+	// borrowing from the memory budget shared by all Readers.
 	BufferSize = 32 * 1024
 )
 
@@ -20,7 +22,7 @@ type Reader struct {
 
 func New() *Reader {
 	return &Reader{
-		buf: *NewBuffer(BufferSize),
+		buf: *NewBudgetBuffer(BufferSize, sharedBudget),
 	}
 }
 
@@ -29,7 +31,12 @@ func (r *Reader) Reassembled(rs []tcpassembly.Reassembly) {
 		return
 	}
 	for _, reassembly := range rs {
-		err := r.buf.Write(reassembly.Skip, reassembly.Bytes)
+		var err error
+		if IsFiller(reassembly.Bytes) {
+			err = r.buf.WriteTruncated(reassembly.Skip, len(reassembly.Bytes))
+		} else {
+			err = r.buf.Write(reassembly.Skip, reassembly.Bytes)
+		}
 		if err != nil {
 			r.err = err
 			return
@@ -52,6 +59,11 @@ func (r *Reader) Truncate() {
 	r.buf.Reset()
 }
 
+// Buffered returns the number of bytes of data buffered, not including gaps.
+func (r *Reader) Buffered() int {
+	return r.buf.buf.Len()
+}
+
 func (r *Reader) Discard(n int) (discarded int, err error) {
 	if r.err != nil {
 		return 0, r.err
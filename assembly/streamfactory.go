@@ -3,8 +3,11 @@ package assembly
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/box/memsniff/analysis"
+	"github.com/box/memsniff/decode"
 	"github.com/box/memsniff/log"
 	"github.com/box/memsniff/protocol/mctext"
 	"github.com/box/memsniff/protocol/model"
@@ -13,6 +16,10 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 )
 
+// affinityWindow is how closely gets must follow one another on a connection,
+// in capture time, for their keys to be counted as requested together.
+const affinityWindow = 20 * time.Millisecond
+
 type connectionKey struct {
 	netFlow       gopacket.Flow
 	transportFlow gopacket.Flow
@@ -33,6 +40,10 @@ func (c *connectionKey) String() string {
 		c.transportFlow.Dst())
 }
 
+func (c *connectionKey) SrcString() string {
+	return fmt.Sprintf("%s:%s", c.netFlow.Src(), c.transportFlow.Src())
+}
+
 func (c *connectionKey) DstString() string {
 	return fmt.Sprintf("%s:%s", c.netFlow.Dst(), c.transportFlow.Dst())
 }
@@ -41,25 +52,68 @@ type streamFactory struct {
 	logger        log.Logger
 	analysis      *analysis.Pool
 	memcachePorts []int
+	servers       []*net.IPNet
+	// index of the capture interface of the packet being assembled
+	iface int
+	// connections handled by the worker, locked while assembling
+	conns *connTable
+	// capture time of the data being assembled
+	now      time.Time
+	latency  *latencyTracker
+	pipeline *pipelineTracker
+	// counts the gaps and resyncs of the worker's consumers
+	stats   *workerStats
+	desyncs *desyncTracker
 
 	halfOpen map[connectionKey]*model.Consumer
+	// streams by direction, created while assembling their first packet
+	streams map[streamKey]*seqStream
 }
 
 // IsFromServer returns true if we believe this packet is coming from the server.
-// Note that it will misidentify a client using a server port as a source ephemeral port.
-// For now we accept that possibility, but we could try to infer based on source IP as well.
-func (sf *streamFactory) IsFromServer(transportFlow gopacket.Flow) bool {
+// If server addresses were configured and exactly one endpoint is a server, the
+// source address decides.  Otherwise we fall back to the source port, which
+// will misidentify a client using a server port as a source ephemeral port.
+func (sf *streamFactory) IsFromServer(netFlow, transportFlow gopacket.Flow) bool {
+	if len(sf.servers) > 0 {
+		srcServer := isInNetlist(sf.servers, netFlow.Src())
+		dstServer := isInNetlist(sf.servers, netFlow.Dst())
+		if srcServer != dstServer {
+			return srcServer
+		}
+	}
 	port := srcPort(transportFlow)
 	return isInPortlist(sf.memcachePorts, port)
 }
 
 func srcPort(transportFlow gopacket.Flow) int {
-	if transportFlow.EndpointType() != layers.EndpointTCPPort {
-		panic("non TCP flow")
+	if t := transportFlow.EndpointType(); t != layers.EndpointTCPPort && t != layers.EndpointUDPPort {
+		panic("non TCP or UDP flow")
 	}
 	return int(binary.BigEndian.Uint16(transportFlow.Src().Raw()))
 }
 
+// isMemcached returns true if dp is a TCP or UDP packet to or from a memcached
+// port, and a memcached server if servers were configured.
+func (sf *streamFactory) isMemcached(dp *decode.DecodedPacket) bool {
+	var srcPort, dstPort int
+	switch {
+	case dp.IsTCP():
+		srcPort, dstPort = int(dp.TCP.SrcPort), int(dp.TCP.DstPort)
+	case dp.IsUDP():
+		srcPort, dstPort = int(dp.UDP.SrcPort), int(dp.UDP.DstPort)
+	default:
+		return false
+	}
+	if !isInPortlist(sf.memcachePorts, srcPort) &&
+		!isInPortlist(sf.memcachePorts, dstPort) {
+		return false
+	}
+	return len(sf.servers) == 0 ||
+		isInNetlist(sf.servers, dp.NetFlow.Src()) ||
+		isInNetlist(sf.servers, dp.NetFlow.Dst())
+}
+
 func isInPortlist(ports []int, port int) bool {
 	for _, p := range ports {
 		if port == p {
@@ -69,15 +123,33 @@ func isInPortlist(ports []int, port int) bool {
 	return false
 }
 
-func (sf *streamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.Stream {
+func isInNetlist(nets []*net.IPNet, addr gopacket.Endpoint) bool {
+	ip := net.IP(addr.Raw())
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionKey returns the key of the connection with the given flows,
+// oriented from the server to the client, and whether the flows are from the
+// server.
+func (sf *streamFactory) connectionKey(netFlow, transportFlow gopacket.Flow) (connectionKey, bool) {
 	ck := connectionKey{
 		netFlow:       netFlow,
 		transportFlow: transportFlow,
 	}
-	fromServer := sf.IsFromServer(transportFlow)
+	fromServer := sf.IsFromServer(netFlow, transportFlow)
 	if !fromServer {
 		ck = ck.Reverse()
 	}
+	return ck, fromServer
+}
+
+func (sf *streamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.Stream {
+	ck, fromServer := sf.connectionKey(netFlow, transportFlow)
 
 	var c *model.Consumer
 	var ok bool
@@ -86,6 +158,9 @@ func (sf *streamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.S
 	} else {
 		c = sf.createConsumer(ck)
 		sf.halfOpen[ck] = c
+		if sf.conns != nil {
+			sf.conns.setConsumer(ck, c)
+		}
 	}
 
 	var stream tcpassembly.Stream
@@ -95,11 +170,51 @@ func (sf *streamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.S
 		stream = c.ClientStream()
 	}
 
-	return stream
+	return sf.wrap(netFlow, transportFlow, stream)
 }
 
 func (sf *streamFactory) createConsumer(ck connectionKey) *model.Consumer {
-	return mctext.NewConsumer(nil, sf.analysis.HandleEvents)
+	iface := sf.iface
+	c := mctext.NewConsumer(nil, func(evts []model.Event) {
+		sf.analysis.HandleInterfaceEvents(iface, evts)
+	})
+	client := ck.netFlow.Dst().String()
+	if sf.latency != nil {
+		c.Clock = func() time.Time { return sf.now }
+		c.LatencyHandler = func(latency time.Duration) {
+			sf.latency.addRequest(client, latency)
+		}
+	}
+	var preceding []string
+	var precedingTime time.Time
+	c.GetHandler = func(keys []string) {
+		if sf.pipeline != nil {
+			sf.pipeline.addGet(client, len(keys))
+		}
+		if sf.now.Sub(precedingTime) > affinityWindow {
+			preceding = preceding[:0]
+		}
+		sf.analysis.HandleKeys(keys, preceding)
+		preceding = append(preceding[:0], keys...)
+		precedingTime = sf.now
+	}
+	if sf.pipeline != nil {
+		c.PipelineHandler = func(outstanding int) {
+			sf.pipeline.addOutstanding(client, outstanding)
+		}
+	}
+	if sf.stats != nil {
+		c.DesyncHandler = sf.desynced
+	}
+	return c
+}
+
+// desynced counts a consumer losing track of its conversation.
+func (sf *streamFactory) desynced(d model.Desync) {
+	sf.stats.add(Stats{Resyncs: 1})
+	if sf.desyncs != nil {
+		sf.desyncs.add(d)
+	}
 }
 
 func (sf *streamFactory) log(items ...interface{}) {
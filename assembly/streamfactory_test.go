@@ -0,0 +1,43 @@
+package assembly
+
+import (
+	"net"
+	"testing"
+
+	"github.com/box/memsniff/capture"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestFromServerByPort(t *testing.T) {
+	sf := &streamFactory{memcachePorts: []int{11211}}
+	testFromServer(t, sf, "10.0.0.1", 11211, "10.0.0.2", 40000, true)
+	testFromServer(t, sf, "10.0.0.2", 40000, "10.0.0.1", 11211, false)
+}
+
+func TestFromServerByAddress(t *testing.T) {
+	servers, _ := capture.ParseServers([]string{"10.0.0.1"})
+	sf := &streamFactory{memcachePorts: []int{11211}, servers: servers}
+	// client happens to use a memcached port as its ephemeral port
+	testFromServer(t, sf, "10.0.0.2", 11211, "10.0.0.1", 11211, false)
+	testFromServer(t, sf, "10.0.0.1", 11211, "10.0.0.2", 11211, true)
+}
+
+func TestFromServerBetweenServers(t *testing.T) {
+	servers, _ := capture.ParseServers([]string{"10.0.0.0/24"})
+	sf := &streamFactory{memcachePorts: []int{11211}, servers: servers}
+	testFromServer(t, sf, "10.0.0.1", 11211, "10.0.0.2", 40000, true)
+	testFromServer(t, sf, "10.0.0.2", 40000, "10.0.0.1", 11211, false)
+}
+
+func testFromServer(t *testing.T, sf *streamFactory, src string, srcPort int, dst string, dstPort int, expected bool) {
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(src).To4(), net.ParseIP(dst).To4())
+	transportFlow := gopacket.NewFlow(layers.EndpointTCPPort, port(srcPort), port(dstPort))
+	if sf.IsFromServer(netFlow, transportFlow) != expected {
+		t.Error(src, srcPort, "->", dst, dstPort, "expected IsFromServer", expected)
+	}
+}
+
+func port(p int) []byte {
+	return []byte{byte(p >> 8), byte(p)}
+}
@@ -0,0 +1,177 @@
+package assembly
+
+import (
+	"github.com/box/memsniff/assembly/reader"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// streamKey identifies one direction of a TCP connection, as tcpassembly
+// does.
+type streamKey struct {
+	netFlow       gopacket.Flow
+	transportFlow gopacket.Flow
+}
+
+// seqRange is a range of sequence numbers.
+type seqRange struct {
+	start uint32
+	n     int
+}
+
+func (r seqRange) end() uint32 {
+	return r.start + uint32(r.n)
+}
+
+// seqStream passes the data reassembled for one direction of a connection on
+// to a consumer, following the sequence numbers of the data so that payload
+// beyond the snap length is passed on as reader.Filler.  tcpassembly copies
+// the data of packets it buffers, so the filler given to it cannot be told
+// apart from captured data by the time it is reassembled.
+type seqStream struct {
+	key    streamKey
+	sf     *streamFactory
+	stream tcpassembly.Stream
+	// sequence number of the next byte to be reassembled, once started
+	next    uint32
+	started bool
+	// sequence number following the SYN, if one was seen
+	syn    uint32
+	sawSYN bool
+	// lowest sequence number assembled before the stream started, where
+	// tcpassembly starts a stream whose SYN was not seen
+	lowest    uint32
+	sawLowest bool
+	// payload not captured and not yet reassembled, in ascending order
+	truncated []seqRange
+	ret       []tcpassembly.Reassembly
+}
+
+// seqStream returns the seqStream for the direction of tcp, creating it if
+// tcp will start a stream in tcpassembly.  It returns nil for packets that
+// tcpassembly ignores.
+func (sf *streamFactory) seqStream(netFlow gopacket.Flow, tcp *layers.TCP, truncated int) *seqStream {
+	k := streamKey{netFlow, tcp.TransportFlow()}
+	s, ok := sf.streams[k]
+	if !ok && (tcp.SYN || len(tcp.Payload)+truncated > 0) {
+		s = &seqStream{key: k, sf: sf}
+		sf.streams[k] = s
+	}
+	return s
+}
+
+// wrap returns the seqStream for the stream being created for the given flows,
+// passing data on to stream.
+func (sf *streamFactory) wrap(netFlow, transportFlow gopacket.Flow, stream tcpassembly.Stream) *seqStream {
+	k := streamKey{netFlow, transportFlow}
+	s, ok := sf.streams[k]
+	if !ok {
+		s = &seqStream{key: k, sf: sf}
+		sf.streams[k] = s
+	}
+	s.stream = stream
+	return s
+}
+
+// assembling records a packet about to be given to tcpassembly, with truncated
+// bytes of payload beyond those captured.
+func (s *seqStream) assembling(tcp *layers.TCP, truncated int) {
+	seq := tcp.Seq
+	if tcp.SYN {
+		seq++
+		s.syn, s.sawSYN = seq, true
+	}
+	if !s.started && (!s.sawLowest || int32(seq-s.lowest) < 0) {
+		s.lowest, s.sawLowest = seq, true
+	}
+	if truncated == 0 {
+		return
+	}
+	r := seqRange{seq + uint32(len(tcp.Payload)), truncated}
+	if s.started && int32(r.end()-s.next) <= 0 {
+		// a retransmission of data already reassembled
+		return
+	}
+	i := len(s.truncated)
+	for i > 0 && int32(s.truncated[i-1].start-r.start) > 0 {
+		i--
+	}
+	s.truncated = append(s.truncated, seqRange{})
+	copy(s.truncated[i+1:], s.truncated[i:])
+	s.truncated[i] = r
+}
+
+func (s *seqStream) Reassembled(rs []tcpassembly.Reassembly) {
+	s.ret = s.ret[:0]
+	lost := 0
+	for _, r := range rs {
+		// a Skip of -1 only means the start of the stream was not seen
+		if r.Skip > 0 {
+			lost++
+		}
+		switch {
+		case r.Start && s.sawSYN:
+			s.next = s.syn
+		case !s.started:
+			s.next = s.lowest
+		case r.Skip > 0:
+			s.next += uint32(r.Skip)
+		}
+		s.started = true
+		s.split(r)
+	}
+	if lost > 0 && s.sf.stats != nil {
+		s.sf.stats.add(Stats{LostData: lost})
+	}
+	s.stream.Reassembled(s.ret)
+}
+
+// split appends r to s.ret, split so that uncaptured payload is replaced by
+// filler.
+func (s *seqStream) split(r tcpassembly.Reassembly) {
+	b := r.Bytes
+	first := true
+	emit := func(data []byte, last bool) {
+		part := tcpassembly.Reassembly{Bytes: data, Seen: r.Seen}
+		if first {
+			part.Skip, part.Start = r.Skip, r.Start
+			first = false
+		}
+		part.End = last && r.End
+		s.ret = append(s.ret, part)
+		s.next += uint32(len(data))
+	}
+	for len(b) > 0 && len(s.truncated) > 0 {
+		tr := s.truncated[0]
+		end := int(int32(tr.end() - s.next))
+		if end <= 0 {
+			s.truncated = s.truncated[1:]
+			continue
+		}
+		off := int(int32(tr.start - s.next))
+		if off >= len(b) {
+			break
+		}
+		if off > 0 {
+			emit(b[:off], false)
+			b = b[off:]
+			continue
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		emit(reader.Filler(end), end == len(b))
+		b = b[end:]
+	}
+	if len(b) > 0 || first {
+		emit(b, true)
+	}
+}
+
+func (s *seqStream) ReassemblyComplete() {
+	if s.sf.streams[s.key] == s {
+		delete(s.sf.streams, s.key)
+	}
+	s.stream.ReassemblyComplete()
+}
@@ -0,0 +1,157 @@
+package assembly
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/box/memsniff/decode"
+	"github.com/box/memsniff/protocol/model"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// length of the frame header preceding each memcached UDP datagram
+const udpHeaderLen = 8
+
+// most datagrams we expect in a message: a value of memcached's default 1 MiB
+// item size limit, split into datagrams of 1400 bytes
+const maxUDPDatagrams = 1024
+
+// udpRequestKey identifies a single memcached request sent over UDP.
+type udpRequestKey struct {
+	// oriented from the server to the client
+	conn      connectionKey
+	requestID uint16
+}
+
+// udpMessage collects the datagrams of a request or response, which may
+// arrive in any order.
+type udpMessage struct {
+	datagrams [][]byte
+	received  int
+	// capture time of the first datagram received
+	started time.Time
+}
+
+// add stores the datagram with sequence number seq out of total, returning
+// false if it does not belong with those already received.
+func (m *udpMessage) add(seq, total int, data []byte, timestamp time.Time) bool {
+	if m.datagrams == nil {
+		m.datagrams = make([][]byte, total)
+		m.started = timestamp
+	}
+	if total != len(m.datagrams) || m.datagrams[seq] != nil {
+		return false
+	}
+	// copy the data, which belongs to the capture buffer
+	m.datagrams[seq] = append(make([]byte, 0, len(data)), data...)
+	m.received++
+	return true
+}
+
+func (m *udpMessage) complete() bool {
+	return m.datagrams != nil && m.received == len(m.datagrams)
+}
+
+// udpRequest collects a request and its response.
+type udpRequest struct {
+	started  time.Time
+	request  udpMessage
+	response udpMessage
+}
+
+// message returns the response if fromServer is true, otherwise the request.
+func (r *udpRequest) message(fromServer bool) *udpMessage {
+	if fromServer {
+		return &r.response
+	}
+	return &r.request
+}
+
+// udpAssembler reassembles memcached requests and responses sent over UDP,
+// each of which may be split across several datagrams, and parses them once
+// both are complete.
+type udpAssembler struct {
+	sf *streamFactory
+	// newConsumer creates a consumer to parse a single request
+	newConsumer func(ck connectionKey) *model.Consumer
+	pending     map[udpRequestKey]*udpRequest
+}
+
+func newUDPAssembler(sf *streamFactory) *udpAssembler {
+	return &udpAssembler{
+		sf:          sf,
+		newConsumer: sf.createConsumer,
+		pending:     make(map[udpRequestKey]*udpRequest),
+	}
+}
+
+// handle adds a UDP datagram to the request it belongs to.
+func (ua *udpAssembler) handle(dp *decode.DecodedPacket) {
+	ua.add(dp.NetFlow, dp.UDP.TransportFlow(), dp.UDP.Payload, dp.Info.Timestamp)
+}
+
+func (ua *udpAssembler) add(netFlow, transportFlow gopacket.Flow, payload []byte, timestamp time.Time) {
+	if len(payload) < udpHeaderLen {
+		return
+	}
+	requestID := binary.BigEndian.Uint16(payload[0:2])
+	seq := int(binary.BigEndian.Uint16(payload[2:4]))
+	total := int(binary.BigEndian.Uint16(payload[4:6]))
+	reserved := binary.BigEndian.Uint16(payload[6:8])
+	if total == 0 || seq >= total || reserved != 0 {
+		// not the memcached frame header
+		return
+	}
+	if total > maxUDPDatagrams {
+		// too many to buffer for a single message
+		return
+	}
+
+	ck, fromServer := ua.sf.connectionKey(netFlow, transportFlow)
+	key := udpRequestKey{ck, requestID}
+	r, ok := ua.pending[key]
+	if !ok {
+		r = &udpRequest{started: timestamp}
+		ua.pending[key] = r
+	}
+	if !r.message(fromServer).add(seq, total, payload[udpHeaderLen:], timestamp) {
+		// a duplicate, or a new request reusing the ID, so start over
+		r = &udpRequest{started: timestamp}
+		ua.pending[key] = r
+		r.message(fromServer).add(seq, total, payload[udpHeaderLen:], timestamp)
+	}
+	if r.request.complete() && r.response.complete() {
+		delete(ua.pending, key)
+		ua.parse(ck, r)
+	}
+}
+
+// parse feeds a complete request and response to a new consumer.
+func (ua *udpAssembler) parse(ck connectionKey, r *udpRequest) {
+	c := ua.newConsumer(ck)
+	client, server := c.ClientStream(), c.ServerStream()
+	ua.sf.now = r.request.started
+	for _, data := range r.request.datagrams {
+		client.Reassembled([]tcpassembly.Reassembly{{Bytes: data}})
+	}
+	ua.sf.now = r.response.started
+	for _, data := range r.response.datagrams {
+		server.Reassembled([]tcpassembly.Reassembly{{Bytes: data}})
+	}
+	client.ReassemblyComplete()
+	server.ReassemblyComplete()
+}
+
+// flushOlderThan discards requests started before t that are still missing
+// datagrams, returning the number discarded.
+func (ua *udpAssembler) flushOlderThan(t time.Time) int {
+	var n int
+	for key, r := range ua.pending {
+		if r.started.Before(t) {
+			delete(ua.pending, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package assembly
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/box/memsniff/protocol/mctext"
+	"github.com/box/memsniff/protocol/model"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestUDPMultiDatagramResponse(t *testing.T) {
+	ua, events := testUDPAssembler()
+	ts := time.Unix(0, 0)
+	client, server := udpFlows("10.0.0.2", 40000, "10.0.0.1", 11211)
+	ua.add(client.net, client.transport, udpFrame(7, 0, 1, "get foo bar\r\n"), ts)
+	// the response arrives out of order
+	ua.add(server.net, server.transport, udpFrame(7, 1, 2, "VALUE bar 0 5\r\nhello\r\nEND\r\n"), ts)
+	if len(*events) != 0 {
+		t.Error("parsed incomplete response")
+	}
+	ua.add(server.net, server.transport, udpFrame(7, 0, 2, "VALUE foo 0 3\r\nabc\r\n"), ts)
+
+	expected := []model.Event{
+		{Type: model.EventGetHit, Key: "foo", Size: 3},
+		{Type: model.EventGetHit, Key: "bar", Size: 5},
+	}
+	if len(*events) != len(expected) {
+		t.Fatal("got events", *events, "expected", expected)
+	}
+	for i, evt := range expected {
+		if (*events)[i] != evt {
+			t.Error("got event", (*events)[i], "expected", evt)
+		}
+	}
+	if len(ua.pending) != 0 {
+		t.Error("request still pending after response completed")
+	}
+}
+
+func TestUDPFlush(t *testing.T) {
+	ua, events := testUDPAssembler()
+	client, _ := udpFlows("10.0.0.2", 40000, "10.0.0.1", 11211)
+	ua.add(client.net, client.transport, udpFrame(1, 0, 1, "get foo\r\n"), time.Unix(0, 0))
+	ua.add(client.net, client.transport, udpFrame(2, 0, 1, "get bar\r\n"), time.Unix(60, 0))
+	if n := ua.flushOlderThan(time.Unix(30, 0)); n != 1 || len(ua.pending) != 1 {
+		t.Error("flushed", n, "requests, leaving", len(ua.pending), "pending")
+	}
+	if len(*events) != 0 {
+		t.Error("got events without a response:", *events)
+	}
+}
+
+func TestUDPIgnoresNonMemcachedFrames(t *testing.T) {
+	ua, _ := testUDPAssembler()
+	client, _ := udpFlows("10.0.0.2", 40000, "10.0.0.1", 11211)
+	ua.add(client.net, client.transport, []byte("get foo\r\n"), time.Unix(0, 0))
+	ua.add(client.net, client.transport, udpFrame(1, 1, 1, "get foo\r\n"), time.Unix(0, 0))
+	if len(ua.pending) != 0 {
+		t.Error("accepted datagrams without a valid frame header")
+	}
+	ua.add(client.net, client.transport, udpFrame(1, 0, maxUDPDatagrams+1, "get foo\r\n"), time.Unix(0, 0))
+	if len(ua.pending) != 0 {
+		t.Error("accepted a datagram claiming", maxUDPDatagrams+1, "in its message")
+	}
+}
+
+func testUDPAssembler() (*udpAssembler, *[]model.Event) {
+	var events []model.Event
+	ua := newUDPAssembler(&streamFactory{memcachePorts: []int{11211}})
+	ua.newConsumer = func(connectionKey) *model.Consumer {
+		return mctext.NewConsumer(nil, func(evts []model.Event) {
+			events = append(events, evts...)
+		})
+	}
+	return ua, &events
+}
+
+type udpFlow struct {
+	net, transport gopacket.Flow
+}
+
+// udpFlows returns the flows in each direction between two UDP endpoints.
+func udpFlows(src string, srcPort int, dst string, dstPort int) (udpFlow, udpFlow) {
+	f := udpFlow{
+		net:       gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(src).To4(), net.ParseIP(dst).To4()),
+		transport: gopacket.NewFlow(layers.EndpointUDPPort, port(srcPort), port(dstPort)),
+	}
+	return f, udpFlow{f.net.Reverse(), f.transport.Reverse()}
+}
+
+// udpFrame returns data preceded by the memcached UDP frame header.
+func udpFrame(requestID, seq, total int, data string) []byte {
+	hdr := []byte{
+		byte(requestID >> 8), byte(requestID),
+		byte(seq >> 8), byte(seq),
+		byte(total >> 8), byte(total),
+		0, 0,
+	}
+	return append(hdr, data...)
+}
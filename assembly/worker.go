@@ -2,9 +2,11 @@ package assembly
 
 import (
 	"errors"
+	"net"
 	"time"
 
 	"github.com/box/memsniff/analysis"
+	"github.com/box/memsniff/assembly/reader"
 	"github.com/box/memsniff/decode"
 	"github.com/box/memsniff/log"
 	"github.com/box/memsniff/protocol/model"
@@ -16,40 +18,69 @@ var (
 )
 
 type workItem struct {
-	dps    []*decode.DecodedPacket
+	dps []*decode.DecodedPacket
+	// reset asks the worker to forget every connection instead
+	reset  bool
 	doneCh chan<- struct{}
 }
 
 type worker struct {
 	logger    log.Logger
+	sf        *streamFactory
 	assembler *tcpassembly.Assembler
-	wiCh      chan workItem
+	udp       *udpAssembler
+	conns     *connTable
+	churn     *churnTracker
+	health    *healthTracker
+	stats     *workerStats
+	// how long connections may be idle, in capture time
+	idleTimeout time.Duration
+	wiCh        chan workItem
 }
 
-func newWorker(logger log.Logger, analysis *analysis.Pool, memcachePorts []int) worker {
-	sf := streamFactory{
+// newWorker creates a worker that is one of numWorkers sharing the limits in
+// buffering, and reporting to the trackers of its Pool.
+func newWorker(logger log.Logger, analysis *analysis.Pool, memcachePorts []int, servers []*net.IPNet,
+	buffering Buffering, numWorkers int, t *trackers) worker {
+	sf := &streamFactory{
 		logger:        logger,
 		analysis:      analysis,
 		memcachePorts: memcachePorts,
+		servers:       servers,
 
 		halfOpen: make(map[connectionKey]*model.Consumer),
+		streams:  make(map[streamKey]*seqStream),
+		conns:    newConnTable(),
+		latency:  t.latency,
+		pipeline: t.pipeline,
+		stats:    &workerStats{},
+		desyncs:  t.desyncs,
 	}
 	w := worker{
 		logger:    logger,
-		assembler: tcpassembly.NewAssembler(tcpassembly.NewStreamPool(&sf)),
-		wiCh:      make(chan workItem, 128),
+		sf:        sf,
+		conns:     sf.conns,
+		churn:     t.churn,
+		health:    t.health,
+		stats:     sf.stats,
+		assembler: tcpassembly.NewAssembler(tcpassembly.NewStreamPool(sf)),
+		udp:       newUDPAssembler(sf),
+
+		idleTimeout: buffering.IdleTimeout,
+		wiCh:        make(chan workItem, 128),
 	}
-	// Don't let the Assembly buffer much data in an attempt to compensate for out-of-order
-	// and missing packets.  Just report the data as lost downstream and continue.
-	w.assembler.MaxBufferedPagesPerConnection = 1
-	w.assembler.MaxBufferedPagesTotal = 1
+	// Only buffer as much data as configured in an attempt to compensate for
+	// out-of-order packets.  Beyond that, report the data as lost downstream
+	// and continue.
+	w.assembler.MaxBufferedPagesPerConnection = buffering.pagesPerConnection()
+	w.assembler.MaxBufferedPagesTotal = buffering.pagesPerWorker(numWorkers)
 	go w.loop()
 	return w
 }
 
 func (w worker) handlePackets(dps []*decode.DecodedPacket, doneCh chan<- struct{}) error {
 	select {
-	case w.wiCh <- workItem{dps, doneCh}:
+	case w.wiCh <- workItem{dps: dps, doneCh: doneCh}:
 		return nil
 	default:
 		return errQueueFull
@@ -62,24 +93,115 @@ func (w worker) loop() {
 	for {
 		select {
 		case <-ticker.C:
-			f, c := w.assembler.FlushOlderThan(mostRecent.Add(-time.Minute))
-			if f > 0 || c > 0 {
-				w.log("Flushed", f, "Closed", c)
-			}
+			w.flushOlderThan(mostRecent.Add(-w.idleTimeout))
 
 		case wi, ok := <-w.wiCh:
 			if !ok {
 				return
 			}
+			if wi.reset {
+				w.reset()
+				mostRecent = time.Time{}
+			}
 			for _, dp := range wi.dps {
+				if !w.sf.isMemcached(dp) {
+					// the capture filter cannot see inside tunnels,
+					// or tell which IP fragments hold memcached
+					// traffic
+					continue
+				}
 				mostRecent = dp.Info.Timestamp
-				w.assembler.AssembleWithTimestamp(dp.NetFlow, &dp.TCP, mostRecent)
+				w.sf.iface = dp.Info.InterfaceIndex
+				if dp.IsUDP() {
+					w.udp.handle(dp)
+					continue
+				}
+				w.assemble(dp)
 			}
 			wi.doneCh <- struct{}{}
 		}
 	}
 }
 
+// flushOlderThan skips data still missing on connections idle since before
+// cutoff, and forgets those connections.
+func (w worker) flushOlderThan(cutoff time.Time) {
+	f, c := w.assembler.FlushOlderThan(cutoff)
+	w.stats.add(Stats{Flushed: f, Closed: c})
+	w.udp.flushOlderThan(cutoff)
+	w.conns.flushOlderThan(cutoff)
+}
+
+// reset closes every stream and forgets every connection, releasing any data
+// buffered for them.
+func (w worker) reset() {
+	w.conns.mu.Lock()
+	defer w.conns.mu.Unlock()
+	w.assembler.FlushAll()
+	for ck := range w.sf.halfOpen {
+		delete(w.sf.halfOpen, ck)
+	}
+	for k := range w.sf.streams {
+		delete(w.sf.streams, k)
+	}
+	for k := range w.udp.pending {
+		delete(w.udp.pending, k)
+	}
+	for ck := range w.conns.conns {
+		delete(w.conns.conns, ck)
+	}
+}
+
+// assemble adds a TCP packet to its stream, tracking the connection.
+func (w worker) assemble(dp *decode.DecodedPacket) {
+	w.conns.mu.Lock()
+	defer w.conns.mu.Unlock()
+	ck, fromServer := w.sf.connectionKey(dp.NetFlow, dp.TCP.TransportFlow())
+	c, res := w.conns.track(ck, fromServer, &dp.TCP, dp.Truncated, dp.Info.Timestamp)
+	w.sf.now = dp.Info.Timestamp
+	if s := w.sf.seqStream(dp.NetFlow, &dp.TCP, dp.Truncated); s != nil {
+		s.assembling(&dp.TCP, dp.Truncated)
+	}
+	if dp.Truncated > 0 {
+		w.assembleTruncated(dp)
+	} else {
+		w.assembler.AssembleWithTimestamp(dp.NetFlow, &dp.TCP, dp.Info.Timestamp)
+	}
+	c.sync()
+	client := ck.netFlow.Dst().String()
+	switch res.event {
+	case connOpened:
+		w.churn.opened(client, dp.Info.Timestamp)
+	case connClosed:
+		w.churn.closed(client, dp.Info.Timestamp)
+	}
+	if res.health.Total() > 0 {
+		w.health.add(client, c.Server, fromServer, res.health)
+	}
+	if res.rtt > 0 {
+		w.sf.latency.addRTT(client, res.rtt)
+	}
+}
+
+// assembleTruncated adds a TCP packet whose payload was cut short by the snap
+// length, followed by filler standing in for the bytes not captured so that
+// the stream stays contiguous.  The filler may be copied by tcpassembly, so
+// its stream recognizes it by sequence number once reassembled.
+func (w worker) assembleTruncated(dp *decode.DecodedPacket) {
+	captured := dp.TCP
+	captured.FIN = false
+	w.assembler.AssembleWithTimestamp(dp.NetFlow, &captured, dp.Info.Timestamp)
+
+	rest := dp.TCP
+	rest.Seq += uint32(len(dp.TCP.Payload))
+	if rest.SYN {
+		rest.Seq++
+		rest.SYN = false
+	}
+	rest.Payload = reader.Filler(dp.Truncated)
+	w.assembler.AssembleWithTimestamp(dp.NetFlow, &rest, dp.Info.Timestamp)
+}
+
 func (w worker) log(items ...interface{}) {
 	if w.logger != nil {
 		w.logger.Log(items...)
@@ -0,0 +1,431 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Constants from linux/if_packet.h
+const (
+	solPacket          = 263
+	packetRxRing       = 5
+	packetStatistics   = 6
+	packetVersion      = 10
+	packetFanout       = 18
+	tpacketV3          = 2
+	packetFanoutHash   = 0
+	fanoutFlagUniqueID = 0x2000
+	fanoutFlagDefrag   = 0x8000
+	tpStatusKernel     = 0
+	tpStatusUser       = 1
+	afpacketBlockSize  = 1 << 20
+	afpacketFrameSize  = 1 << 11
+	// how long the kernel waits before handing over a partially filled block
+	afpacketBlockTimeout = 10 * time.Millisecond
+)
+
+// Hardware types from linux/if_arp.h, reported by the kernel for each interface
+const (
+	arphrdEther    = 1
+	arphrdTunnel   = 768
+	arphrdTunnel6  = 769
+	arphrdLoopback = 772
+	arphrdSit      = 776
+	arphrdNone     = 0xfffe
+)
+
+// Offsets into struct tpacket_block_desc
+const (
+	blockStatusOffset      = 8
+	blockNumPktsOffset     = 12
+	blockFirstPacketOffset = 16
+)
+
+// tpacketReq3 mirrors struct tpacket_req3.
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlockTov uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// tpacket3Hdr mirrors the leading fields of struct tpacket3_hdr.
+type tpacket3Hdr struct {
+	nextOffset uint32
+	sec        uint32
+	nsec       uint32
+	snaplen    uint32
+	len        uint32
+	status     uint32
+	mac        uint16
+	net        uint16
+}
+
+// tpacketStatsV3 mirrors struct tpacket_stats_v3.
+type tpacketStatsV3 struct {
+	packets      uint32
+	drops        uint32
+	freezeQCount uint32
+}
+
+// ringSource reads packets from a memory-mapped AF_PACKET TPACKET_V3 ring.
+// Packets are copied directly from the ring into the caller's PacketBuffer.
+type ringSource struct {
+	fd       int
+	ring     []byte
+	index    int
+	linkType layers.LinkType
+	// number of blocks in the ring and the block currently being read
+	numBlocks int
+	block     int
+	// position within the current block, valid when inBlock is true
+	inBlock   bool
+	remaining uint32
+	offset    uint32
+	// counters accumulated from PACKET_STATISTICS, which resets on read
+	stats tpacketStatsV3
+}
+
+// newAFPacketSource opens fanout AF_PACKET sockets on each of netInterfaces,
+// each with its own ring, and merges them into a single ParallelSource.
+// bufferSize MiB of ring memory is divided between the sockets of each
+// interface.  The kernel truncates packets to snapLen bytes as the filter
+// directs.
+func newAFPacketSource(netInterfaces []string, bufferSize int, snapLen int, fanout int, bpf string) (PacketSource, error) {
+	if fanout < 1 {
+		fanout = 1
+	}
+	numBlocks := bufferSize * 1024 * 1024 / (afpacketBlockSize * fanout)
+	if numBlocks < 2 {
+		numBlocks = 2
+	}
+
+	var names []string
+	var sources []PacketSource
+	closeAll := func() {
+		for _, src := range sources {
+			src.(*ringSource).close()
+		}
+	}
+	for i, netInterface := range netInterfaces {
+		iface, err := net.InterfaceByName(netInterface)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		linkType, err := interfaceLinkType(netInterface)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s: %v", netInterface, err)
+		}
+		filter, err := compileFilter(linkType, snapLen, bpf)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		var groupID int
+		for j := 0; j < fanout; j++ {
+			rs, err := newRingSource(iface, i, linkType, numBlocks, filter)
+			if err == nil && fanout > 1 {
+				if j == 0 {
+					groupID, err = rs.createFanout()
+				} else {
+					err = rs.joinFanout(groupID)
+				}
+				if err != nil {
+					rs.close()
+				}
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("%s: %v", netInterface, err)
+			}
+			names = append(names, netInterface)
+			sources = append(sources, rs)
+		}
+	}
+	return newMultiSource(names, sources), nil
+}
+
+// interfaceLinkType returns the link type of the packets captured from the
+// named interface, as determined by its hardware type.
+func interfaceLinkType(netInterface string) (layers.LinkType, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", netInterface, "type"))
+	if err != nil {
+		return 0, err
+	}
+	hatype, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	return arphrdLinkType(hatype)
+}
+
+// arphrdLinkType returns the link type of the packets an AF_PACKET socket
+// captures from an interface of hardware type hatype, which for SOCK_RAW
+// sockets is the interface's own link-layer header.
+func arphrdLinkType(hatype int) (layers.LinkType, error) {
+	switch hatype {
+	case arphrdEther, arphrdLoopback:
+		return layers.LinkTypeEthernet, nil
+	case arphrdNone, arphrdTunnel, arphrdTunnel6, arphrdSit:
+		// IP packets with no link-layer header, as on tun devices
+		return layers.LinkTypeRaw, nil
+	}
+	return 0, fmt.Errorf("unsupported hardware type %d for AF_PACKET capture", hatype)
+}
+
+func newRingSource(iface *net.Interface, index int, linkType layers.LinkType, numBlocks int, filter []pcap.BPFInstruction) (rs *ringSource, err error) {
+	// receive nothing until bound to the interface below
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	rs = &ringSource{fd: fd, index: index, linkType: linkType, numBlocks: numBlocks}
+	defer func() {
+		if err != nil {
+			rs.close()
+			rs = nil
+		}
+	}()
+
+	// attach the filter before binding so we never see unfiltered packets
+	if err = rs.attachFilter(filter); err != nil {
+		return
+	}
+	if err = syscall.SetsockoptInt(fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return
+	}
+	req := tpacketReq3{
+		blockSize:      afpacketBlockSize,
+		blockNr:        uint32(numBlocks),
+		frameSize:      afpacketFrameSize,
+		frameNr:        uint32(numBlocks * afpacketBlockSize / afpacketFrameSize),
+		retireBlockTov: uint32(afpacketBlockTimeout / time.Millisecond),
+	}
+	if err = setsockopt(fd, solPacket, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return
+	}
+	rs.ring, err = syscall.Mmap(fd, 0, numBlocks*afpacketBlockSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	})
+	return
+}
+
+func (rs *ringSource) attachFilter(filter []pcap.BPFInstruction) error {
+	if len(filter) == 0 {
+		return nil
+	}
+	insns := make([]syscall.SockFilter, len(filter))
+	for i, f := range filter {
+		insns[i] = syscall.SockFilter{Code: f.Code, Jt: f.Jt, Jf: f.Jf, K: f.K}
+	}
+	prog := syscall.SockFprog{Len: uint16(len(insns)), Filter: &insns[0]}
+	return setsockopt(rs.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, unsafe.Pointer(&prog), unsafe.Sizeof(prog))
+}
+
+// createFanout adds this socket to a new fanout group, distributing packets
+// among the group's sockets by flow hash.  The kernel chooses an ID not used
+// by any other group, such as one made by another memsniff, and we return it
+// for the other sockets to join.
+func (rs *ringSource) createFanout() (int, error) {
+	arg := (packetFanoutHash | fanoutFlagDefrag | fanoutFlagUniqueID) << 16
+	if err := syscall.SetsockoptInt(rs.fd, solPacket, packetFanout, arg); err != nil {
+		return 0, err
+	}
+	arg, err := syscall.GetsockoptInt(rs.fd, solPacket, packetFanout)
+	if err != nil {
+		return 0, err
+	}
+	return arg & 0xffff, nil
+}
+
+// joinFanout adds this socket to the fanout group made by createFanout.
+func (rs *ringSource) joinFanout(groupID int) error {
+	arg := (packetFanoutHash|fanoutFlagDefrag)<<16 | groupID
+	return syscall.SetsockoptInt(rs.fd, solPacket, packetFanout, arg)
+}
+
+func (rs *ringSource) close() {
+	if rs.ring != nil {
+		_ = syscall.Munmap(rs.ring)
+		rs.ring = nil
+	}
+	_ = syscall.Close(rs.fd)
+}
+
+func (rs *ringSource) CollectPackets(pb *PacketBuffer) error {
+	pb.Clear()
+	for pb.PacketLen() < pb.PacketCap() {
+		pd, err := rs.peek()
+		if err == pcap.NextErrorTimeoutExpired && pb.PacketLen() > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pb.BytesRemaining() < len(pd.Data) {
+			return nil
+		}
+		// the only copy of the packet data, straight from the ring
+		if err = pb.Append(pd); err != nil {
+			return err
+		}
+		rs.advance()
+	}
+	return nil
+}
+
+// LinkType returns the link type of the interface captured from.
+func (rs *ringSource) LinkType() layers.LinkType {
+	return rs.linkType
+}
+
+func (rs *ringSource) DiscardPacket() error {
+	if _, err := rs.peek(); err != nil {
+		return err
+	}
+	rs.advance()
+	return nil
+}
+
+// peek returns the next packet in the ring without consuming it, waiting
+// briefly for the kernel to hand over a block if none is ready.
+func (rs *ringSource) peek() (PacketData, error) {
+	for !rs.inBlock {
+		if atomic.LoadUint32(rs.blockStatus())&tpStatusUser != 0 {
+			rs.inBlock = true
+			rs.remaining = rs.blockUint32(blockNumPktsOffset)
+			rs.offset = rs.blockUint32(blockFirstPacketOffset)
+			break
+		}
+		if err := rs.poll(); err != nil {
+			return PacketData{}, err
+		}
+	}
+	if rs.remaining == 0 {
+		rs.releaseBlock()
+		return rs.peek()
+	}
+
+	blockStart := rs.block * afpacketBlockSize
+	hdr := (*tpacket3Hdr)(unsafe.Pointer(&rs.ring[blockStart+int(rs.offset)]))
+	dataStart := blockStart + int(rs.offset) + int(hdr.mac)
+	return PacketData{
+		Info: gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(hdr.sec), int64(hdr.nsec)),
+			CaptureLength:  int(hdr.snaplen),
+			Length:         int(hdr.len),
+			InterfaceIndex: rs.index,
+		},
+		Data: rs.ring[dataStart : dataStart+int(hdr.snaplen)],
+	}, nil
+}
+
+// advance consumes the packet returned by the previous call to peek.
+func (rs *ringSource) advance() {
+	blockStart := rs.block * afpacketBlockSize
+	hdr := (*tpacket3Hdr)(unsafe.Pointer(&rs.ring[blockStart+int(rs.offset)]))
+	rs.offset += hdr.nextOffset
+	rs.remaining--
+	if rs.remaining == 0 {
+		rs.releaseBlock()
+	}
+}
+
+// releaseBlock returns the current block to the kernel.
+func (rs *ringSource) releaseBlock() {
+	atomic.StoreUint32(rs.blockStatus(), tpStatusKernel)
+	rs.inBlock = false
+	rs.block = (rs.block + 1) % rs.numBlocks
+}
+
+func (rs *ringSource) blockStatus() *uint32 {
+	return (*uint32)(unsafe.Pointer(&rs.ring[rs.block*afpacketBlockSize+blockStatusOffset]))
+}
+
+func (rs *ringSource) blockUint32(offset int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&rs.ring[rs.block*afpacketBlockSize+offset]))
+}
+
+// poll waits for the kernel to signal that a block is ready, returning
+// pcap.NextErrorTimeoutExpired if none is ready within afpacketBlockTimeout.
+func (rs *ringSource) poll() error {
+	pfd := struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{int32(rs.fd), pollIn, 0}
+	ts := syscall.NsecToTimespec(int64(afpacketBlockTimeout))
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1,
+		uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno == syscall.EINTR || (errno == 0 && n == 0) {
+		return pcap.NextErrorTimeoutExpired
+	}
+	if errno != 0 {
+		return errno
+	}
+	if pfd.revents&pollErr != 0 {
+		return fmt.Errorf("error polling AF_PACKET socket")
+	}
+	return nil
+}
+
+const (
+	pollIn  = 0x1
+	pollErr = 0x8
+)
+
+func (rs *ringSource) Stats() (*pcap.Stats, error) {
+	var s tpacketStatsV3
+	l := uint32(unsafe.Sizeof(s))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(rs.fd), solPacket, packetStatistics,
+		uintptr(unsafe.Pointer(&s)), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	rs.stats.packets += s.packets
+	rs.stats.drops += s.drops
+	rs.stats.freezeQCount += s.freezeQCount
+	return &pcap.Stats{
+		PacketsReceived: int(rs.stats.packets),
+		PacketsDropped:  int(rs.stats.drops),
+	}, nil
+}
+
+func setsockopt(fd, level, name int, val unsafe.Pointer, vallen uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), vallen, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestARPHRDLinkTypes(t *testing.T) {
+	for hatype, expected := range map[int]layers.LinkType{
+		arphrdEther:    layers.LinkTypeEthernet,
+		arphrdLoopback: layers.LinkTypeEthernet,
+		arphrdNone:     layers.LinkTypeRaw,
+		arphrdTunnel6:  layers.LinkTypeRaw,
+	} {
+		if lt, err := arphrdLinkType(hatype); err != nil || lt != expected {
+			t.Error("hardware type", hatype, "got", lt, err, "expected", expected)
+		}
+	}
+	// InfiniBand has a link-layer header we cannot decode
+	if lt, err := arphrdLinkType(32); err == nil {
+		t.Error("expected error for InfiniBand, got", lt)
+	}
+}
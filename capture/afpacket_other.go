@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import "errors"
+
+func newAFPacketSource(netInterfaces []string, bufferSize int, snapLen int, fanout int, bpf string) (PacketSource, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on Linux")
+}
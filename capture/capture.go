@@ -3,26 +3,90 @@
 package capture
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
+	"github.com/box/memsniff/log"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"io"
-	"strconv"
+	"net"
 	"time"
 )
 
 const (
+	// snapLen is the largest number of bytes captured from each packet.
 	snapLen = 65535
+	// MinSnapLen is the smallest snap length that still captures all the
+	// headers of memcached packets in the deepest tunnels decoded: up to
+	// 192 bytes for VXLAN over IPv6 carrying IPv6, with VLAN tags inside
+	// and out and the longest TCP options.  What remains is left for the
+	// first line of the payload, which may need a longer snap length.
+	MinSnapLen = 256
 )
 
+// LinkTypeLinuxSLL2 is the link type of Linux cooked captures in the format
+// introduced in libpcap 1.10.  Its number, 276, does not fit in gopacket's
+// 8 bit LinkType, so it is represented by 20, which is otherwise unassigned.
+// Sources only report it once they have checked that the full link type is
+// 276, and not another number that truncates to 20.
+const LinkTypeLinuxSLL2 layers.LinkType = 20
+
+// linkTypeNumberSLL2 is the link type number of LinkTypeLinuxSLL2 used by
+// libpcap and in capture files.
+const linkTypeNumberSLL2 = 276
+
+// linkTypeNumber returns the link type number used by libpcap and in capture
+// files for linkType.
+func linkTypeNumber(linkType layers.LinkType) uint32 {
+	if linkType == LinkTypeLinuxSLL2 {
+		return linkTypeNumberSLL2
+	}
+	return uint32(linkType)
+}
+
+// linkTypeFromNumber returns the link type with the number n, as read from a
+// capture file.
+func linkTypeFromNumber(n uint32) (layers.LinkType, error) {
+	if n == linkTypeNumberSLL2 {
+		return LinkTypeLinuxSLL2, nil
+	}
+	if n > 0xff || layers.LinkType(n) == LinkTypeLinuxSLL2 {
+		return 0, fmt.Errorf("unsupported link type %d", n)
+	}
+	return layers.LinkType(n), nil
+}
+
+// handleLinkType returns the link type of handle.  gopacket truncates the
+// link type numbers of pcap handles to 8 bits, so a truncated 276 is only
+// taken for LinkTypeLinuxSLL2 if the handle offers that link type by name.
+func handleLinkType(handle *pcap.Handle) (layers.LinkType, error) {
+	lt := handle.LinkType()
+	if lt != LinkTypeLinuxSLL2 {
+		return lt, nil
+	}
+	links, err := handle.ListDataLinks()
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range links {
+		if l.Name == "LINUX_SLL2" {
+			return lt, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported link type %d modulo 256", lt)
+}
+
 var (
 	// ErrNoSource is returned when neither a network interface nor a file
 	// is specified to New.
 	ErrNoSource = errors.New("must specify a network interface or file")
-	// ErrAmbiguousSource is returned when both a network interface and a file
+	// ErrAmbiguousSource is returned when both network interfaces and a file
 	// are specified to New.
 	ErrAmbiguousSource = errors.New("cannot specify both network interface and file")
+	// ErrReplayLive is returned when replay options are specified to New
+	// for a live capture.
+	ErrReplayLive = errors.New("replay speed, time window and follow only apply when reading from a file")
 )
 
 // PacketData represents a single packet's data plus metadata indicating when
@@ -38,84 +102,204 @@ type StatProvider interface {
 	Stats() (*pcap.Stats, error)
 }
 
+// InterfaceStats holds capture statistics for a single network interface.
+type InterfaceStats struct {
+	Name string
+	pcap.Stats
+}
+
+// InterfaceStatProvider provides capture statistics broken down by network
+// interface.
+type InterfaceStatProvider interface {
+	// InterfaceStats returns statistics for each interface, in the order the
+	// interfaces were specified.
+	InterfaceStats() ([]InterfaceStats, error)
+}
+
 // PacketSource is an abstract source of network packets.
 type PacketSource interface {
 	// CollectPackets fills pb with packets.
 	CollectPackets(pb *PacketBuffer) error
 	// DiscardPacket reads a single packet and discards its contents.
 	DiscardPacket() error
+	// LinkType returns the link type of the packets most recently collected.
+	LinkType() layers.LinkType
 	StatProvider
 }
 
+// ParallelSource is a PacketSource made up of several independent sources,
+// such as several interfaces or AF_PACKET fanout sockets, which may be read
+// concurrently.
+type ParallelSource interface {
+	PacketSource
+	// Sources returns the underlying sources.  Once Sources has been called,
+	// packets must only be read from the returned sources.
+	Sources() []PacketSource
+}
+
 type source struct {
 	*pcap.Handle
+	// index of the interface this source captures from, used to tag packets
+	index int
+	// link type of the handle, checked by handleLinkType
+	linkType layers.LinkType
+}
+
+func newSource(handle *pcap.Handle, index int) (source, error) {
+	linkType, err := handleLinkType(handle)
+	return source{handle, index, linkType}, err
+}
+
+// LinkType returns the link type of the handle.
+func (s source) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// Config describes the source of packets and which packets to capture.
+type Config struct {
+	// Network interfaces to capture from.  Packets from the nth interface
+	// have their CaptureInfo.InterfaceIndex set to n.
+	Interfaces []string
+	// pcap file to read from, or "-" for stdin.  A directory or glob pattern
+	// reads each of the matching files in order of their first packet.
+	InFile string
+	// Follow keeps reading InFile as it grows, and moves on to new files
+	// matching InFile as they appear.  Packets are read as soon as they are
+	// written unless Speed is given.
+	Follow bool
+	// BufferSize determines the amount of kernel memory (in MiB) to allocate
+	// for temporary storage on each interface. A larger BufferSize can reduce
+	// dropped packets as revealed by Stats, but use caution as kernel memory
+	// is a precious resource.
+	BufferSize int
+	// NoDelay replays packets from InFile as fast as possible instead of at
+	// the rate they were originally captured.
+	NoDelay bool
+	// Speed multiplies the rate at which packets from InFile are replayed,
+	// between MinSpeed and MaxSpeed.  Zero replays at the original rate.
+	Speed float64
+	// Start and End limit replay to a window of time within InFile.
+	Start TimeBound
+	End   TimeBound
+	// Ports on which memcached servers listen.
+	Ports []int
+	// Servers restricts capture to traffic to or from these networks.
+	// If empty, traffic on Ports is captured regardless of address.
+	Servers []*net.IPNet
+	// Filter is an additional BPF expression that captured packets must match.
+	Filter string
+	// Decapsulate also captures all VXLAN, GRE, ERSPAN and MPLS tunnels,
+	// since the filter cannot look inside them.  Their contents must be
+	// checked against Ports and Servers after decoding.
+	Decapsulate bool
+	// AFPacket captures from Interfaces using memory-mapped AF_PACKET
+	// sockets instead of libpcap.  Only supported on Linux.
+	AFPacket bool
+	// Fanout is the number of AF_PACKET sockets per interface among which
+	// the kernel distributes packets.
+	Fanout int
+	// SnapLen is the number of bytes captured from the start of each packet
+	// on Interfaces, from MinSnapLen up.  Zero captures whole packets.  A
+	// small SnapLen reduces copying at high packet rates, at the cost of
+	// only seeing the start of large values.
+	SnapLen int
+	// Logger receives messages about capture files that are skipped while
+	// replaying.  No logging is done if nil.
+	Logger log.Logger
 }
 
-// New creates a PacketSource bound to the specified network interface or pcap
-// file.
-//
-// bufferSize determines the amount of kernel memory (in MiB) to allocate for
-// temporary storage. A larger bufferSize can reduce dropped packets as
-// revealed by Stats, but use caution as kernel memory is a precious resource.
-func New(netInterface string, infile string, bufferSize int, noDelay bool, ports []int) (PacketSource, error) {
-	var err error
-	handle, err := makeHandle(netInterface, infile, bufferSize)
+// New creates a PacketSource bound to the network interfaces or pcap files
+// specified in conf.  Packets from multiple interfaces are merged into a
+// single PacketSource.
+func New(conf Config) (PacketSource, error) {
+	bpf, err := buildFilter(conf.Ports, conf.Servers, conf.Filter, conf.Decapsulate)
 	if err != nil {
 		return nil, err
 	}
-	bpf, err := portFilter(ports)
+	if conf.Speed != 0 && (conf.Speed < MinSpeed || conf.Speed > MaxSpeed) {
+		return nil, fmt.Errorf("replay speed must be between %gx and %gx", MinSpeed, MaxSpeed)
+	}
+	if conf.SnapLen != 0 && (conf.SnapLen < MinSnapLen || conf.SnapLen > snapLen) {
+		return nil, fmt.Errorf("snap length must be between %d and %d", MinSnapLen, snapLen)
+	}
+	if conf.SnapLen == 0 {
+		conf.SnapLen = snapLen
+	}
+	if conf.InFile == "" && (conf.Speed != 0 || !conf.Start.IsZero() || !conf.End.IsZero() || conf.Follow) {
+		return nil, ErrReplayLive
+	}
+	if conf.AFPacket {
+		if conf.InFile != "" {
+			return nil, ErrAmbiguousSource
+		}
+		if len(conf.Interfaces) == 0 {
+			return nil, ErrNoSource
+		}
+		return newAFPacketSource(conf.Interfaces, conf.BufferSize, conf.SnapLen, conf.Fanout, bpf)
+	}
+	if conf.InFile != "" {
+		if len(conf.Interfaces) > 0 {
+			return nil, ErrAmbiguousSource
+		}
+		return newFileReplayer(conf, bpf)
+	}
+	handles, err := makeHandles(conf.Interfaces, conf.BufferSize, conf.SnapLen)
 	if err != nil {
 		return nil, err
 	}
-	if err = handle.SetBPFFilter(bpf); err != nil {
-		return nil, err
+	sources := make([]PacketSource, len(handles))
+	for i, handle := range handles {
+		if err = handle.SetBPFFilter(bpf); err != nil {
+			closeHandles(handles)
+			return nil, err
+		}
+		if sources[i], err = newSource(handle, i); err != nil {
+			closeHandles(handles)
+			return nil, err
+		}
 	}
-	if !noDelay && infile != "" {
-		return newReplayer(source{handle}, 1000, 8*1024*1024), nil
+
+	if len(sources) == 1 {
+		return sources[0], nil
 	}
-	return source{handle}, nil
+	return newMultiSource(conf.Interfaces, sources), nil
 }
 
-func makeHandle(netInterface string, infile string, bufferSize int) (*pcap.Handle, error) {
-	var src *pcap.Handle
-	var err error
-
-	if netInterface != "" && infile != "" {
-		return nil, ErrAmbiguousSource
+func makeHandles(netInterfaces []string, bufferSize int, snapLen int) ([]*pcap.Handle, error) {
+	if len(netInterfaces) == 0 {
+		return nil, ErrNoSource
 	}
-	if netInterface != "" {
-		src, err = newLiveCapture(netInterface, bufferSize)
-		if err != nil {
-			return nil, err
-		}
-	} else if infile != "" {
-		// OpenOffline interprets "-" as stdin
-		src, err = pcap.OpenOffline(infile)
+
+	handles := make([]*pcap.Handle, 0, len(netInterfaces))
+	for _, netInterface := range netInterfaces {
+		src, err := newLiveCapture(netInterface, bufferSize, snapLen)
 		if err != nil {
+			closeHandles(handles)
 			return nil, err
 		}
-	} else {
-		return nil, ErrNoSource
+		handles = append(handles, src)
 	}
-
-	return src, nil
+	return handles, nil
 }
 
-func portFilter(ports []int) (string, error) {
-	if len(ports) < 1 {
-		return "", errors.New("need at least one port")
+// openFile opens a pcap or pcapng file, or stdin if infile is "-", for
+// reading packets matching bpf.  Files are read without libpcap, which cannot
+// decompress them or tell us how far through the file it has read.
+func openFile(infile string, follow bool, bpf string) (PacketSource, error) {
+	fs, err := openFileSource(infile, follow, bpf)
+	if err != nil {
+		return nil, err
 	}
+	return fs, nil
+}
 
-	var filterExpr bytes.Buffer
-	filterExpr.WriteString("tcp port " + strconv.Itoa(ports[0]))
-	for _, port := range ports[1:] {
-		filterExpr.WriteString(" or tcp port " + strconv.Itoa(port))
+func closeHandles(handles []*pcap.Handle) {
+	for _, h := range handles {
+		h.Close()
 	}
-
-	return filterExpr.String(), nil
 }
 
-func newLiveCapture(netInterface string, bufferSize int) (*pcap.Handle, error) {
+func newLiveCapture(netInterface string, bufferSize int, snapLen int) (*pcap.Handle, error) {
 	inactive, err := pcap.NewInactiveHandle(netInterface)
 	defer inactive.CleanUp()
 	if err != nil {
@@ -155,6 +339,7 @@ func (s source) CollectPackets(pb *PacketBuffer) error {
 		if err != nil {
 			return err
 		}
+		ci.InterfaceIndex = s.index
 		// Append makes a copy of the data, which is required because
 		// buf is overwritten on the next call to ZeroCopyReadPacketData.
 		err = pb.Append(PacketData{ci, buf})
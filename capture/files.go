@@ -0,0 +1,345 @@
+package capture
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/box/memsniff/log"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// isFileSet reports whether path names a directory or glob pattern of capture
+// files rather than a single file.
+func isFileSet(path string) bool {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.IsDir()
+	}
+	return strings.ContainsAny(path, "*?[")
+}
+
+// listFiles returns the capture files in the directory or matching the glob
+// pattern path, in no particular order.  Files in a directory or matching a
+// pattern are skipped unless they begin with the magic bytes of a capture,
+// which also skips files too new to have a complete header yet.
+func listFiles(path string) ([]string, error) {
+	var candidates []string
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			candidates = append(candidates, filepath.Join(path, e.Name()))
+		}
+	} else if isFileSet(path) {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		candidates = matches
+	} else {
+		return []string{path}, nil
+	}
+	var paths []string
+	for _, p := range candidates {
+		if isCaptureFile(p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// sortByStartTime sorts paths by the time returned by startTime for each.
+func sortByStartTime(paths []string, startTime func(path string) time.Time) {
+	starts := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		starts[p] = startTime(p)
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return starts[paths[i]].Before(starts[paths[j]])
+	})
+}
+
+// fileStartTime returns the timestamp of the first packet in the capture file
+// at path, or its modification time if it has no packets yet.
+func fileStartTime(path string) time.Time {
+	fs, err := openFileSource(path, false, "")
+	if err != nil {
+		return time.Time{}
+	}
+	defer fs.Close()
+	if pd, err := fs.nextRecord(); err == nil {
+		return pd.Info.Timestamp
+	}
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// fileChain reads a sequence of capture files as a single PacketSource, such
+// as the files written by tcpdump -G.  When following, fileChain waits for
+// more packets at the end of the last file, and moves on to new files
+// matching pattern as they appear.
+type fileChain struct {
+	// A Logger instance for reporting files that cannot be read.  No logging
+	// is done if nil.
+	Logger  log.Logger
+	pattern string
+	follow  bool
+	open    func(path string) (PacketSource, error)
+	// returns the time of the first packet in a file, to order new files
+	startTime func(path string) time.Time
+	// files not yet opened, in order
+	pending []string
+	// every file we have queued, so that rescans only pick up new files
+	seen        map[string]bool
+	current     PacketSource
+	currentPath string
+	// link type of the file most recently read
+	linkType layers.LinkType
+	// statistics and total size of files already finished
+	finished      pcap.Stats
+	finishedBytes int64
+}
+
+func newFileChain(pattern string, follow bool, open func(path string) (PacketSource, error)) (*fileChain, error) {
+	c := &fileChain{
+		pattern:   pattern,
+		follow:    follow,
+		open:      open,
+		startTime: fileStartTime,
+		seen:      make(map[string]bool),
+	}
+	if err := c.rescan(); err != nil {
+		return nil, err
+	}
+	if len(c.pending) == 0 && !follow {
+		return nil, fmt.Errorf("no capture files found in %s", pattern)
+	}
+	return c, nil
+}
+
+func (c *fileChain) CollectPackets(pb *PacketBuffer) error {
+	return c.read(func(src PacketSource) error {
+		return src.CollectPackets(pb)
+	})
+}
+
+func (c *fileChain) LinkType() layers.LinkType {
+	return c.linkType
+}
+
+func (c *fileChain) DiscardPacket() error {
+	return c.read(PacketSource.DiscardPacket)
+}
+
+// read calls fn with the current file, moving on to the next file when the
+// current one is exhausted.
+func (c *fileChain) read(fn func(src PacketSource) error) error {
+	for {
+		if c.current == nil {
+			if err := c.next(); err != nil {
+				return err
+			}
+		}
+		err := fn(c.current)
+		if err == nil {
+			c.linkType = c.current.LinkType()
+		}
+		if err == pcap.NextErrorTimeoutExpired && c.follow {
+			// the writer has moved on to a new file once one appears,
+			// so this one is complete after one more read
+			if len(c.pending) == 0 {
+				if err = c.rescan(); err != nil {
+					return err
+				}
+			}
+			if len(c.pending) == 0 {
+				return pcap.NextErrorTimeoutExpired
+			}
+			if err = fn(c.current); err != pcap.NextErrorTimeoutExpired {
+				return err
+			}
+			c.finish()
+			continue
+		}
+		if err == io.EOF {
+			c.finish()
+			continue
+		}
+		return err
+	}
+}
+
+// next opens the next file in the chain.  Files that cannot be opened are
+// logged and skipped, so that one bad file does not stop the replay.
+func (c *fileChain) next() error {
+	for {
+		if len(c.pending) == 0 && c.follow {
+			if err := c.rescan(); err != nil {
+				return err
+			}
+			if len(c.pending) == 0 {
+				time.Sleep(followPollInterval)
+				return pcap.NextErrorTimeoutExpired
+			}
+		}
+		if len(c.pending) == 0 {
+			return io.EOF
+		}
+		path := c.pending[0]
+		c.pending = c.pending[1:]
+		src, err := c.open(path)
+		if err != nil {
+			c.log("skipping", path+":", err)
+			continue
+		}
+		c.currentPath = path
+		c.current = src
+		return nil
+	}
+}
+
+func (c *fileChain) log(items ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Log(items...)
+	}
+}
+
+// finish closes the current file.
+func (c *fileChain) finish() {
+	if s, err := c.current.Stats(); err == nil {
+		c.finished.PacketsReceived += s.PacketsReceived
+		c.finished.PacketsDropped += s.PacketsDropped
+	}
+	if fi, err := os.Stat(c.currentPath); err == nil {
+		c.finishedBytes += fi.Size()
+	}
+	closeSource(c.current)
+	c.current = nil
+}
+
+// rescan queues any files matching pattern that have not been seen before,
+// in order of their first packet.  Only new files are opened, so that polling
+// a long rotated capture does not reread every file.
+func (c *fileChain) rescan() error {
+	paths, err := listFiles(c.pattern)
+	if err != nil {
+		return err
+	}
+	var added []string
+	for _, p := range paths {
+		if !c.seen[p] {
+			c.seen[p] = true
+			added = append(added, p)
+		}
+	}
+	sortByStartTime(added, c.startTime)
+	c.pending = append(c.pending, added...)
+	return nil
+}
+
+func (c *fileChain) Stats() (*pcap.Stats, error) {
+	s := c.finished
+	if c.current != nil {
+		cs, err := c.current.Stats()
+		if err != nil {
+			return nil, err
+		}
+		s.PacketsReceived += cs.PacketsReceived
+		s.PacketsDropped += cs.PacketsDropped
+	}
+	return &s, nil
+}
+
+// offset returns the number of bytes read from all files so far, or -1 if
+// unknown.
+func (c *fileChain) offset() int64 {
+	if c.current == nil {
+		return c.finishedBytes
+	}
+	if o, ok := c.current.(offsetter); ok {
+		return c.finishedBytes + o.offset()
+	}
+	return -1
+}
+
+// Close closes the current file.
+func (c *fileChain) Close() {
+	if c.current != nil {
+		closeSource(c.current)
+		c.current = nil
+	}
+}
+
+// newFileReplayer creates a replayer for the capture files named by
+// conf.InFile, which may be a single file, a directory or a glob pattern.
+func newFileReplayer(conf Config, bpf string) (*replayer, error) {
+	var open func() (PacketSource, error)
+	var fileSize int64
+	if conf.Follow || isFileSet(conf.InFile) {
+		openOne := func(path string) (PacketSource, error) {
+			return openFile(path, conf.Follow, bpf)
+		}
+		open = func() (PacketSource, error) {
+			c, err := newFileChain(conf.InFile, conf.Follow, openOne)
+			if err != nil {
+				return nil, err
+			}
+			c.Logger = conf.Logger
+			return c, nil
+		}
+		if !conf.Follow {
+			paths, err := listFiles(conf.InFile)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range paths {
+				if fi, err := os.Stat(p); err == nil {
+					fileSize += fi.Size()
+				}
+			}
+		}
+	} else {
+		open = func() (PacketSource, error) {
+			return openFile(conf.InFile, false, bpf)
+		}
+		if fi, err := os.Stat(conf.InFile); err == nil {
+			fileSize = fi.Size()
+		}
+	}
+
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+	r := newReplayer(src, 1000, 8*1024*1024)
+	if conf.Speed != 0 {
+		r.speed = conf.Speed
+	} else if conf.Follow {
+		// keep up with the writer rather than replaying history
+		r.speed = 0
+	}
+	if conf.NoDelay {
+		r.speed = 0
+	}
+	r.startBound = conf.Start
+	r.endBound = conf.End
+	// "-" is stdin, which we cannot reopen
+	if conf.InFile != "-" {
+		r.reopen = open
+		r.fileSize = fileSize
+	}
+	return r, nil
+}
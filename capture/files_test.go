@@ -0,0 +1,222 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapHeader returns the header of a little-endian pcap file of Ethernet
+// packets.
+func pcapHeader() []byte {
+	hdr := make([]byte, pcapFileHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], 1)
+	return hdr
+}
+
+// pcapRecord returns a pcap record of a one-byte packet.
+func pcapRecord(ts time.Time, b byte) []byte {
+	rec := make([]byte, pcapRecordHeaderLen+1)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], 1)
+	binary.LittleEndian.PutUint32(rec[12:], 1)
+	rec[pcapRecordHeaderLen] = b
+	return rec
+}
+
+func writePcap(t *testing.T, path string, start time.Time, data ...byte) {
+	buf := pcapHeader()
+	for i, b := range data {
+		buf = append(buf, pcapRecord(start.Add(time.Duration(i)*time.Second), b)...)
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAll collects packets from src until it returns io.EOF, or until it
+// times out if wantTimeout is set.
+func readAll(t *testing.T, src PacketSource, wantTimeout bool) []byte {
+	var got []byte
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	for {
+		err := src.CollectPackets(buf)
+		for i := 0; i < buf.PacketLen(); i++ {
+			got = append(got, buf.Packet(i).Data[0])
+		}
+		if err == io.EOF && !wantTimeout {
+			return got
+		}
+		if err == pcap.NextErrorTimeoutExpired && wantTimeout {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileChainOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	// names sort in the opposite order to the captures
+	writePcap(t, filepath.Join(dir, "b.pcap"), start, 1, 2)
+	writePcap(t, filepath.Join(dir, "a.pcap"), start.Add(time.Minute), 3)
+
+	for _, pattern := range []string{dir, filepath.Join(dir, "*.pcap")} {
+		uut, err := newFileChain(pattern, false, func(path string) (PacketSource, error) {
+			return openFileSource(path, false, "")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, uut, false); string(got) != "\x01\x02\x03" {
+			t.Error(pattern, "got packets", got)
+		}
+	}
+}
+
+func TestFileChainFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := filepath.Join(dir, "1.pcap")
+	writePcap(t, first, start, 1)
+
+	uut, err := newFileChain(dir, true, func(path string) (PacketSource, error) {
+		return openFileSource(path, true, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, uut, true); string(got) != "\x01" {
+		t.Error("got packets", got)
+	}
+
+	// a partially written record is not returned until it is complete
+	rec := pcapRecord(start.Add(time.Second), 2)
+	appendFile(t, first, rec[:10])
+	if got := readAll(t, uut, true); len(got) != 0 {
+		t.Error("got packets from partial record", got)
+	}
+	appendFile(t, first, rec[10:])
+	if got := readAll(t, uut, true); string(got) != "\x02" {
+		t.Error("got packets", got)
+	}
+
+	// rotation to a new file
+	writePcap(t, filepath.Join(dir, "2.pcap"), start.Add(time.Minute), 3, 4)
+	if got := readAll(t, uut, true); string(got) != "\x03\x04" {
+		t.Error("got packets after rotation", got)
+	}
+}
+
+// TestFileChainRescanNewOnly checks that rescanning only reads the start time
+// of files not seen before.
+func TestFileChainRescanNewOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	writePcap(t, filepath.Join(dir, "1.pcap"), start, 1)
+	writePcap(t, filepath.Join(dir, "2.pcap"), start.Add(time.Minute), 2)
+
+	uut, err := newFileChain(dir, true, func(path string) (PacketSource, error) {
+		return openFileSource(path, true, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read []string
+	uut.startTime = func(path string) time.Time {
+		read = append(read, filepath.Base(path))
+		return fileStartTime(path)
+	}
+
+	if err = uut.rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 0 {
+		t.Error("rescan read seen files", read)
+	}
+	writePcap(t, filepath.Join(dir, "3.pcap"), start.Add(2*time.Minute), 3)
+	if err = uut.rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || read[0] != "3.pcap" {
+		t.Error("rescan read", read, "expected only 3.pcap")
+	}
+}
+
+// TestFileChainSkipsUnreadable checks that files without capture magic are
+// not queued, and that a file that fails to open does not stop the chain.
+func TestFileChainSkipsUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	writePcap(t, filepath.Join(dir, "1.pcap"), start, 1)
+	writePcap(t, filepath.Join(dir, "2.pcap"), start.Add(time.Minute), 2)
+	writePcap(t, filepath.Join(dir, "3.pcap"), start.Add(2*time.Minute), 3)
+	if err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("rotated hourly\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := listFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 {
+		t.Error("listed", paths)
+	}
+
+	uut, err := newFileChain(dir, false, func(path string) (PacketSource, error) {
+		if filepath.Base(path) == "2.pcap" {
+			return nil, os.ErrPermission
+		}
+		return openFileSource(path, false, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, uut, false); string(got) != "\x01\x03" {
+		t.Error("got packets", got)
+	}
+}
@@ -0,0 +1,180 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// ParseServers converts a list of IP addresses and CIDR networks into
+// networks. A bare IP address is treated as a network containing only that
+// address.
+func ParseServers(servers []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(servers))
+	for _, s := range servers {
+		if strings.Contains(s, "/") {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid server address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// tunnelFilter matches the tunnels that the decoder can look inside.  It must
+// come last in a filter, since the mpls primitive changes the offsets used by
+// any primitives that follow it.
+const tunnelFilter = "udp port 4789 or ip proto gre or ip6 proto gre or mpls"
+
+// fragmentFilter matches IP fragments that cannot be matched by port because
+// they do not begin with the TCP or UDP header: IPv4 fragments after the first, and
+// IPv6 fragments, whose fragment header hides the protocol from libpcap.
+const fragmentFilter = "ip[6:2] & 0x1fff != 0 or ip6[6] == 44"
+
+// buildFilter returns a BPF expression matching TCP and UDP traffic on any of
+// ports, along with any IP fragments that may belong to it, restricted to
+// hosts in servers if any are given, and further restricted by the
+// user-supplied expression extra if it is not empty.  If tunnels is true,
+// tunneled traffic is also matched, since BPF cannot look inside the tunnels
+// to check ports and hosts.
+func buildFilter(ports []int, servers []*net.IPNet, extra string, tunnels bool) (string, error) {
+	clauses := make([]string, 0, 3)
+
+	pf, err := portFilter(ports)
+	if err != nil {
+		return "", err
+	}
+	clauses = append(clauses, pf)
+
+	if len(servers) > 0 {
+		clauses = append(clauses, serverFilter(servers))
+	}
+	extra = strings.TrimSpace(extra)
+	if tunnels {
+		match := "(" + joinClauses(clauses) + ") or " + tunnelFilter
+		if extra == "" {
+			return match, nil
+		}
+		return "(" + extra + ") and (" + match + ")", nil
+	}
+	if extra != "" {
+		clauses = append(clauses, extra)
+	}
+	return joinClauses(clauses), nil
+}
+
+// joinClauses returns a BPF expression matching all of clauses.
+func joinClauses(clauses []string) string {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, ") and (") + ")"
+}
+
+func portFilter(ports []int) (string, error) {
+	if len(ports) < 1 {
+		return "", errors.New("need at least one port")
+	}
+
+	var filterExpr bytes.Buffer
+	for i, port := range ports {
+		if i > 0 {
+			filterExpr.WriteString(" or ")
+		}
+		p := strconv.Itoa(port)
+		filterExpr.WriteString("tcp port " + p + " or udp port " + p)
+	}
+	filterExpr.WriteString(" or " + fragmentFilter)
+
+	return filterExpr.String(), nil
+}
+
+func serverFilter(servers []*net.IPNet) string {
+	terms := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ones, bits := s.Mask.Size()
+		if ones == bits {
+			terms = append(terms, "host "+s.IP.String())
+		} else {
+			terms = append(terms, "net "+s.String())
+		}
+	}
+	return strings.Join(terms, " or ")
+}
+
+// compileFilter compiles a BPF expression for packets with the given link
+// type, for use by sources that do not capture through libpcap.  The filter
+// accepts up to snapLen bytes of each matching packet.
+func compileFilter(linkType layers.LinkType, snapLen int, expr string) (insns []pcap.BPFInstruction, err error) {
+	err = withDeadHandle(linkType, snapLen, func(handle *pcap.Handle) error {
+		insns, err = handle.CompileBPFFilter(expr)
+		return err
+	})
+	return insns, err
+}
+
+// newMatcher compiles a BPF expression for matching packets with the given
+// link type in userspace.
+func newMatcher(linkType layers.LinkType, expr string) (bpf *pcap.BPF, err error) {
+	err = withDeadHandle(linkType, snapLen, func(handle *pcap.Handle) error {
+		bpf, err = handle.NewBPF(expr)
+		return err
+	})
+	return bpf, err
+}
+
+// withDeadHandle calls fn with a pcap handle of the given link type and snap
+// length that is not capturing any packets.
+//
+// libpcap needs a handle to compile a filter, so we open an empty capture
+// file with the right link type.
+func withDeadHandle(linkType layers.LinkType, snapLen int, fn func(handle *pcap.Handle) error) error {
+	f, err := ioutil.TempFile("", "memsniff-bpf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	hdr := make([]byte, pcapFileHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(snapLen))
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeNumber(linkType))
+	_, err = f.Write(hdr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	handle, err := pcap.OpenOffline(f.Name())
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return fn(handle)
+}
@@ -0,0 +1,66 @@
+package capture
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseServers(t *testing.T) {
+	nets, err := ParseServers([]string{"10.0.0.1", "10.1.0.0/16", "fe80::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1/32", "10.1.0.0/16", "fe80::1/128"}
+	if len(nets) != len(expected) {
+		t.Fatal("got", len(nets), "networks, expected", len(expected))
+	}
+	for i, n := range nets {
+		if n.String() != expected[i] {
+			t.Error("got", n, "expected", expected[i])
+		}
+	}
+}
+
+func TestParseServersInvalid(t *testing.T) {
+	if _, err := ParseServers([]string{"memcache01"}); err == nil {
+		t.Error("did not return error for hostname")
+	}
+	if _, err := ParseServers([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("did not return error for invalid CIDR")
+	}
+}
+
+func TestFilterPortsOnly(t *testing.T) {
+	testFilter(t, []int{11211, 11212}, nil, "", false,
+		"tcp port 11211 or udp port 11211 or tcp port 11212 or udp port 11212 or "+fragmentFilter)
+}
+
+func TestFilterServersAndExtra(t *testing.T) {
+	servers, _ := ParseServers([]string{"10.0.0.1", "10.1.0.0/16"})
+	testFilter(t, []int{11211}, servers, " vlan ", false,
+		"(tcp port 11211 or udp port 11211 or "+fragmentFilter+") and (host 10.0.0.1 or net 10.1.0.0/16) and (vlan)")
+}
+
+func TestFilterTunnels(t *testing.T) {
+	testFilter(t, []int{11211}, nil, "", true,
+		"(tcp port 11211 or udp port 11211 or "+fragmentFilter+") or "+tunnelFilter)
+	servers, _ := ParseServers([]string{"10.0.0.1"})
+	testFilter(t, []int{11211}, servers, "vlan", true,
+		"(vlan) and (((tcp port 11211 or udp port 11211 or "+fragmentFilter+") and (host 10.0.0.1)) or "+tunnelFilter+")")
+}
+
+func TestFilterNoPorts(t *testing.T) {
+	if _, err := buildFilter(nil, nil, "tcp", false); err == nil {
+		t.Error("did not return error for empty port list")
+	}
+}
+
+func testFilter(t *testing.T, ports []int, servers []*net.IPNet, extra string, tunnels bool, expected string) {
+	f, err := buildFilter(ports, servers, extra, tunnels)
+	if err != nil {
+		t.Error(err)
+	}
+	if f != expected {
+		t.Error("got", f, "expected", expected)
+	}
+}
@@ -0,0 +1,244 @@
+package capture
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// number of buffers each source may fill ahead of CollectPackets
+	multiSourceBuffers = 2
+	// how long CollectPackets waits for data before giving up, matching
+	// the timeout of a live pcap handle
+	multiSourceTimeout = 10 * time.Millisecond
+)
+
+// multiSource merges packets from several PacketSources, usually one per
+// network interface or AF_PACKET socket, into a single PacketSource.  Each
+// source is read on its own goroutine, so that a quiet interface does not
+// delay packets from a busy one.
+//
+// Sources may have different link types, such as an Ethernet interface and a
+// tunnel interface, but each batch of packets returned holds packets of a
+// single link type, given by LinkType.
+//
+// Consumers that can read from several sources concurrently should use
+// Sources instead, which avoids copying packets through the merge buffers.
+type multiSource struct {
+	names   []string
+	sources []PacketSource
+	// starts the per-source goroutines on first use of CollectPackets
+	// or DiscardPacket
+	start sync.Once
+	// buffers filled by the per-source goroutines
+	ready chan collected
+	// the buffer currently being drained, and the next packet in it
+	current collected
+	cursor  int
+	// link type of the packets most recently returned
+	linkType layers.LinkType
+	// number of sources that have not yet returned an error
+	active int
+	// error from a source to be returned by the next call to CollectPackets
+	pendingErr error
+}
+
+// collected is a buffer filled by a single source.
+type collected struct {
+	pb       *PacketBuffer
+	linkType layers.LinkType
+	err      error
+	// where to return pb once it has been drained
+	free chan<- *PacketBuffer
+}
+
+// newMultiSource merges sources.  names gives the interface of each source,
+// and may contain duplicates if several sources share an interface.
+func newMultiSource(names []string, sources []PacketSource) *multiSource {
+	m := &multiSource{
+		names:   names,
+		sources: sources,
+		ready:   make(chan collected, len(sources)*multiSourceBuffers),
+		active:  len(sources),
+	}
+	if len(sources) > 0 {
+		m.linkType = sources[0].LinkType()
+	}
+	return m
+}
+
+// Sources returns the underlying sources so they may be read concurrently.
+// CollectPackets and DiscardPacket must not be called after Sources.
+func (m *multiSource) Sources() []PacketSource {
+	return m.sources
+}
+
+func (m *multiSource) startCollecting() {
+	for _, src := range m.sources {
+		free := make(chan *PacketBuffer, multiSourceBuffers)
+		for i := 0; i < multiSourceBuffers; i++ {
+			free <- NewPacketBuffer(1000, 8*1024*1024)
+		}
+		go m.collect(src, free)
+	}
+}
+
+// collect fills buffers from src until src returns an error.
+func (m *multiSource) collect(src PacketSource, free chan *PacketBuffer) {
+	for pb := range free {
+		err := src.CollectPackets(pb)
+		if err == pcap.NextErrorTimeoutExpired {
+			free <- pb
+			continue
+		}
+		m.ready <- collected{pb, src.LinkType(), err, free}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiSource) CollectPackets(pb *PacketBuffer) error {
+	m.start.Do(m.startCollecting)
+	pb.Clear()
+	if m.pendingErr != nil {
+		err := m.pendingErr
+		m.pendingErr = nil
+		return err
+	}
+	for pb.PacketLen() < pb.PacketCap() {
+		if m.current.pb == nil {
+			// only wait for more data if we have nothing to return yet
+			err := m.next(pb.PacketLen() == 0)
+			if err == pcap.NextErrorTimeoutExpired && pb.PacketLen() > 0 {
+				return nil
+			}
+			if err != nil && pb.PacketLen() > 0 {
+				m.pendingErr = err
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if m.cursor >= m.current.pb.PacketLen() {
+			m.release()
+			continue
+		}
+		if pb.PacketLen() == 0 {
+			m.linkType = m.current.linkType
+		} else if m.current.linkType != m.linkType {
+			// leave packets of another link type for the next batch
+			break
+		}
+		p := m.current.pb.Packet(m.cursor)
+		if pb.BytesRemaining() < len(p.Data) {
+			break
+		}
+		if err := pb.Append(p); err != nil {
+			return err
+		}
+		m.cursor++
+	}
+	return nil
+}
+
+// LinkType returns the link type of the packets most recently returned by
+// CollectPackets, or of the first source before any have been returned.
+func (m *multiSource) LinkType() layers.LinkType {
+	return m.linkType
+}
+
+func (m *multiSource) DiscardPacket() error {
+	m.start.Do(m.startCollecting)
+	for {
+		if m.current.pb == nil {
+			if err := m.next(true); err != nil {
+				return err
+			}
+		}
+		if m.cursor < m.current.pb.PacketLen() {
+			m.cursor++
+			return nil
+		}
+		m.release()
+	}
+}
+
+// next makes the next filled buffer current.  If wait is true, next waits
+// briefly for a buffer to become available.
+func (m *multiSource) next(wait bool) error {
+	for m.active > 0 {
+		var c collected
+		if wait {
+			select {
+			case c = <-m.ready:
+			case <-time.After(multiSourceTimeout):
+				return pcap.NextErrorTimeoutExpired
+			}
+		} else {
+			select {
+			case c = <-m.ready:
+			default:
+				return pcap.NextErrorTimeoutExpired
+			}
+		}
+		if c.err != nil {
+			m.active--
+			if c.err == io.EOF {
+				continue
+			}
+			return c.err
+		}
+		m.current = c
+		m.cursor = 0
+		return nil
+	}
+	return io.EOF
+}
+
+// release returns the current buffer to its source to be filled again.
+func (m *multiSource) release() {
+	m.current.free <- m.current.pb
+	m.current = collected{}
+	m.cursor = 0
+}
+
+// Stats returns the combined statistics of all sources.
+func (m *multiSource) Stats() (*pcap.Stats, error) {
+	total := &pcap.Stats{}
+	for _, src := range m.sources {
+		s, err := src.Stats()
+		if err != nil {
+			return nil, err
+		}
+		total.PacketsReceived += s.PacketsReceived
+		total.PacketsDropped += s.PacketsDropped
+		total.PacketsIfDropped += s.PacketsIfDropped
+	}
+	return total, nil
+}
+
+// InterfaceStats returns the combined statistics of the sources for each
+// interface.
+func (m *multiSource) InterfaceStats() ([]InterfaceStats, error) {
+	var stats []InterfaceStats
+	for i, src := range m.sources {
+		s, err := src.Stats()
+		if err != nil {
+			return nil, err
+		}
+		if len(stats) == 0 || stats[len(stats)-1].Name != m.names[i] {
+			stats = append(stats, InterfaceStats{Name: m.names[i]})
+		}
+		is := &stats[len(stats)-1]
+		is.PacketsReceived += s.PacketsReceived
+		is.PacketsDropped += s.PacketsDropped
+		is.PacketsIfDropped += s.PacketsIfDropped
+	}
+	return stats, nil
+}
@@ -0,0 +1,136 @@
+package capture
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// finiteSource is a testSource that returns io.EOF once it runs out of packets.
+type finiteSource struct {
+	testSource
+	stats pcap.Stats
+}
+
+func (s *finiteSource) CollectPackets(pb *PacketBuffer) error {
+	if len(s.pd) == 0 {
+		pb.Clear()
+		return io.EOF
+	}
+	return s.testSource.CollectPackets(pb)
+}
+
+func (s *finiteSource) Stats() (*pcap.Stats, error) {
+	return &s.stats, nil
+}
+
+func TestMultiSourceMerges(t *testing.T) {
+	now := time.Now()
+	a := &finiteSource{stats: pcap.Stats{PacketsReceived: 2, PacketsDropped: 1}}
+	a.AddPacket(now, []byte{0})
+	a.AddPacket(now, []byte{0})
+	b := &finiteSource{stats: pcap.Stats{PacketsReceived: 1}}
+	b.AddPacket(now, []byte{1})
+
+	uut := newMultiSource([]string{"a", "b"}, []PacketSource{a, b})
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	counts := make(map[byte]int)
+	for {
+		err := uut.CollectPackets(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != pcap.NextErrorTimeoutExpired {
+			t.Fatal(err)
+		}
+		for i := 0; i < buf.PacketLen(); i++ {
+			counts[buf.Packet(i).Data[0]]++
+		}
+	}
+	if counts[0] != 2 || counts[1] != 1 {
+		t.Error("got packet counts", counts)
+	}
+
+	total, _ := uut.Stats()
+	if total.PacketsReceived != 3 || total.PacketsDropped != 1 {
+		t.Error("got combined stats", total)
+	}
+	perInterface, _ := uut.InterfaceStats()
+	if perInterface[1].Name != "b" || perInterface[1].PacketsReceived != 1 {
+		t.Error("got interface stats", perInterface[1])
+	}
+}
+
+// rawSource is a finiteSource of raw IP packets.
+type rawSource struct {
+	finiteSource
+}
+
+func (s *rawSource) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+func TestMultiSourceLinkTypes(t *testing.T) {
+	now := time.Now()
+	a := &finiteSource{}
+	a.AddPacket(now, []byte{0})
+	a.AddPacket(now, []byte{0})
+	b := &rawSource{}
+	b.AddPacket(now, []byte{1})
+
+	uut := newMultiSource([]string{"eth0", "tun0"}, []PacketSource{a, b})
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	expected := map[byte]layers.LinkType{0: layers.LinkTypeEthernet, 1: layers.LinkTypeRaw}
+	var n int
+	for {
+		err := uut.CollectPackets(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != pcap.NextErrorTimeoutExpired {
+			t.Fatal(err)
+		}
+		for i := 0; i < buf.PacketLen(); i++ {
+			if lt := uut.LinkType(); lt != expected[buf.Packet(i).Data[0]] {
+				t.Error("packet", buf.Packet(i).Data, "returned with link type", lt)
+			}
+			n++
+		}
+	}
+	if n != 3 {
+		t.Error("got", n, "packets, expected 3")
+	}
+}
+
+func TestMultiSourceDiscard(t *testing.T) {
+	a := &finiteSource{}
+	a.AddPacket(time.Now(), []byte{0})
+	uut := newMultiSource([]string{"a"}, []PacketSource{a})
+	if err := uut.DiscardPacket(); err != nil {
+		t.Error(err)
+	}
+	if err := uut.DiscardPacket(); err != io.EOF {
+		t.Error("expected EOF, got", err)
+	}
+}
+
+func TestMultiSourceInterfaceStatsByName(t *testing.T) {
+	a := &finiteSource{stats: pcap.Stats{PacketsReceived: 2}}
+	b := &finiteSource{stats: pcap.Stats{PacketsReceived: 3, PacketsDropped: 1}}
+	c := &finiteSource{stats: pcap.Stats{PacketsReceived: 1}}
+	uut := newMultiSource([]string{"eth0", "eth0", "eth1"}, []PacketSource{a, b, c})
+
+	stats, _ := uut.InterfaceStats()
+	if len(stats) != 2 {
+		t.Fatal("expected stats for 2 interfaces, got", stats)
+	}
+	if stats[0].Name != "eth0" || stats[0].PacketsReceived != 5 || stats[0].PacketsDropped != 1 {
+		t.Error("got eth0 stats", stats[0])
+	}
+	if stats[1].Name != "eth1" || stats[1].PacketsReceived != 1 {
+		t.Error("got eth1 stats", stats[1])
+	}
+}
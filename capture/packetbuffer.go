@@ -3,6 +3,7 @@ package capture
 import (
 	"errors"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 var (
@@ -85,6 +86,9 @@ func (b *BlockBuffer) Append(data []byte) error {
 type PacketBuffer struct {
 	BlockBuffer
 	cis []gopacket.CaptureInfo
+	// LinkType is the link type of every packet in the buffer.  It is not
+	// set by CollectPackets; callers copy it from the PacketSource.
+	LinkType layers.LinkType
 }
 
 // NewPacketBuffer creates a PacketBuffer with the specified limits.
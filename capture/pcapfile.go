@@ -0,0 +1,558 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// pcapFileHeaderLen is the size of the header at the start of a pcap file.
+const pcapFileHeaderLen = 24
+
+// pcapRecordHeaderLen is the size of the header preceding each packet in a
+// pcap file.
+const pcapRecordHeaderLen = 16
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	// largest packet record we accept, to detect corrupt files
+	maxPcapRecordLen = 256 * 1024
+	// largest pcapng block of any kind we accept
+	maxPcapngBlockLen = 16 * 1024 * 1024
+	// how long to wait for a followed file to grow before giving up
+	followPollInterval = 10 * time.Millisecond
+)
+
+// pcapng block types
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 1
+	pcapngEnhancedPacket       = 6
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptionEnd            = 0
+	pcapngOptionTSResolution   = 9
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+type fileFormat int
+
+const (
+	formatUnknown fileFormat = iota
+	formatPcap
+	formatPcapng
+)
+
+// fileSource reads packets from a pcap or pcapng file without libpcap.  The
+// file may be compressed with gzip, zstd or xz, and is decompressed as it is
+// read.  An uncompressed file may be followed as it grows; records are only
+// returned once they have been completely written.
+type fileSource struct {
+	name string
+	r    io.Reader
+	// closes the file and any decompressor
+	closers []io.Closer
+	// counts bytes read from the file itself, before decompression
+	raw *countingReader
+	// the buffered reader of an uncompressed file, or nil if compressed
+	plain *bufio.Reader
+	// wait for more data at the end of the file instead of returning io.EOF
+	follow bool
+	// BPF expression that returned packets must match, compiled for each
+	// interface once its link type is known
+	filterExpr string
+	// unread data is buf[start:end]
+	buf        []byte
+	start, end int
+	// parsed from the file and section headers
+	format fileFormat
+	order  binary.ByteOrder
+	ifaces []fileInterface
+	// number of packets returned
+	received int
+	// link type of the packets most recently returned
+	linkType layers.LinkType
+	// a packet read but not yet returned, because its link type differs
+	// from the rest of the batch
+	held         *PacketData
+	heldLinkType layers.LinkType
+}
+
+// fileInterface describes a capture interface recorded in a file.  A pcap
+// file always has exactly one.
+type fileInterface struct {
+	linkType layers.LinkType
+	// timestamps are in units of 10^-tsExp seconds, or 2^-tsExp seconds
+	// if tsBinary is true
+	tsExp    uint
+	tsBinary bool
+	filter   *pcap.BPF
+}
+
+func (fi *fileInterface) timestamp(ticks uint64) time.Time {
+	if fi.tsBinary {
+		sec := ticks >> fi.tsExp
+		frac := ticks & (1<<fi.tsExp - 1)
+		return time.Unix(int64(sec), int64(frac*1e9>>fi.tsExp))
+	}
+	unit := uint64(1)
+	for i := uint(0); i < fi.tsExp; i++ {
+		unit *= 10
+	}
+	sec, frac := ticks/unit, ticks%unit
+	for unit < 1e9 {
+		frac *= 10
+		unit *= 10
+	}
+	for unit > 1e9 {
+		frac /= 10
+		unit /= 10
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// openFileSource opens the capture file at path, or stdin if path is "-".
+// Compressed files are never followed, since they are only readable once
+// they are complete.
+func openFileSource(path string, follow bool, filterExpr string) (*fileSource, error) {
+	var f *os.File
+	if path == "-" {
+		f = os.Stdin
+		follow = false
+	} else {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	fs := &fileSource{
+		name:       path,
+		raw:        &countingReader{r: f},
+		closers:    []io.Closer{f},
+		follow:     follow,
+		filterExpr: filterExpr,
+		buf:        make([]byte, 1024*1024),
+	}
+	if err := fs.detectCompression(); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// detectCompression sets up decompression of the file if it begins with the
+// magic bytes of a supported compression format.
+func (fs *fileSource) detectCompression() error {
+	br := bufio.NewReader(fs.raw)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		fs.r = zr
+		fs.closers = append(fs.closers, zr)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		fs.r = zr
+		fs.closers = append(fs.closers, zr.IOReadCloser())
+	case bytes.HasPrefix(magic, xzMagic):
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			return err
+		}
+		fs.r = zr
+	default:
+		fs.r = br
+		fs.plain = br
+		return nil
+	}
+	fs.follow = false
+	return nil
+}
+
+// readMagic returns up to the first len(xzMagic) bytes of the file at path,
+// enough to recognize any of the formats we read.
+func readMagic(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	magic := make([]byte, len(xzMagic))
+	n, _ := io.ReadFull(f, magic)
+	return magic[:n]
+}
+
+// isCompressed reports whether the file at path begins with the magic bytes
+// of a supported compression format.
+func isCompressed(path string) bool {
+	return hasCompressedMagic(readMagic(path))
+}
+
+func hasCompressedMagic(magic []byte) bool {
+	return bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) ||
+		bytes.HasPrefix(magic, xzMagic)
+}
+
+// isCaptureFile reports whether the file at path begins with the magic bytes
+// of a pcap or pcapng file, or of a supported compression format.
+func isCaptureFile(path string) bool {
+	magic := readMagic(path)
+	if hasCompressedMagic(magic) {
+		return true
+	}
+	if len(magic) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case pcapMagicMicros, pcapMagicNanos, pcapngSectionHeader:
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *fileSource) CollectPackets(pb *PacketBuffer) error {
+	pb.Clear()
+	for pb.PacketLen() < pb.PacketCap() && pb.BytesRemaining() >= snapLen {
+		pd, linkType, err := fs.next()
+		if (err == io.EOF || err == pcap.NextErrorTimeoutExpired) && pb.PacketLen() > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pb.PacketLen() > 0 && linkType != fs.linkType {
+			// keep each batch to a single link type
+			fs.held, fs.heldLinkType = &pd, linkType
+			return nil
+		}
+		fs.linkType = linkType
+		if err = pb.Append(pd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fileSource) DiscardPacket() error {
+	_, linkType, err := fs.next()
+	if err == nil {
+		fs.linkType = linkType
+	}
+	return err
+}
+
+func (fs *fileSource) LinkType() layers.LinkType {
+	return fs.linkType
+}
+
+func (fs *fileSource) Stats() (*pcap.Stats, error) {
+	return &pcap.Stats{PacketsReceived: fs.received}, nil
+}
+
+// Close closes the underlying file and any decompressor.
+func (fs *fileSource) Close() {
+	for i := len(fs.closers) - 1; i >= 0; i-- {
+		_ = fs.closers[i].Close()
+	}
+	fs.closers = nil
+}
+
+// offset returns the number of bytes of the file consumed so far.  For a
+// compressed file this includes whatever the decompressor has read ahead.
+func (fs *fileSource) offset() int64 {
+	if fs.plain == nil {
+		return fs.raw.n
+	}
+	return fs.raw.n - int64(fs.plain.Buffered()) - int64(fs.end-fs.start)
+}
+
+// next returns the next packet that matches the filter, and the link type of
+// the interface it was captured on.  The returned data is only valid until
+// the next call to next.
+func (fs *fileSource) next() (PacketData, layers.LinkType, error) {
+	if fs.held != nil {
+		pd := *fs.held
+		fs.held = nil
+		return pd, fs.heldLinkType, nil
+	}
+	for {
+		pd, err := fs.nextRecord()
+		if err != nil {
+			return pd, layers.LinkTypeNull, err
+		}
+		iface := &fs.ifaces[pd.Info.InterfaceIndex]
+		// interfaces within a file are not memsniff's capture interfaces
+		pd.Info.InterfaceIndex = 0
+		if iface.filter == nil || iface.filter.Matches(pd.Info, pd.Data) {
+			fs.received++
+			return pd, iface.linkType, nil
+		}
+	}
+}
+
+// nextRecord returns the next packet in the file, with InterfaceIndex set
+// to the index of the interface within the file.
+func (fs *fileSource) nextRecord() (PacketData, error) {
+	if fs.format == formatUnknown {
+		if err := fs.need(4); err != nil {
+			return PacketData{}, err
+		}
+		magic := fs.buf[fs.start : fs.start+4]
+		if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+			fs.format = formatPcapng
+		} else {
+			if err := fs.readPcapHeader(); err != nil {
+				return PacketData{}, err
+			}
+			fs.format = formatPcap
+		}
+	}
+	if fs.format == formatPcapng {
+		return fs.nextPcapngPacket()
+	}
+	return fs.nextPcapRecord()
+}
+
+func (fs *fileSource) readPcapHeader() error {
+	if err := fs.need(pcapFileHeaderLen); err != nil {
+		return err
+	}
+	hdr := fs.buf[fs.start : fs.start+pcapFileHeaderLen]
+	iface := fileInterface{tsExp: 6}
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicros:
+		fs.order = binary.LittleEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNanos:
+		fs.order, iface.tsExp = binary.LittleEndian, 9
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicros:
+		fs.order = binary.BigEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNanos:
+		fs.order, iface.tsExp = binary.BigEndian, 9
+	default:
+		return fmt.Errorf("%s: not a pcap or pcapng file", fs.name)
+	}
+	linkType, err := linkTypeFromNumber(fs.order.Uint32(hdr[20:]))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.name, err)
+	}
+	iface.linkType = linkType
+	fs.start += pcapFileHeaderLen
+	return fs.addInterface(iface)
+}
+
+func (fs *fileSource) nextPcapRecord() (PacketData, error) {
+	if err := fs.need(pcapRecordHeaderLen); err != nil {
+		return PacketData{}, err
+	}
+	hdr := fs.buf[fs.start : fs.start+pcapRecordHeaderLen]
+	sec := int64(fs.order.Uint32(hdr[0:]))
+	frac := int64(fs.order.Uint32(hdr[4:]))
+	capLen := int(fs.order.Uint32(hdr[8:]))
+	origLen := int(fs.order.Uint32(hdr[12:]))
+	if capLen > maxPcapRecordLen {
+		return PacketData{}, fmt.Errorf("%s: corrupt record of %d bytes", fs.name, capLen)
+	}
+	if err := fs.need(pcapRecordHeaderLen + capLen); err != nil {
+		return PacketData{}, err
+	}
+
+	if fs.ifaces[0].tsExp == 6 {
+		frac *= 1000
+	}
+	dataStart := fs.start + pcapRecordHeaderLen
+	fs.start = dataStart + capLen
+	return PacketData{
+		Info: gopacket.CaptureInfo{
+			Timestamp:     time.Unix(sec, frac),
+			CaptureLength: capLen,
+			Length:        origLen,
+		},
+		Data: fs.buf[dataStart:fs.start],
+	}, nil
+}
+
+// nextPcapngPacket reads blocks until it finds a packet, processing any
+// section headers and interface descriptions along the way.
+func (fs *fileSource) nextPcapngPacket() (PacketData, error) {
+	for {
+		if err := fs.need(12); err != nil {
+			return PacketData{}, err
+		}
+		hdr := fs.buf[fs.start:]
+		blockType := binary.LittleEndian.Uint32(hdr)
+		if blockType == pcapngSectionHeader {
+			// the section header determines the byte order of everything
+			// up to the next section header, including its own length
+			switch {
+			case binary.LittleEndian.Uint32(hdr[8:]) == pcapngByteOrderMagic:
+				fs.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(hdr[8:]) == pcapngByteOrderMagic:
+				fs.order = binary.BigEndian
+			default:
+				return PacketData{}, fmt.Errorf("%s: corrupt pcapng section header", fs.name)
+			}
+		}
+		blockType = fs.order.Uint32(hdr)
+		blockLen := int(fs.order.Uint32(hdr[4:]))
+		if blockLen < 12 || blockLen%4 != 0 || blockLen > maxPcapngBlockLen {
+			return PacketData{}, fmt.Errorf("%s: corrupt pcapng block of %d bytes", fs.name, blockLen)
+		}
+		if err := fs.need(blockLen); err != nil {
+			return PacketData{}, err
+		}
+		body := fs.buf[fs.start+8 : fs.start+blockLen-4]
+		fs.start += blockLen
+
+		switch blockType {
+		case pcapngSectionHeader:
+			fs.ifaces = nil
+		case pcapngInterfaceDescription:
+			if err := fs.readInterfaceDescription(body); err != nil {
+				return PacketData{}, err
+			}
+		case pcapngEnhancedPacket:
+			return fs.readEnhancedPacket(body)
+		}
+		// other block types carry nothing we need
+	}
+}
+
+func (fs *fileSource) readInterfaceDescription(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("%s: corrupt pcapng interface description", fs.name)
+	}
+	linkType, err := linkTypeFromNumber(uint32(fs.order.Uint16(body)))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.name, err)
+	}
+	iface := fileInterface{
+		linkType: linkType,
+		tsExp:    6,
+	}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := fs.order.Uint16(opts)
+		l := int(fs.order.Uint16(opts[2:]))
+		if code == pcapngOptionEnd || 4+l > len(opts) {
+			break
+		}
+		if code == pcapngOptionTSResolution && l >= 1 {
+			res := opts[4]
+			iface.tsBinary = res&0x80 != 0
+			iface.tsExp = uint(res & 0x7f)
+		}
+		opts = opts[4+(l+3)/4*4:]
+	}
+	return fs.addInterface(iface)
+}
+
+func (fs *fileSource) readEnhancedPacket(body []byte) (PacketData, error) {
+	if len(body) < 20 {
+		return PacketData{}, fmt.Errorf("%s: corrupt pcapng packet", fs.name)
+	}
+	ifaceID := int(fs.order.Uint32(body))
+	ticks := uint64(fs.order.Uint32(body[4:]))<<32 | uint64(fs.order.Uint32(body[8:]))
+	capLen := int(fs.order.Uint32(body[12:]))
+	origLen := int(fs.order.Uint32(body[16:]))
+	if ifaceID >= len(fs.ifaces) || 20+capLen > len(body) {
+		return PacketData{}, fmt.Errorf("%s: corrupt pcapng packet", fs.name)
+	}
+	return PacketData{
+		Info: gopacket.CaptureInfo{
+			Timestamp:      fs.ifaces[ifaceID].timestamp(ticks),
+			CaptureLength:  capLen,
+			Length:         origLen,
+			InterfaceIndex: ifaceID,
+		},
+		Data: body[20 : 20+capLen],
+	}, nil
+}
+
+// addInterface records an interface described in the file, compiling the
+// filter for its link type.
+func (fs *fileSource) addInterface(iface fileInterface) error {
+	if fs.filterExpr != "" {
+		filter, err := newMatcher(iface.linkType, fs.filterExpr)
+		if err != nil {
+			return err
+		}
+		iface.filter = filter
+	}
+	fs.ifaces = append(fs.ifaces, iface)
+	return nil
+}
+
+// need ensures that at least n bytes of unread data are buffered.  If they
+// are not yet available, need returns pcap.NextErrorTimeoutExpired when
+// following the file, and io.EOF otherwise.
+func (fs *fileSource) need(n int) error {
+	if fs.end-fs.start >= n {
+		return nil
+	}
+	if n > len(fs.buf) {
+		buf := make([]byte, n)
+		fs.end = copy(buf, fs.buf[fs.start:fs.end])
+		fs.start = 0
+		fs.buf = buf
+	} else if fs.start+n > len(fs.buf) {
+		fs.end = copy(fs.buf, fs.buf[fs.start:fs.end])
+		fs.start = 0
+	}
+
+	for fs.end-fs.start < n {
+		m, err := fs.r.Read(fs.buf[fs.end:])
+		fs.end += m
+		if err == io.EOF && fs.end-fs.start < n {
+			if fs.follow {
+				time.Sleep(followPollInterval)
+				return pcap.NextErrorTimeoutExpired
+			}
+			// a partial record at the end of the file is most likely
+			// from a capture that was interrupted, so just ignore it
+			return io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
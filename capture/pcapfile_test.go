@@ -0,0 +1,237 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// testPcap returns an uncompressed pcap file with three one-byte packets.
+func testPcap(start time.Time) []byte {
+	buf := pcapHeader()
+	for i := 0; i < 3; i++ {
+		buf = append(buf, pcapRecord(start.Add(time.Duration(i)*time.Second), byte(i+1))...)
+	}
+	return buf
+}
+
+func TestCompressedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	compressors := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"gz": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"zst": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}
+	for ext, compress := range compressors {
+		var buf bytes.Buffer
+		w, err := compress(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(testPcap(start))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "test.pcap."+ext)
+		if err = ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if !isCompressed(path) {
+			t.Error(ext, "not detected as compressed")
+		}
+		fs, err := openFileSource(path, false, "")
+		if err != nil {
+			t.Fatal(ext, err)
+		}
+		if got := readAll(t, fs, false); string(got) != "\x01\x02\x03" {
+			t.Error(ext, "got packets", got)
+		}
+		if fs.offset() != int64(buf.Len()) {
+			t.Error(ext, "read", fs.offset(), "of", buf.Len(), "bytes")
+		}
+		fs.Close()
+	}
+}
+
+// pcapngBlock returns a little-endian pcapng block with the given body.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	l := uint32(12 + len(body))
+	b := make([]byte, 8, l)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], l)
+	b = append(b, body...)
+	return append(b, byte(l), byte(l>>8), byte(l>>16), byte(l>>24))
+}
+
+func TestPcapng(t *testing.T) {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	for i := 8; i < 16; i++ {
+		shb[i] = 0xff
+	}
+
+	// Ethernet with nanosecond timestamps
+	idb := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint16(idb[0:], 1)
+	idb = append(idb, pcapngOptionTSResolution, 0, 1, 0, 9, 0, 0, 0)
+	idb = append(idb, 0, 0, 0, 0)
+
+	ts := time.Date(2017, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	ticks := uint64(ts.UnixNano())
+	epb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ticks>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ticks))
+	binary.LittleEndian.PutUint32(epb[12:], 3)
+	binary.LittleEndian.PutUint32(epb[16:], 3)
+	epb = append(epb, 7, 8, 9)
+
+	var file []byte
+	file = append(file, pcapngBlock(pcapngSectionHeader, shb)...)
+	file = append(file, pcapngBlock(pcapngInterfaceDescription, idb)...)
+	// a block type we don't understand
+	file = append(file, pcapngBlock(4, []byte{1, 2, 3, 4})...)
+	file = append(file, pcapngBlock(pcapngEnhancedPacket, epb)...)
+
+	f, err := ioutil.TempFile("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.Write(file)
+	f.Close()
+
+	fs, err := openFileSource(f.Name(), false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	pd, linkType, err := fs.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pd.Info.Timestamp.Equal(ts) || !bytes.Equal(pd.Data, []byte{7, 8, 9}) {
+		t.Error("got packet", pd)
+	}
+	if linkType != layers.LinkTypeEthernet {
+		t.Error("got link type", linkType)
+	}
+	if _, _, err = fs.next(); err != io.EOF {
+		t.Error("expected EOF, got", err)
+	}
+}
+
+func TestPcapngLinkTypes(t *testing.T) {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	for i := 8; i < 16; i++ {
+		shb[i] = 0xff
+	}
+	file := pcapngBlock(pcapngSectionHeader, shb)
+	for _, linkType := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL} {
+		idb := make([]byte, 8)
+		binary.LittleEndian.PutUint16(idb[0:], uint16(linkType))
+		file = append(file, pcapngBlock(pcapngInterfaceDescription, idb)...)
+	}
+	for _, iface := range []uint32{0, 0, 1} {
+		epb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(epb[0:], iface)
+		binary.LittleEndian.PutUint32(epb[12:], 1)
+		binary.LittleEndian.PutUint32(epb[16:], 1)
+		epb = append(epb, byte(iface))
+		file = append(file, pcapngBlock(pcapngEnhancedPacket, epb)...)
+	}
+
+	f, err := ioutil.TempFile("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.Write(file)
+	f.Close()
+
+	fs, err := openFileSource(f.Name(), false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	pb := NewPacketBuffer(1000, 8*1024*1024)
+	if err = fs.CollectPackets(pb); err != nil {
+		t.Fatal(err)
+	}
+	if pb.PacketLen() != 2 || fs.LinkType() != layers.LinkTypeEthernet {
+		t.Error("got", pb.PacketLen(), "packets of link type", fs.LinkType())
+	}
+	if err = fs.CollectPackets(pb); err != nil {
+		t.Fatal(err)
+	}
+	if pb.PacketLen() != 1 || fs.LinkType() != layers.LinkTypeLinuxSLL || pb.Packet(0).Data[0] != 1 {
+		t.Error("got", pb.PacketLen(), "packets of link type", fs.LinkType())
+	}
+}
+
+func TestPcapLinkTypeNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		number   uint32
+		linkType layers.LinkType
+		ok       bool
+	}{
+		{1, layers.LinkTypeEthernet, true},
+		{276, LinkTypeLinuxSLL2, true},
+		// truncated to the numbers of other link types
+		{20, 0, false},
+		{257, 0, false},
+		{532, 0, false},
+	} {
+		file := testPcap(time.Unix(100, 0))
+		binary.LittleEndian.PutUint32(file[20:], tc.number)
+		f, err := ioutil.TempFile("", "memsniff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write(file)
+		f.Close()
+
+		fs, err := openFileSource(f.Name(), false, "")
+		if err == nil {
+			_, linkType, err := fs.next()
+			if tc.ok && (err != nil || linkType != tc.linkType) {
+				t.Error("link type", tc.number, "read as", linkType, err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("link type", tc.number, "read as", linkType)
+			}
+			fs.Close()
+		} else if tc.ok {
+			t.Error("link type", tc.number, err)
+		}
+		os.Remove(f.Name())
+	}
+}
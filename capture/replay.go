@@ -3,21 +3,118 @@ package capture
 import (
 	"fmt"
 	"github.com/box/memsniff/log"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// MinSpeed is the slowest supported replay speed multiplier.
+	MinSpeed = 0.1
+	// MaxSpeed is the fastest supported replay speed multiplier.
+	MaxSpeed = 100.0
+)
+
+// TimeBound is a point in a capture file, given either as an offset from the
+// first packet in the file or as an absolute time.  The zero TimeBound is
+// unbounded.
+type TimeBound struct {
+	Offset time.Duration
+	Time   time.Time
+}
+
+// ParseTimeBound parses a duration such as "5m30s", taken as an offset from
+// the first packet, or an RFC 3339 timestamp such as "2017-03-01T12:00:00Z".
+// An empty string is an unbounded TimeBound.
+func ParseTimeBound(s string) (TimeBound, error) {
+	if s == "" {
+		return TimeBound{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return TimeBound{Offset: d}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return TimeBound{}, fmt.Errorf("invalid time %q: must be an offset like 5m30s or a timestamp like 2006-01-02T15:04:05Z", s)
+	}
+	return TimeBound{Time: t}, nil
+}
+
+// IsZero reports whether b is unbounded.
+func (b TimeBound) IsZero() bool {
+	return b.Offset == 0 && b.Time.IsZero()
+}
+
+// resolve returns the absolute time of b in a capture whose first packet
+// was captured at origin, or the zero Time if b is unbounded.
+func (b TimeBound) resolve(origin time.Time) time.Time {
+	if !b.Time.IsZero() {
+		return b.Time
+	}
+	if b.Offset != 0 {
+		return origin.Add(b.Offset)
+	}
+	return time.Time{}
+}
+
+// ReplayPositioner reports progress through a capture file.
+type ReplayPositioner interface {
+	// ReplayPosition returns the capture time of the most recently replayed
+	// packet, and its offset from the first packet in the file.
+	ReplayPosition() (time.Time, time.Duration)
+}
+
 // replayer throttles results from a PacketSource according to the Timestamp
 // accompanying each packet.  It is most useful for recreating the input rate
-// of a previously captured pcap file.
+// of a previously captured pcap file, optionally sped up or slowed down and
+// limited to a window of time within the file.
 type replayer struct {
 	// A Logger instance for debugging.  No logging is done if nil.
 	Logger log.Logger
-	// The wall time that this replayer was created.
-	start time.Time
-	// The timestamp of the first packet returned from src, usually
+	// The rate of replay relative to the original capture, or 0 to replay
+	// as fast as possible.
+	speed float64
+	// The window of the capture to replay, relative to origin.
+	startBound TimeBound
+	endBound   TimeBound
+	// The absolute window, resolved once the first packet has been read.
+	windowStart time.Time
+	windowEnd   time.Time
+	// Whether we have passed windowEnd.
+	ended bool
+	// Guards the replay clock and src against concurrent use by a
+	// ReplayController.
+	mu sync.Mutex
+	// The replay clock: the capture time since first that had been replayed
+	// as of the wall time clockStart.  The clock does not advance while
+	// paused.
+	clockBase  time.Duration
+	clockStart time.Time
+	paused     bool
+	// Packets before this time are skipped after a seek.
+	skipUntil time.Time
+	// Reopens the capture file for seeking backward, or nil if the
+	// source cannot be reopened.
+	reopen func() (PacketSource, error)
+	// The number of packets read from src so far, and the position
+	// in the file of some of the packets read.
+	srcPackets int
+	index      []indexEntry
+	// The size of the capture file in bytes, or 0 if unknown.
+	fileSize int64
+	// The timestamp of the first packet read from src, usually
 	// the first packet in a capture file.
+	origin time.Time
+	// The timestamp of the first packet returned from the window.
 	first time.Time
+	// The timestamp of the most recently replayed packet in Unix
+	// nanoseconds, and origin in the same units.  Accessed atomically
+	// by ReplayPosition.
+	lastNanos   int64
+	originNanos int64
 	// The buffer we ask src to fill as much as possible.
 	buf *PacketBuffer
 	// The next packet in buf to be returned to the user.
@@ -34,32 +131,48 @@ const replayerTimeout = -pcap.BlockForever
 
 func newReplayer(src PacketSource, batchSize int, maxBytes int) *replayer {
 	return &replayer{
-		buf: NewPacketBuffer(batchSize, maxBytes),
-		src: src,
+		speed: 1,
+		buf:   NewPacketBuffer(batchSize, maxBytes),
+		src:   src,
 	}
 }
 
 func (r *replayer) CollectPackets(pb *PacketBuffer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	pb.Clear()
-	if r.start.IsZero() {
-		r.start = time.Now()
+	if r.ended {
+		return io.EOF
+	}
+	if r.speed == 0 && !r.paused {
+		return r.collectUnthrottled(pb)
+	}
+	if r.clockStart.IsZero() {
+		r.clockStart = time.Now()
 	}
 
-	elapsed := time.Since(r.start)
-	r.dropExpired(elapsed)
+	elapsed := r.elapsed()
+	if !r.paused {
+		r.dropExpired(elapsed)
+	}
 	for r.cursor >= r.buf.PacketLen() {
 		err := r.fill()
 		if err != nil {
 			return err
 		}
-		r.dropExpired(elapsed)
+		if !r.paused {
+			r.dropExpired(elapsed)
+		}
 	}
 
 	l := r.buf.PacketLen()
-	writeUntil := r.first.Add(elapsed + replayerTimeout)
+	writeUntil := r.first.Add(elapsed + r.scale(replayerTimeout))
 	for ; r.cursor < l && pb.BytesRemaining() >= snapLen; r.cursor++ {
 		p := r.buf.Packet(r.cursor)
-		r.received++
+		if r.pastEnd(p) {
+			r.ended = true
+			break
+		}
 		if p.Info.Timestamp.After(writeUntil) {
 			time.Sleep(replayerTimeout)
 			if pb.PacketLen() == 0 {
@@ -67,26 +180,83 @@ func (r *replayer) CollectPackets(pb *PacketBuffer) error {
 			}
 			return nil
 		}
+		r.received++
 		if err := pb.Append(p); err != nil {
 			return err
 		}
+		r.setLast(p)
 	}
 
+	if r.ended && pb.PacketLen() == 0 {
+		return io.EOF
+	}
 	return nil
 }
 
+// collectUnthrottled fills pb with as many packets as are available without
+// regard to their timestamps.
+func (r *replayer) collectUnthrottled(pb *PacketBuffer) error {
+	for pb.PacketLen() < pb.PacketCap() && pb.BytesRemaining() >= snapLen {
+		if r.cursor >= r.buf.PacketLen() {
+			if pb.PacketLen() > 0 {
+				return nil
+			}
+			if err := r.fill(); err != nil {
+				return err
+			}
+			continue
+		}
+		p := r.buf.Packet(r.cursor)
+		if r.pastEnd(p) {
+			r.ended = true
+			break
+		}
+		if err := pb.Append(p); err != nil {
+			return err
+		}
+		r.cursor++
+		r.received++
+		r.setLast(p)
+	}
+
+	if r.ended && pb.PacketLen() == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// elapsed returns how far into the capture we should be, measured from the
+// first packet in the window.
+func (r *replayer) elapsed() time.Duration {
+	if r.paused || r.clockStart.IsZero() {
+		return r.clockBase
+	}
+	return r.clockBase + r.scale(time.Since(r.clockStart))
+}
+
+// scale converts a wall clock duration into capture time.
+func (r *replayer) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * r.speed)
+}
+
 func (r *replayer) dropExpired(elapsed time.Duration) {
-	dropUntil := r.first.Add(elapsed).Add(replayerTimeout / -2)
+	dropUntil := r.first.Add(elapsed).Add(r.scale(replayerTimeout / -2))
 	for ; r.cursor < r.buf.PacketLen(); r.cursor++ {
 		p := r.buf.Packet(r.cursor)
-		if p.Info.Timestamp.After(dropUntil) {
+		if p.Info.Timestamp.After(dropUntil) || r.pastEnd(p) {
 			break
 		}
 		r.dropped++
+		r.setLast(p)
 	}
 }
 
 func (r *replayer) DiscardPacket() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended {
+		return io.EOF
+	}
 	if r.cursor >= r.buf.PacketLen() {
 		err := r.fill()
 		if r.buf.PacketLen() == 0 || err != nil {
@@ -95,35 +265,95 @@ func (r *replayer) DiscardPacket() error {
 	}
 
 	p := r.buf.Packet(r.cursor)
-	offset := p.Info.Timestamp.Sub(r.first)
-	elapsed := time.Since(r.start)
-	if offset > elapsed+replayerTimeout {
-		time.Sleep(replayerTimeout)
-		return pcap.NextErrorTimeoutExpired
+	if r.pastEnd(p) {
+		r.ended = true
+		return io.EOF
+	}
+	if r.speed != 0 || r.paused {
+		offset := p.Info.Timestamp.Sub(r.first)
+		if offset > r.elapsed()+r.scale(replayerTimeout) {
+			time.Sleep(replayerTimeout)
+			return pcap.NextErrorTimeoutExpired
+		}
 	}
 
 	r.cursor++
 	r.received++
+	r.setLast(p)
 	return nil
 }
 
 func (r *replayer) Stats() (*pcap.Stats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return &pcap.Stats{
 		PacketsReceived: r.received,
 		PacketsDropped:  r.dropped,
 	}, nil
 }
 
+func (r *replayer) LinkType() layers.LinkType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.LinkType()
+}
+
+// ReplayPosition returns the capture time of the most recently replayed
+// packet, and its offset from the first packet in the file.
+func (r *replayer) ReplayPosition() (time.Time, time.Duration) {
+	last := atomic.LoadInt64(&r.lastNanos)
+	if last == 0 {
+		return time.Time{}, 0
+	}
+	return time.Unix(0, last), time.Duration(last - atomic.LoadInt64(&r.originNanos))
+}
+
+// fill reads the next batch of packets from src, skipping any before the
+// start of the window or the target of a seek.
 func (r *replayer) fill() error {
-	err := r.src.CollectPackets(r.buf)
-	if err != nil {
-		return err
+	for {
+		err := r.src.CollectPackets(r.buf)
+		if err != nil {
+			return err
+		}
+		r.cursor = 0
+		if r.buf.PacketLen() == 0 {
+			return nil
+		}
+		if r.origin.IsZero() {
+			r.origin = r.buf.Packet(0).Info.Timestamp
+			atomic.StoreInt64(&r.originNanos, r.origin.UnixNano())
+			r.windowStart = r.startBound.resolve(r.origin)
+			r.windowEnd = r.endBound.resolve(r.origin)
+		}
+		r.addToIndex()
+		r.skipBefore(r.windowStart)
+		r.skipBefore(r.skipUntil)
+		if r.cursor < r.buf.PacketLen() {
+			if r.first.IsZero() {
+				r.first = r.buf.Packet(r.cursor).Info.Timestamp
+			}
+			return nil
+		}
 	}
-	r.cursor = 0
-	if r.first.IsZero() {
-		r.first = r.buf.Packet(0).Info.Timestamp
+}
+
+// skipBefore advances past packets in buf captured before t.
+func (r *replayer) skipBefore(t time.Time) {
+	for ; r.cursor < r.buf.PacketLen(); r.cursor++ {
+		if !r.buf.Packet(r.cursor).Info.Timestamp.Before(t) {
+			break
+		}
 	}
-	return nil
+}
+
+// pastEnd reports whether p falls after the end of the window.
+func (r *replayer) pastEnd(p PacketData) bool {
+	return !r.windowEnd.IsZero() && p.Info.Timestamp.After(r.windowEnd)
+}
+
+func (r *replayer) setLast(p PacketData) {
+	atomic.StoreInt64(&r.lastNanos, p.Info.Timestamp.UnixNano())
 }
 
 func (r *replayer) String() string {
@@ -3,7 +3,9 @@ package capture
 import (
 	"github.com/box/memsniff/log"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"io"
 	"testing"
 	"time"
 )
@@ -33,6 +35,10 @@ func (s *testSource) DiscardPacket() error {
 	return nil
 }
 
+func (s *testSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
 func (s *testSource) Stats() (*pcap.Stats, error) {
 	return &pcap.Stats{}, nil
 }
@@ -106,3 +112,78 @@ func TestDrop(t *testing.T) {
 		t.Error("expected a dropped packet")
 	}
 }
+
+func TestSpeed(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	delay := 40 * replayerTimeout
+	ts := &testSource{}
+	ts.AddPacket(start, []byte{0})
+	ts.AddPacket(start.Add(delay), []byte{1})
+
+	uut := newReplayer(ts, 1000, 8*1024*1024)
+	uut.speed = 10
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+
+	began := time.Now()
+	if err := uut.CollectPackets(buf); buf.PacketLen() != 1 {
+		t.Error(err)
+	}
+	for {
+		err := uut.CollectPackets(buf)
+		if buf.PacketLen() > 0 {
+			break
+		}
+		if err != pcap.NextErrorTimeoutExpired {
+			t.Fatal(err)
+		}
+	}
+
+	// at 10x the second packet is due after 4 timeouts instead of 40
+	if took := time.Since(began); took > delay/2 {
+		t.Error("second packet took", took, "at 10x speed")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	ts := &testSource{}
+	for i := 0; i < 10; i++ {
+		ts.AddPacket(start.Add(time.Duration(i)*time.Minute), []byte{byte(i)})
+	}
+
+	uut := newReplayer(ts, 1000, 8*1024*1024)
+	uut.speed = 0
+	uut.startBound = TimeBound{Offset: 3 * time.Minute}
+	uut.endBound = TimeBound{Time: start.Add(5 * time.Minute)}
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+
+	err := uut.CollectPackets(buf)
+	if err != nil || buf.PacketLen() != 3 {
+		t.Fatal("got", buf.PacketLen(), "packets:", err)
+	}
+	if buf.Packet(0).Data[0] != 3 || buf.Packet(2).Data[0] != 5 {
+		t.Error("got packets outside window", buf.Packet(0).Data, buf.Packet(2).Data)
+	}
+	if err = uut.CollectPackets(buf); err != io.EOF {
+		t.Error("expected EOF after window, got", err)
+	}
+
+	captured, offset := uut.ReplayPosition()
+	if !captured.Equal(start.Add(5*time.Minute)) || offset != 5*time.Minute {
+		t.Error("got replay position", captured, offset)
+	}
+}
+
+func TestParseTimeBound(t *testing.T) {
+	b, err := ParseTimeBound("5m30s")
+	if err != nil || b.Offset != 5*time.Minute+30*time.Second {
+		t.Error(b, err)
+	}
+	b, err = ParseTimeBound("2017-03-01T12:00:00Z")
+	if err != nil || !b.Time.Equal(time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Error(b, err)
+	}
+	if _, err = ParseTimeBound("yesterday"); err == nil {
+		t.Error("expected error")
+	}
+}
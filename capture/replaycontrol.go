@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoRewind is returned by Seek when seeking backward in a capture that
+// cannot be reopened, such as one read from stdin.
+var ErrNoRewind = errors.New("cannot seek backward in this capture")
+
+// ReplayController controls the replay of a capture file.
+type ReplayController interface {
+	ReplayPositioner
+	// SetPaused stops or restarts the replay clock.
+	SetPaused(paused bool)
+	// Step advances the replay clock by d of capture time while paused.
+	Step(d time.Duration)
+	// Seek moves the replay position forward or backward by d of
+	// capture time.
+	Seek(d time.Duration) error
+	// Progress returns the fraction of the capture file read so far,
+	// or -1 if it is unknown.
+	Progress() float64
+}
+
+// indexEntry records the position in the capture file of a batch of packets
+// read from src, so that we can return to it after reopening the file.
+type indexEntry struct {
+	timestamp time.Time
+	packets   int
+}
+
+// addToIndex records the position of the batch just read into buf.
+func (r *replayer) addToIndex() {
+	if len(r.index) == 0 || r.srcPackets > r.index[len(r.index)-1].packets {
+		r.index = append(r.index, indexEntry{
+			timestamp: r.buf.Packet(0).Info.Timestamp,
+			packets:   r.srcPackets,
+		})
+	}
+	r.srcPackets += r.buf.PacketLen()
+}
+
+// SetPaused stops or restarts the replay clock.  While paused, no packets are
+// replayed unless the clock is advanced by Step.
+func (r *replayer) SetPaused(paused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if paused == r.paused {
+		return
+	}
+	if paused {
+		if r.speed == 0 {
+			// there is no clock when replaying as fast as possible,
+			// so stop at the last packet replayed
+			last, _ := r.ReplayPosition()
+			if !last.IsZero() {
+				r.clockBase = last.Sub(r.first)
+			}
+		} else {
+			r.clockBase = r.elapsed()
+		}
+	} else {
+		r.clockStart = time.Now()
+	}
+	r.paused = paused
+}
+
+// Step advances the replay clock by d of capture time while paused.
+func (r *replayer) Step(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		r.clockBase += d
+	}
+}
+
+// Seek moves the replay position forward or backward by d of capture time,
+// relative to the most recently replayed packet.  Seeking backward reopens
+// the capture file and skips to the nearest indexed packet before the new
+// position.
+func (r *replayer) Seek(d time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.first.IsZero() {
+		// nothing read yet
+		return nil
+	}
+	last, _ := r.ReplayPosition()
+	if last.IsZero() {
+		last = r.first
+	}
+	target := last.Add(d)
+	if target.Before(r.first) {
+		target = r.first
+	}
+
+	if d < 0 {
+		if err := r.rewind(target); err != nil {
+			return err
+		}
+	} else {
+		r.skipBefore(target)
+	}
+	r.skipUntil = target
+	r.ended = !r.windowEnd.IsZero() && target.After(r.windowEnd)
+	r.clockBase = target.Sub(r.first)
+	r.clockStart = time.Now()
+	atomic.StoreInt64(&r.lastNanos, target.UnixNano())
+	return nil
+}
+
+// rewind reopens the capture file positioned at the last indexed batch of
+// packets that starts no later than target.
+func (r *replayer) rewind(target time.Time) error {
+	if r.reopen == nil || len(r.index) == 0 {
+		return ErrNoRewind
+	}
+	i := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].timestamp.After(target)
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	entry := r.index[i]
+
+	src, err := r.reopen()
+	if err != nil {
+		return err
+	}
+	for n := 0; n < entry.packets; n++ {
+		if err = src.DiscardPacket(); err != nil {
+			closeSource(src)
+			return err
+		}
+	}
+	closeSource(r.src)
+	r.src = src
+	r.srcPackets = entry.packets
+	r.buf.Clear()
+	r.cursor = 0
+	return nil
+}
+
+// Progress returns the fraction of the capture file read so far, or -1 if
+// the size of the file or the position within it is unknown.
+func (r *replayer) Progress() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fileSize <= 0 {
+		return -1
+	}
+	o, ok := r.src.(offsetter)
+	if !ok {
+		return -1
+	}
+	pos := o.offset()
+	if pos < 0 {
+		return -1
+	}
+	p := float64(pos) / float64(r.fileSize)
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// offsetter is implemented by sources that know how much of their capture
+// files they have read, which may differ from the size of the packets read
+// if the files are compressed, in pcapng format or filtered.
+type offsetter interface {
+	// offset returns the number of bytes read, or -1 if unknown.
+	offset() int64
+}
+
+// closeSource releases any resources held by src.
+func closeSource(src PacketSource) {
+	if c, ok := src.(interface {
+		Close()
+	}); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// minutes returns a testSource with n packets captured a minute apart.
+func minutes(start time.Time, n int) *testSource {
+	ts := &testSource{}
+	for i := 0; i < n; i++ {
+		ts.AddPacket(start.Add(time.Duration(i)*time.Minute), []byte{byte(i)})
+	}
+	return ts
+}
+
+func TestPauseAndStep(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	delay := 5 * replayerTimeout
+	ts := &testSource{}
+	ts.AddPacket(start, []byte{0})
+	ts.AddPacket(start.Add(delay), []byte{1})
+
+	uut := newReplayer(ts, 1000, 8*1024*1024)
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	if err := uut.CollectPackets(buf); buf.PacketLen() != 1 {
+		t.Fatal(err)
+	}
+
+	uut.SetPaused(true)
+	time.Sleep(2 * delay)
+	if err := uut.CollectPackets(buf); err != pcap.NextErrorTimeoutExpired {
+		t.Error("expected no packets while paused, got", buf.PacketLen(), err)
+	}
+
+	uut.Step(delay)
+	if err := uut.CollectPackets(buf); buf.PacketLen() != 1 {
+		t.Error("expected packet after step:", err)
+	}
+	if s, _ := uut.Stats(); s.PacketsDropped != 0 {
+		t.Error("dropped", s.PacketsDropped, "packets while paused")
+	}
+}
+
+func TestSeekForward(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	uut := newReplayer(minutes(start, 10), 1000, 8*1024*1024)
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	if err := uut.CollectPackets(buf); buf.PacketLen() != 1 {
+		t.Fatal(err)
+	}
+
+	if err := uut.Seek(5 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	err := uut.CollectPackets(buf)
+	if buf.PacketLen() != 1 || buf.Packet(0).Data[0] != 5 {
+		t.Error("expected packet 5 after seek, got", buf.PacketLen(), "packets:", err)
+	}
+}
+
+func TestSeekBackward(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	uut := newReplayer(minutes(start, 10), 1000, 8*1024*1024)
+	uut.speed = 0
+	uut.reopen = func() (PacketSource, error) {
+		return minutes(start, 10), nil
+	}
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	if err := uut.CollectPackets(buf); buf.PacketLen() != 10 {
+		t.Fatal(err)
+	}
+
+	if err := uut.Seek(-3 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	err := uut.CollectPackets(buf)
+	if buf.PacketLen() != 4 || buf.Packet(0).Data[0] != 6 {
+		t.Error("expected packets 6-9 after seek, got", buf.PacketLen(), "packets:", err)
+	}
+}
+
+func TestSeekBackwardWithoutReopen(t *testing.T) {
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	uut := newReplayer(minutes(start, 10), 1000, 8*1024*1024)
+	buf := NewPacketBuffer(1000, 8*1024*1024)
+	_ = uut.CollectPackets(buf)
+	if err := uut.Seek(-time.Minute); err != ErrNoRewind {
+		t.Error("expected ErrNoRewind, got", err)
+	}
+}
+
+// TestProgressUncompressed checks that progress through an uncompressed file
+// is measured in bytes of the file consumed, not read ahead.
+func TestProgressUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(dir, "1.pcap")
+	writePcap(t, path, start, 1, 2, 3)
+
+	uut, err := newFileReplayer(Config{InFile: path, NoDelay: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := uut.Progress(); p != 0 {
+		t.Error("progress before reading", p)
+	}
+	if got := readAll(t, uut, false); len(got) != 3 {
+		t.Fatal("got packets", got)
+	}
+	if p := uut.Progress(); p != 1 {
+		t.Error("progress after reading", p)
+	}
+}
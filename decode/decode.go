@@ -15,42 +15,102 @@ const (
 type DecodedPacket struct {
 	Info gopacket.CaptureInfo
 
-	ethParser *gopacket.DecodingLayerParser
-	loParser  *gopacket.DecodingLayerParser
-	decoded   []gopacket.LayerType
-	ether     layers.Ethernet
-	lo        layers.Loopback
-	dot1q     layers.Dot1Q
-	ipv4      layers.IPv4
-	ipv6      layers.IPv6
-	TCP       layers.TCP
-	Payload   gopacket.Payload
-	FlowHash  uint64
-	NetFlow   gopacket.Flow
+	// parsers for each first layer seen so far, created on first use
+	parsers map[gopacket.LayerType]*layerParser
+	// every layer decoder, by the layer type it decodes
+	decoders map[gopacket.LayerType]gopacket.DecodingLayer
+	decoded  []gopacket.LayerType
+	ether    layers.Ethernet
+	lo       layers.Loopback
+	sll      layers.LinuxSLL
+	sll2     linuxSLL2
+	raw      rawIP
+	dot1q    layers.Dot1Q
+	ipv4     layers.IPv4
+	ipv6     layers.IPv6
+	ipv6frag ipv6Fragment
+	frag     gopacket.Fragment
+	UDP      layers.UDP
+	vxlan    vxlan
+	gre      gre
+	mpls     mpls
+	TCP      layers.TCP
+	Payload  gopacket.Payload
+	FlowHash uint64
+	// NetFlow is the innermost network flow, inside any tunnels.
+	NetFlow gopacket.Flow
+	// Encapsulated is true if the packet was decoded from inside a tunnel.
+	Encapsulated bool
+	// Truncated is the number of bytes at the end of the TCP payload that
+	// were not captured because they were beyond the snap length.
+	Truncated int
+	// where the packet fits in its datagram, if it is an IP fragment
+	fragment fragmentInfo
+	// the innermost transport layer
+	transport gopacket.LayerType
 }
 
-func newDecodedPacket() *DecodedPacket {
-	dp := &DecodedPacket{}
-
-	dp.ethParser = gopacket.NewDecodingLayerParser(dp.ether.LayerType())
-	dp.ethParser.AddDecodingLayer(&dp.ether)
-	dp.ethParser.AddDecodingLayer(&dp.dot1q)
-	dp.ethParser.AddDecodingLayer(&dp.ipv4)
-	dp.ethParser.AddDecodingLayer(&dp.ipv6)
-	dp.ethParser.AddDecodingLayer(&dp.TCP)
-	dp.ethParser.AddDecodingLayer(&dp.Payload)
-
-	dp.loParser = gopacket.NewDecodingLayerParser(dp.lo.LayerType())
-	dp.loParser.AddDecodingLayer(&dp.lo)
-	dp.loParser.AddDecodingLayer(&dp.dot1q)
-	dp.loParser.AddDecodingLayer(&dp.ipv4)
-	dp.loParser.AddDecodingLayer(&dp.ipv6)
-	dp.loParser.AddDecodingLayer(&dp.TCP)
-	dp.loParser.AddDecodingLayer(&dp.Payload)
+// layerParser decodes packets beginning with a particular layer.
+type layerParser struct {
+	*gopacket.DecodingLayerParser
+	first gopacket.LayerType
+}
 
+func newDecodedPacket() *DecodedPacket {
+	dp := &DecodedPacket{
+		parsers: make(map[gopacket.LayerType]*layerParser),
+	}
+	dp.decoders = make(map[gopacket.LayerType]gopacket.DecodingLayer)
+	for _, dl := range []gopacket.DecodingLayer{
+		&dp.ether, &dp.lo, &dp.sll, &dp.sll2, &dp.raw,
+		// A tunneled layer is decoded into the same struct as the outer
+		// layer of the same type, so only the innermost headers are
+		// available once decoding is complete.
+		&dp.dot1q, &dp.ipv4, &dp.ipv6, &dp.ipv6frag, &dp.frag,
+		&dp.UDP, &dp.vxlan, &dp.gre, &dp.mpls, &dp.TCP, &dp.Payload,
+	} {
+		dp.decoders[dl.CanDecode().(gopacket.LayerType)] = dl
+	}
 	return dp
 }
 
+// linkLayerTypes gives the first layer of a packet captured with each
+// supported link type.
+var linkLayerTypes = map[layers.LinkType]gopacket.LayerType{
+	layers.LinkTypeEthernet:   layers.LayerTypeEthernet,
+	layers.LinkTypeNull:       layers.LayerTypeLoopback,
+	layers.LinkTypeLoop:       layers.LayerTypeLoopback,
+	layers.LinkTypeLinuxSLL:   layers.LayerTypeLinuxSLL,
+	capture.LinkTypeLinuxSLL2: layerTypeLinuxSLL2,
+	layers.LinkTypeRaw:        layerTypeRawIP,
+	layers.LinkTypeIPv4:       layerTypeRawIP,
+	layers.LinkTypeIPv6:       layerTypeRawIP,
+}
+
+// parser returns the parser for packets beginning with the layer first.
+func (dp *DecodedPacket) parser(first gopacket.LayerType) *layerParser {
+	if p, ok := dp.parsers[first]; ok {
+		return p
+	}
+	p := &layerParser{
+		DecodingLayerParser: gopacket.NewDecodingLayerParser(first),
+		first:               first,
+	}
+	for _, dl := range dp.decoders {
+		p.AddDecodingLayer(dl)
+	}
+	dp.parsers[first] = p
+	return p
+}
+
+// failedLayer returns the layer that could not be decoded by p.
+func (dp *DecodedPacket) failedLayer(p *layerParser) gopacket.LayerType {
+	if len(dp.decoded) == 0 {
+		return p.first
+	}
+	return dp.decoders[dp.decoded[len(dp.decoded)-1]].NextLayerType()
+}
+
 // IsTCP returns true if dp was successfully decoded as a TCP packet.
 func (dp *DecodedPacket) IsTCP() bool {
 	for _, lt := range dp.decoded {
@@ -61,36 +121,99 @@ func (dp *DecodedPacket) IsTCP() bool {
 	return false
 }
 
-// decode parses a single packet from raw byte data and updates the decoded
-// field of d.
+// IsUDP returns true if dp was successfully decoded as a UDP datagram, other
+// than one carrying a tunnel.
+func (dp *DecodedPacket) IsUDP() bool {
+	return dp.transport == layers.LayerTypeUDP
+}
+
+// decode parses a single packet of the given link type from raw byte data
+// and updates the decoded field of d.
 //
 // decode is not threadsafe.
-func (dp *DecodedPacket) decode(d *decoder, ci gopacket.CaptureInfo, data []byte) {
+func (dp *DecodedPacket) decode(d *decoder, linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte) {
 	dp.Info = ci
 	dp.FlowHash = 0
+	dp.Encapsulated = false
+	dp.fragment = fragmentInfo{}
+	dp.transport = 0
+	dp.decoded = dp.decoded[:0]
+	first, ok := linkLayerTypes[linkType]
+	if !ok {
+		d.failed(unsupportedLinkType(linkType))
+		return
+	}
+	dp.decodeLayers(d, first, data)
+}
+
+// decodeLayers parses data beginning with the layer first.
+func (dp *DecodedPacket) decodeLayers(d *decoder, first gopacket.LayerType, data []byte) {
 	dp.Payload = dp.Payload[:0]
-	parser := dp.ethParser
+	dp.Truncated = 0
+	parser := dp.parser(first)
 	err := parser.DecodeLayers(data, &dp.decoded)
-	if !dp.IsTCP() {
-		parser = dp.loParser
-		err = parser.DecodeLayers(data, &dp.decoded)
-	}
-	if err != nil {
-		d.logger.Log("Error from DecodeLayers:", err)
+	if lt, ok := err.(gopacket.UnsupportedLayerType); ok {
+		d.failed(unsupportedLayer(gopacket.LayerType(lt)))
+	} else if err != nil {
+		d.failed(dp.failedLayer(parser).String())
 	}
 
-	if parser.Truncated && ci.Length > d.largestPacket {
-		d.logger.Log("Found truncated packet of length", ci.Length)
-		d.largestPacket = ci.Length
+	if parser.Truncated && dp.Info.Length > d.largestPacket {
+		d.logger.Log("Found truncated packet of length", dp.Info.Length)
+		d.largestPacket = dp.Info.Length
 	}
+	// bytes missing from the end of the innermost IP datagram
+	var missing int
 	for _, layer := range dp.decoded {
 		switch layer {
 		case layers.LayerTypeIPv4:
 			dp.NetFlow = dp.ipv4.NetworkFlow()
+			missing = int(dp.ipv4.Length) - len(dp.ipv4.Contents) - len(dp.ipv4.Payload)
+			if dp.ipv4.Flags&layers.IPv4MoreFragments != 0 || dp.ipv4.FragOffset != 0 {
+				dp.fragment = fragmentInfo{
+					key:    fragmentKey{dp.NetFlow, uint32(dp.ipv4.Id), dp.ipv4.Protocol},
+					offset: int(dp.ipv4.FragOffset) * 8,
+					more:   dp.ipv4.Flags&layers.IPv4MoreFragments != 0,
+					next:   dp.ipv4.Protocol.LayerType(),
+				}
+			}
 		case layers.LayerTypeIPv6:
 			dp.NetFlow = dp.ipv6.NetworkFlow()
+			missing = int(dp.ipv6.Length) - len(dp.ipv6.Payload)
+		case layers.LayerTypeIPv6Fragment:
+			dp.fragment = fragmentInfo{
+				key:    fragmentKey{dp.NetFlow, dp.ipv6frag.Identification, 0},
+				offset: int(dp.ipv6frag.FragmentOffset) * 8,
+				more:   dp.ipv6frag.MoreFragments,
+				next:   dp.ipv6frag.NextHeader.LayerType(),
+			}
+		case gopacket.LayerTypeFragment:
+			dp.fragment.data = dp.frag
 		case layers.LayerTypeTCP:
+			dp.transport = layers.LayerTypeTCP
+			if missing > 0 {
+				dp.Truncated = missing
+				d.truncated++
+			}
 			dp.FlowHash = hashCombine(dp.NetFlow.FastHash(), dp.TCP.TransportFlow().FastHash())
+		case layers.LayerTypeUDP:
+			dp.transport = layers.LayerTypeUDP
+			dp.FlowHash = hashCombine(dp.NetFlow.FastHash(), dp.UDP.TransportFlow().FastHash())
+		case layers.LayerTypeVXLAN:
+			// the UDP datagram was only a tunnel
+			dp.transport = 0
+			dp.Encapsulated = true
+			d.encapsulated.VXLAN++
+		case layers.LayerTypeGRE:
+			dp.Encapsulated = true
+			if dp.gre.erspan {
+				d.encapsulated.ERSPAN++
+			} else {
+				d.encapsulated.GRE++
+			}
+		case layers.LayerTypeMPLS:
+			dp.Encapsulated = true
+			d.encapsulated.MPLS++
 		default:
 		}
 	}
@@ -104,13 +227,25 @@ type decoder struct {
 	handler       Handler
 	largestPacket int
 	decoded       []*DecodedPacket
+	// packets decoded from inside tunnels and packets that failed to
+	// decode in the current batch
+	encapsulated EncapsulationStats
+	failures     map[string]int
+	// TCP packets truncated by the snap length in the current batch
+	truncated int
+	// report is invoked with the counts for each batch, if not nil
+	report func(encapsulated EncapsulationStats, failures map[string]int, truncated int)
+	// defrag reassembles IP fragments, which are passed through
+	// undecoded if it is nil
+	defrag *defragmenter
 }
 
 func newDecoder(logger log.Logger, handler Handler) *decoder {
 	d := &decoder{
-		logger:  logger,
-		handler: handler,
-		decoded: make([]*DecodedPacket, batchSize),
+		logger:   logger,
+		handler:  handler,
+		decoded:  make([]*DecodedPacket, batchSize),
+		failures: make(map[string]int),
 	}
 	for i := 0; i < len(d.decoded); i++ {
 		d.decoded[i] = newDecodedPacket()
@@ -118,8 +253,8 @@ func newDecoder(logger log.Logger, handler Handler) *decoder {
 	return d
 }
 
-// decode parses a batch of packets from raw byte data and invokes d's handler
-// for each packet.
+// decode parses a batch of packets of the link type given by pb from raw byte
+// data and invokes d's handler for each packet.
 //
 // decodeBatch is not threadsafe.
 func (d *decoder) decodeBatch(pb *capture.PacketBuffer) {
@@ -127,11 +262,36 @@ func (d *decoder) decodeBatch(pb *capture.PacketBuffer) {
 	if numPackets > len(d.decoded) {
 		panic("not enough space for decoded packets")
 	}
+	d.encapsulated = EncapsulationStats{}
+	d.truncated = 0
+	for layer := range d.failures {
+		delete(d.failures, layer)
+	}
 	for i := 0; i < numPackets; i++ {
 		pd := pb.Packet(i)
-		d.decoded[i].decode(d, pd.Info, pd.Data)
+		d.decoded[i].decode(d, pb.LinkType, pd.Info, pd.Data)
+	}
+	batch := d.decoded[:numPackets]
+	if d.defrag != nil {
+		batch = d.defrag.defragment(d, batch)
 	}
-	d.handler(d.decoded[:numPackets])
+	if d.report != nil && (d.encapsulated != (EncapsulationStats{}) || len(d.failures) > 0 || d.truncated > 0) {
+		d.report(d.encapsulated, d.failures, d.truncated)
+	}
+	d.handler(batch)
+}
+
+// failed counts a packet that could not be decoded because of layer.
+func (d *decoder) failed(layer string) {
+	d.failures[layer]++
+}
+
+func unsupportedLinkType(linkType layers.LinkType) string {
+	return "link type " + linkType.String() + " (unsupported)"
+}
+
+func unsupportedLayer(layer gopacket.LayerType) string {
+	return layer.String() + " (unsupported)"
 }
 
 // based on boost::hash_combine
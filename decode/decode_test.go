@@ -0,0 +1,396 @@
+package decode
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/box/memsniff/capture"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	outerSrc = net.IP{192, 168, 0, 1}
+	outerDst = net.IP{192, 168, 0, 2}
+	innerSrc = net.IP{10, 0, 0, 1}
+	innerDst = net.IP{10, 0, 0, 2}
+)
+
+func TestDecodeVXLAN(t *testing.T) {
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 4789}
+	vxlanHeader := []byte{0x08, 0, 0, 0, 0, 0, 0x01, 0}
+	pkt := outerFrame(t, layers.IPProtocolUDP, udp, gopacket.Payload(append(vxlanHeader, innerFrame(t)...)))
+	testDecodeTunnel(t, pkt, EncapsulationStats{VXLAN: 1})
+}
+
+func TestDecodeGRE(t *testing.T) {
+	greHeader := []byte{0, 0, 0x08, 0x00}
+	pkt := outerFrame(t, layers.IPProtocolGRE, gopacket.Payload(append(greHeader, innerIP(t)...)))
+	testDecodeTunnel(t, pkt, EncapsulationStats{GRE: 1})
+}
+
+func TestDecodeERSPAN(t *testing.T) {
+	// type II: GRE with sequence number, then an 8 byte ERSPAN header
+	greHeader := []byte{0x10, 0, 0x88, 0xbe, 0, 0, 0, 1}
+	erspanHeader := []byte{0x10, 0, 0, 0x01, 0, 0, 0, 0}
+	payload := append(append(greHeader, erspanHeader...), innerFrame(t)...)
+	testDecodeTunnel(t, outerFrame(t, layers.IPProtocolGRE, gopacket.Payload(payload)), EncapsulationStats{ERSPAN: 1})
+
+	// type III with the platform specific subheader
+	greHeader = []byte{0x10, 0, 0x22, 0xeb, 0, 0, 0, 1}
+	erspanHeader = []byte{0x20, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	platform := make([]byte, 8)
+	payload = append(append(append(greHeader, erspanHeader...), platform...), innerFrame(t)...)
+	testDecodeTunnel(t, outerFrame(t, layers.IPProtocolGRE, gopacket.Payload(payload)), EncapsulationStats{ERSPAN: 1})
+}
+
+func TestDecodeMPLS(t *testing.T) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeMPLSUnicast,
+	}
+	labels := []byte{
+		0, 0x01, 0x00, 64,
+		0, 0x02, 0x01, 64, // bottom of stack
+	}
+	pkt := serialize(t, eth, gopacket.Payload(append(labels, innerIP(t)...)))
+	testDecodeTunnel(t, pkt, EncapsulationStats{MPLS: 1})
+}
+
+func TestDecodeUntunneled(t *testing.T) {
+	testDecodeTunnel(t, innerFrame(t), EncapsulationStats{})
+}
+
+func testDecodeTunnel(t *testing.T, pkt []byte, expected EncapsulationStats) {
+	d := newDecoder(testLogger{t}, nil)
+	dp := d.decoded[0]
+	dp.decode(d, layers.LinkTypeEthernet, gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(pkt)}, pkt)
+	if !dp.IsTCP() {
+		t.Fatal("not decoded as TCP:", dp.decoded)
+	}
+	if src, dst := dp.NetFlow.Endpoints(); !net.IP(src.Raw()).Equal(innerSrc) || !net.IP(dst.Raw()).Equal(innerDst) {
+		t.Error("got flow", dp.NetFlow, "expected", innerSrc, "->", innerDst)
+	}
+	if dp.TCP.DstPort != 11211 || string(dp.TCP.Payload) != "get foo\r\n" {
+		t.Error("got TCP", dp.TCP.SrcPort, "->", dp.TCP.DstPort, dp.TCP.Payload)
+	}
+	if dp.Encapsulated != (expected != EncapsulationStats{}) {
+		t.Error("got Encapsulated", dp.Encapsulated)
+	}
+	if d.encapsulated != expected {
+		t.Error("got counts", d.encapsulated, "expected", expected)
+	}
+}
+
+// outerFrame wraps payload in Ethernet and IPv4 headers for the tunnel.
+func outerFrame(t *testing.T, proto layers.IPProtocol, payload ...gopacket.SerializableLayer) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: outerSrc, DstIP: outerDst}
+	return serialize(t, append([]gopacket.SerializableLayer{eth, ip}, payload...)...)
+}
+
+// innerFrame returns an Ethernet frame carrying a memcached request.
+func innerFrame(t *testing.T) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 3},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 4},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	return serialize(t, eth, gopacket.Payload(innerIP(t)))
+}
+
+// innerIP returns an IPv4 packet carrying a memcached request.
+func innerIP(t *testing.T) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: innerSrc, DstIP: innerDst}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 11211, Seq: 1, PSH: true, ACK: true, Window: 1024}
+	return serialize(t, ip, tcp, gopacket.Payload("get foo\r\n"))
+}
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeLinuxSLL(t *testing.T) {
+	sll := []byte{
+		0, 0, // packet type
+		0, 1, // ARPHRD_ETHER
+		0, 6, // address length
+		0, 0, 0, 0, 0, 3, 0, 0, // address
+		0x08, 0x00, // protocol
+	}
+	testDecodeLinkType(t, layers.LinkTypeLinuxSLL, append(sll, innerIP(t)...))
+}
+
+func TestDecodeLinuxSLL2(t *testing.T) {
+	sll2 := []byte{
+		0x08, 0x00, // protocol
+		0, 0, // reserved
+		0, 0, 0, 2, // interface index
+		0, 1, // ARPHRD_ETHER
+		0,                      // packet type
+		6,                      // address length
+		0, 0, 0, 0, 0, 3, 0, 0, // address
+	}
+	testDecodeLinkType(t, capture.LinkTypeLinuxSLL2, append(sll2, innerIP(t)...))
+}
+
+func testDecodeLinkType(t *testing.T, linkType layers.LinkType, pkt []byte) {
+	d := newDecoder(testLogger{t}, nil)
+	dp := d.decoded[0]
+	dp.decode(d, linkType, gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(pkt)}, pkt)
+	if !dp.IsTCP() {
+		t.Fatal("not decoded as TCP:", dp.decoded)
+	}
+	if src, dst := dp.NetFlow.Endpoints(); !net.IP(src.Raw()).Equal(innerSrc) || !net.IP(dst.Raw()).Equal(innerDst) {
+		t.Error("got flow", dp.NetFlow, "expected", innerSrc, "->", innerDst)
+	}
+}
+
+func TestDecodeRawIP(t *testing.T) {
+	testDecodeLinkType(t, layers.LinkTypeRaw, innerIP(t))
+}
+
+func TestDecodeFailures(t *testing.T) {
+	d := newDecoder(testLogger{t}, nil)
+	dp := d.decoded[0]
+	pkt := innerIP(t)
+	// truncate the TCP header
+	pkt = pkt[:len(pkt)-len("get foo\r\n")-10]
+	dp.decode(d, layers.LinkTypeRaw, gopacket.CaptureInfo{}, pkt)
+	dp.decode(d, layers.LinkTypeRaw, gopacket.CaptureInfo{}, pkt)
+	dp.decode(d, layers.LinkTypeTokenRing, gopacket.CaptureInfo{}, pkt)
+	if dp.IsTCP() {
+		t.Error("decoded packet from unsupported link type")
+	}
+	expected := map[string]int{
+		"TCP": 2,
+		unsupportedLinkType(layers.LinkTypeTokenRing): 1,
+	}
+	if len(d.failures) != len(expected) {
+		t.Error("got failures", d.failures, "expected", expected)
+	}
+	for layer, n := range expected {
+		if d.failures[layer] != n {
+			t.Error("got", d.failures[layer], "failures of", layer, "expected", n)
+		}
+	}
+}
+
+func TestDefragmentIPv4(t *testing.T) {
+	// the TCP header and payload, split after the TCP header
+	pkt := innerIP(t)
+	segment := pkt[20:]
+	fragments := [][]byte{
+		ipv4FragmentPacket(t, 0, true, segment[:24]),
+		ipv4FragmentPacket(t, 24, false, segment[24:]),
+	}
+	// deliver out of order
+	testDefragment(t, layers.LinkTypeRaw, [][]byte{fragments[1], fragments[0]})
+}
+
+func TestDefragmentIPv6(t *testing.T) {
+	pkt := innerIP(t)
+	segment := pkt[20:]
+	testDefragment(t, layers.LinkTypeRaw, [][]byte{
+		ipv6FragmentPacket(t, 0, true, segment[:16]),
+		ipv6FragmentPacket(t, 16, false, segment[16:]),
+	})
+}
+
+func testDefragment(t *testing.T, linkType layers.LinkType, fragments [][]byte) {
+	var handled []*DecodedPacket
+	d := newDecoder(testLogger{t}, func(dps []*DecodedPacket) {
+		handled = append(handled, dps...)
+	})
+	d.defrag = newDefragmenter(DefaultDefragMemory, DefaultDefragTimeout)
+	d.decodeBatch(packetBuffer(linkType, fragments...))
+	if len(handled) != 1 {
+		t.Fatal("got", len(handled), "packets, expected 1")
+	}
+	dp := handled[0]
+	if !dp.IsTCP() {
+		t.Fatal("not decoded as TCP:", dp.decoded)
+	}
+	if dp.TCP.DstPort != 11211 || string(dp.TCP.Payload) != "get foo\r\n" {
+		t.Error("got TCP", dp.TCP.SrcPort, "->", dp.TCP.DstPort, dp.TCP.Payload)
+	}
+	if dp.FlowHash == 0 {
+		t.Error("no flow hash for reassembled packet")
+	}
+	expected := DefragStats{Fragments: 2, Reassembled: 1}
+	if s := d.defrag.getStats(); s != expected {
+		t.Error("got stats", s, "expected", expected)
+	}
+	if d.defrag.used != 0 || len(d.defrag.datagrams) != 0 {
+		t.Error("fragments still held after reassembly")
+	}
+}
+
+func TestDefragmentLimits(t *testing.T) {
+	segment := innerIP(t)[20:]
+	first := ipv4FragmentPacket(t, 0, true, segment[:24])
+	d := newDecoder(testLogger{t}, func([]*DecodedPacket) {})
+	d.defrag = newDefragmenter(40, time.Second)
+
+	// the second datagram does not fit alongside the first
+	d.decodeBatch(packetBuffer(layers.LinkTypeRaw, first))
+	second := ipv4FragmentPacket(t, 0, true, segment[:24])
+	second[5] = 2 // different IP ID
+	d.decodeBatch(packetBuffer(layers.LinkTypeRaw, second))
+	if s := d.defrag.getStats(); s.Evicted != 1 || len(d.defrag.datagrams) != 1 {
+		t.Error("got stats", s, "with", len(d.defrag.datagrams), "datagrams held, expected 1 evicted")
+	}
+
+	// a fragment arriving after the timeout expires the rest
+	pb := capture.NewPacketBuffer(1, 65536)
+	pb.Append(capture.PacketData{Info: gopacket.CaptureInfo{Timestamp: time.Unix(10, 0)}, Data: first})
+	pb.LinkType = layers.LinkTypeRaw
+	d.decodeBatch(pb)
+	if s := d.defrag.getStats(); s.Expired != 1 || s.Reassembled != 0 {
+		t.Error("got stats", s, "expected 1 expired")
+	}
+}
+
+func TestDefragmentConflicting(t *testing.T) {
+	segment := innerIP(t)[20:]
+	for _, fragments := range [][][]byte{
+		// a last fragment ending before pieces already held
+		{
+			ipv4FragmentPacket(t, 8, true, segment[8:16]),
+			ipv4FragmentPacket(t, 16, true, segment[16:24]),
+			ipv4FragmentPacket(t, 8, false, segment[8:16]),
+		},
+		// last fragments giving different lengths
+		{
+			ipv4FragmentPacket(t, 16, false, segment[16:24]),
+			ipv4FragmentPacket(t, 8, false, segment[8:16]),
+		},
+		// a fragment ending past the last one
+		{
+			ipv4FragmentPacket(t, 8, false, segment[8:16]),
+			ipv4FragmentPacket(t, 8, true, segment[8:24]),
+		},
+	} {
+		var handled []*DecodedPacket
+		d := newDecoder(testLogger{t}, func(dps []*DecodedPacket) {
+			handled = append(handled, dps...)
+		})
+		d.defrag = newDefragmenter(DefaultDefragMemory, DefaultDefragTimeout)
+		d.decodeBatch(packetBuffer(layers.LinkTypeRaw, fragments...))
+		if len(handled) != 0 {
+			t.Error("reassembled", len(handled), "packets from conflicting fragments")
+		}
+		s := d.defrag.getStats()
+		if s.Evicted != len(fragments) || s.Reassembled != 0 {
+			t.Error("got stats", s, "expected", len(fragments), "evicted")
+		}
+		if d.defrag.used != 0 || len(d.defrag.datagrams) != 0 {
+			t.Error("fragments still held after conflict")
+		}
+	}
+}
+
+// ipv4FragmentPacket returns an IPv4 fragment of the memcached request in innerIP.
+func ipv4FragmentPacket(t *testing.T, offset int, more bool, data []byte) []byte {
+	ip := &layers.IPv4{
+		Version: 4, TTL: 64, Id: 1, Protocol: layers.IPProtocolTCP,
+		FragOffset: uint16(offset / 8), SrcIP: innerSrc, DstIP: innerDst,
+	}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	return serialize(t, ip, gopacket.Payload(data))
+}
+
+// ipv6FragmentPacket returns an IPv6 fragment of the memcached request in innerIP.
+func ipv6FragmentPacket(t *testing.T, offset int, more bool, data []byte) []byte {
+	ip := &layers.IPv6{
+		Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2"),
+	}
+	frag := []byte{byte(layers.IPProtocolTCP), 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(frag[2:], uint16(offset))
+	if more {
+		frag[3] |= 1
+	}
+	return serialize(t, ip, gopacket.Payload(append(frag, data...)))
+}
+
+func packetBuffer(linkType layers.LinkType, pkts ...[]byte) *capture.PacketBuffer {
+	pb := capture.NewPacketBuffer(len(pkts), 65536)
+	for _, pkt := range pkts {
+		pb.Append(capture.PacketData{
+			Info: gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(pkt)},
+			Data: pkt,
+		})
+	}
+	pb.LinkType = linkType
+	return pb
+}
+
+func TestDecodeUDP(t *testing.T) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: innerSrc, DstIP: innerDst}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 11211}
+	udp.SetNetworkLayerForChecksum(ip)
+	pkt := serialize(t, ip, udp, gopacket.Payload("\x00\x01\x00\x00\x00\x01\x00\x00get foo\r\n"))
+
+	d := newDecoder(testLogger{t}, nil)
+	dp := d.decoded[0]
+	dp.decode(d, layers.LinkTypeRaw, gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(pkt)}, pkt)
+	if !dp.IsUDP() || dp.IsTCP() {
+		t.Fatal("not decoded as UDP:", dp.decoded)
+	}
+	if dp.UDP.DstPort != 11211 || len(dp.UDP.Payload) != 17 {
+		t.Error("got UDP", dp.UDP.SrcPort, "->", dp.UDP.DstPort, dp.UDP.Payload)
+	}
+	if dp.FlowHash == 0 {
+		t.Error("no flow hash for UDP datagram")
+	}
+
+	// a VXLAN tunnel is not itself a UDP datagram to parse
+	vxlanHeader := []byte{0x08, 0, 0, 0, 0, 0, 0x01, 0}
+	pkt = outerFrame(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 50000, DstPort: 4789},
+		gopacket.Payload(append(vxlanHeader, innerFrame(t)...)))
+	dp.decode(d, layers.LinkTypeEthernet, gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(pkt)}, pkt)
+	if dp.IsUDP() || !dp.IsTCP() {
+		t.Error("tunneled TCP packet decoded as UDP:", dp.decoded)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: innerDst, DstIP: innerSrc}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+	for _, ip := range []gopacket.SerializableLayer{ip4, ip6} {
+		tcp := &layers.TCP{SrcPort: 11211, DstPort: 40000, Seq: 1, PSH: true, ACK: true, Window: 1024}
+		value := "VALUE foo 0 100\r\n" + strings.Repeat("x", 100) + "\r\nEND\r\n"
+		pkt := serialize(t, ip, tcp, gopacket.Payload(value))
+		// capture only the response line
+		captured := pkt[:len(pkt)-len(value)+17]
+
+		d := newDecoder(testLogger{t}, nil)
+		dp := d.decoded[0]
+		dp.decode(d, layers.LinkTypeRaw, gopacket.CaptureInfo{Length: len(pkt), CaptureLength: len(captured)}, captured)
+		if !dp.IsTCP() {
+			t.Fatal("not decoded as TCP:", dp.decoded)
+		}
+		if string(dp.TCP.Payload) != "VALUE foo 0 100\r\n" {
+			t.Error("got payload", string(dp.TCP.Payload))
+		}
+		if dp.Truncated != len(value)-17 || d.truncated != 1 {
+			t.Error("got", dp.Truncated, "bytes truncated from", d.truncated, "packets, expected", len(value)-17, "from 1")
+		}
+	}
+}
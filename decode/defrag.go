@@ -0,0 +1,309 @@
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultDefragMemory is the default limit on the memory used to hold
+	// fragments of incomplete IP datagrams.
+	DefaultDefragMemory = 4 * 1024 * 1024
+	// DefaultDefragTimeout is the default time, in capture time, to wait for
+	// the remaining fragments of an IP datagram.
+	DefaultDefragTimeout = 30 * time.Second
+
+	ipv6FragmentHeaderLen = 8
+	// largest possible reassembled IP payload
+	maxDatagramLen = 65535
+)
+
+var errTruncatedIPv6Fragment = errors.New("IPv6 fragment header truncated")
+
+// DefragStats counts IP fragments and the datagrams reassembled from them.
+type DefragStats struct {
+	// Fragments counts IP fragments received.
+	Fragments int
+	// Reassembled counts datagrams reassembled from fragments.
+	Reassembled int
+	// Expired counts fragments discarded because the rest of their datagram
+	// did not arrive in time.
+	Expired int
+	// Evicted counts fragments discarded to stay within the memory limit,
+	// or because they were invalid.
+	Evicted int
+}
+
+// ipv6Fragment decodes an IPv6 fragment header.  Unlike layers.IPv6Fragment
+// it can be used with a DecodingLayerParser.
+type ipv6Fragment struct {
+	layers.BaseLayer
+	NextHeader     layers.IPProtocol
+	FragmentOffset uint16
+	MoreFragments  bool
+	Identification uint32
+}
+
+func (f *ipv6Fragment) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIPv6Fragment
+}
+
+// NextLayerType returns the type of the payload, or LayerTypeFragment unless
+// this is an atomic fragment which holds the entire datagram.
+func (f *ipv6Fragment) NextLayerType() gopacket.LayerType {
+	if f.FragmentOffset != 0 || f.MoreFragments {
+		return gopacket.LayerTypeFragment
+	}
+	return f.NextHeader.LayerType()
+}
+
+func (f *ipv6Fragment) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < ipv6FragmentHeaderLen {
+		df.SetTruncated()
+		return errTruncatedIPv6Fragment
+	}
+	f.NextHeader = layers.IPProtocol(data[0])
+	f.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+	f.MoreFragments = data[3]&0x1 != 0
+	f.Identification = binary.BigEndian.Uint32(data[4:8])
+	f.BaseLayer = layers.BaseLayer{Contents: data[:ipv6FragmentHeaderLen], Payload: data[ipv6FragmentHeaderLen:]}
+	return nil
+}
+
+// fragmentKey identifies the datagram that an IP fragment belongs to.
+type fragmentKey struct {
+	netFlow gopacket.Flow
+	id      uint32
+	// always zero for IPv6, where only the first fragment gives the
+	// protocol
+	protocol layers.IPProtocol
+}
+
+// fragmentInfo describes an IP fragment.
+type fragmentInfo struct {
+	key fragmentKey
+	// offset of data within the datagram payload
+	offset int
+	// false for the last fragment
+	more bool
+	// type of the datagram payload, valid in the first fragment
+	next gopacket.LayerType
+	// the fragment payload, or nil if the packet is not a fragment
+	data []byte
+}
+
+// datagram collects the fragments of a single IP datagram.
+type datagram struct {
+	key fragmentKey
+	// capture time of the first fragment received
+	started time.Time
+	pieces  []fragmentPiece
+	// length of the payload, known once the last fragment arrives
+	length int
+	// end of the furthest piece held
+	end  int
+	next gopacket.LayerType
+	// bytes held in pieces
+	size int
+}
+
+type fragmentPiece struct {
+	offset int
+	data   []byte
+}
+
+// defragmenter reassembles IP datagrams from their fragments.  It is shared
+// by all decoders, since the fragments of a datagram may be decoded by
+// different workers.
+type defragmenter struct {
+	mu        sync.Mutex
+	maxMemory int
+	timeout   time.Duration
+	datagrams map[fragmentKey]*datagram
+	// incomplete datagrams in the order they were started
+	order []*datagram
+	// bytes held by all datagrams
+	used  int
+	stats DefragStats
+}
+
+func newDefragmenter(maxMemory int, timeout time.Duration) *defragmenter {
+	return &defragmenter{
+		maxMemory: maxMemory,
+		timeout:   timeout,
+		datagrams: make(map[fragmentKey]*datagram),
+	}
+}
+
+// setLimits changes the memory and time limits for incomplete datagrams.
+func (df *defragmenter) setLimits(maxMemory int, timeout time.Duration) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.maxMemory = maxMemory
+	df.timeout = timeout
+}
+
+func (df *defragmenter) getStats() DefragStats {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	return df.stats
+}
+
+// defragment returns dps without any IP fragments, except that the fragment
+// completing a datagram is replaced by the reassembled datagram.  dps is not
+// modified.
+func (df *defragmenter) defragment(d *decoder, dps []*DecodedPacket) []*DecodedPacket {
+	var out []*DecodedPacket
+	for i, dp := range dps {
+		if dp.fragment.data == nil {
+			if out != nil {
+				out = append(out, dp)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]*DecodedPacket, i, len(dps))
+			copy(out, dps[:i])
+		}
+		if payload, next := df.add(dp); payload != nil {
+			dp.decodeReassembled(d, next, payload)
+			out = append(out, dp)
+		}
+	}
+	if out == nil {
+		return dps
+	}
+	return out
+}
+
+// add adds the fragment in dp to its datagram, returning the payload and its
+// type once the datagram is complete.
+func (df *defragmenter) add(dp *DecodedPacket) ([]byte, gopacket.LayerType) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.stats.Fragments++
+	df.expire(dp.Info.Timestamp)
+
+	f := &dp.fragment
+	end := f.offset + len(f.data)
+	if end > maxDatagramLen || len(f.data) > df.maxMemory {
+		df.stats.Evicted++
+		return nil, 0
+	}
+	for df.used+len(f.data) > df.maxMemory && len(df.order) > 0 {
+		df.evict(df.order[0])
+	}
+
+	dg, ok := df.datagrams[f.key]
+	if !ok {
+		dg = &datagram{key: f.key, started: dp.Info.Timestamp, length: -1}
+		df.datagrams[f.key] = dg
+		df.order = append(df.order, dg)
+	}
+	if dg.conflicts(f, end) {
+		// the fragment cannot be part of the same datagram as those held,
+		// so none of them can be trusted
+		df.stats.Evicted++
+		df.evict(dg)
+		return nil, 0
+	}
+	// copy the data, which belongs to the capture buffer
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+	dg.pieces = append(dg.pieces, fragmentPiece{f.offset, data})
+	dg.size += len(data)
+	df.used += len(data)
+	if end > dg.end {
+		dg.end = end
+	}
+	if f.offset == 0 {
+		dg.next = f.next
+	}
+	if !f.more {
+		dg.length = end
+	}
+
+	payload := dg.reassemble()
+	if payload != nil {
+		df.remove(dg)
+		df.stats.Reassembled++
+	}
+	return payload, dg.next
+}
+
+// conflicts returns true if fragment f, ending at end, disagrees with the
+// length of dg given by its last fragment, or is a last fragment ending before
+// pieces already held.
+func (dg *datagram) conflicts(f *fragmentInfo, end int) bool {
+	if dg.length >= 0 && (end > dg.length || !f.more && end != dg.length) {
+		return true
+	}
+	return !f.more && end < dg.end
+}
+
+// reassemble returns the payload of dg, or nil if fragments are missing.
+func (dg *datagram) reassemble() []byte {
+	if dg.length < 0 {
+		return nil
+	}
+	sort.Slice(dg.pieces, func(i, j int) bool {
+		return dg.pieces[i].offset < dg.pieces[j].offset
+	})
+	covered := 0
+	for _, p := range dg.pieces {
+		if p.offset > covered {
+			return nil
+		}
+		if end := p.offset + len(p.data); end > covered {
+			covered = end
+		}
+	}
+	if covered < dg.length {
+		return nil
+	}
+	payload := make([]byte, dg.length)
+	for _, p := range dg.pieces {
+		copy(payload[p.offset:], p.data)
+	}
+	return payload
+}
+
+// expire discards datagrams started more than the timeout before now.
+func (df *defragmenter) expire(now time.Time) {
+	for len(df.order) > 0 && now.Sub(df.order[0].started) > df.timeout {
+		dg := df.order[0]
+		df.stats.Expired += len(dg.pieces)
+		df.remove(dg)
+	}
+}
+
+// evict discards an incomplete datagram to make room for others.
+func (df *defragmenter) evict(dg *datagram) {
+	df.stats.Evicted += len(dg.pieces)
+	df.remove(dg)
+}
+
+func (df *defragmenter) remove(dg *datagram) {
+	delete(df.datagrams, dg.key)
+	for i, o := range df.order {
+		if o == dg {
+			df.order = append(df.order[:i], df.order[i+1:]...)
+			break
+		}
+	}
+	df.used -= dg.size
+}
+
+// decodeReassembled replaces the fragment in dp with the reassembled datagram
+// payload, whose first layer is next.
+func (dp *DecodedPacket) decodeReassembled(d *decoder, next gopacket.LayerType, payload []byte) {
+	dp.fragment = fragmentInfo{}
+	dp.decoded = dp.decoded[:0]
+	dp.decodeLayers(d, next, payload)
+}
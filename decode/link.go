@@ -0,0 +1,119 @@
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const sll2HeaderLen = 20
+
+var (
+	errTruncatedSLL2  = errors.New("Linux SLL2 header truncated")
+	errTruncatedRawIP = errors.New("empty raw IP packet")
+)
+
+// layerTypeLinuxSLL2 is the layer type of version 2 Linux cooked capture
+// headers, which gopacket does not know about.
+var layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1200, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// linuxSLL2 is a version 2 Linux cooked capture header, as captured from the
+// any pseudo-interface by libpcap 1.10 and later.  Unlike version 1, it
+// records the interface each packet was captured on.
+type linuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	ARPHardware    uint16
+	PacketType     layers.LinuxSLLPacketType
+	Addr           net.HardwareAddr
+}
+
+func (sll *linuxSLL2) LayerType() gopacket.LayerType {
+	return layerTypeLinuxSLL2
+}
+
+func (sll *linuxSLL2) CanDecode() gopacket.LayerClass {
+	return layerTypeLinuxSLL2
+}
+
+func (sll *linuxSLL2) NextLayerType() gopacket.LayerType {
+	return sll.EthernetType.LayerType()
+}
+
+func (sll *linuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < sll2HeaderLen {
+		df.SetTruncated()
+		return errTruncatedSLL2
+	}
+	sll.EthernetType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.ARPHardware = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	addrLen := int(data[11])
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	sll.Addr = net.HardwareAddr(data[12 : 12+addrLen])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:sll2HeaderLen], Payload: data[sll2HeaderLen:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &linuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
+
+// layerTypeRawIP is the layer type of the empty link layer header of raw IP
+// captures, such as those from tunnel interfaces.
+var layerTypeRawIP = gopacket.RegisterLayerType(1201, gopacket.LayerTypeMetadata{
+	Name:    "RawIP",
+	Decoder: gopacket.DecodeFunc(decodeRawIP),
+})
+
+// rawIP is the empty link layer of a raw IP capture, which lets the parser
+// choose between IPv4 and IPv6 by the version of each packet.
+type rawIP struct {
+	layers.BaseLayer
+	next gopacket.LayerType
+}
+
+func (r *rawIP) LayerType() gopacket.LayerType {
+	return layerTypeRawIP
+}
+
+func (r *rawIP) CanDecode() gopacket.LayerClass {
+	return layerTypeRawIP
+}
+
+func (r *rawIP) NextLayerType() gopacket.LayerType {
+	return r.next
+}
+
+func (r *rawIP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) == 0 {
+		df.SetTruncated()
+		return errTruncatedRawIP
+	}
+	r.next = ipLayerType(data[0])
+	r.BaseLayer = layers.BaseLayer{Contents: data[:0], Payload: data}
+	return nil
+}
+
+func decodeRawIP(data []byte, p gopacket.PacketBuilder) error {
+	r := &rawIP{}
+	if err := r.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	return p.NextDecoder(r.next)
+}
@@ -3,6 +3,7 @@ package decode
 
 import (
 	"io"
+	"sync"
 	"time"
 
 	"github.com/box/memsniff/capture"
@@ -12,10 +13,26 @@ import (
 
 type workerQueue chan *worker
 
+const (
+	// most packets, and bytes of packet data, decoded by a worker at once
+	workerBatchSize  = 1000
+	workerBatchBytes = 8 * 1024 * 1024
+)
+
 // Stats contains runtime performance statistics for a Pool.
 type Stats struct {
 	PacketsCaptured int
 	PacketsDropped  int
+	// Encapsulated counts packets decoded from inside tunnels.
+	Encapsulated EncapsulationStats
+	// DecodeFailures counts packets that could not be fully decoded, by the
+	// name of the layer that failed.
+	DecodeFailures map[string]int
+	// Defrag counts IP fragments and the datagrams reassembled from them.
+	Defrag DefragStats
+	// PacketsTruncated counts TCP packets whose payload was cut short by
+	// the capture's snap length.
+	PacketsTruncated int
 }
 
 // Pool is a set of workers for decoding network packets.  It is bound to a
@@ -26,7 +43,9 @@ type Pool struct {
 	numWorkers int
 	src        capture.PacketSource
 	readyQ     workerQueue
+	statsLock  sync.Mutex
 	stats      Stats
+	defrag     *defragmenter
 }
 
 // NewPool creates a new Pool of workers.  As packets are captured and decoded,
@@ -38,37 +57,74 @@ func NewPool(logger log.Logger, numWorkers int, src capture.PacketSource, handle
 		numWorkers: numWorkers,
 		src:        src,
 		readyQ:     make(workerQueue, numWorkers),
+		defrag:     newDefragmenter(DefaultDefragMemory, DefaultDefragTimeout),
 	}
 
 	for i := 0; i < numWorkers; i++ {
 		decoder := newDecoder(logger, handler)
-		p.startWorker(p.readyQ, decoder.decodeBatch, 1000, 8*1024*1024, i)
+		decoder.report = p.addDecodeStats
+		decoder.defrag = p.defrag
+		p.startWorker(p.readyQ, decoder.decodeBatch, workerBatchSize, workerBatchBytes, i)
 	}
 
 	return p
 }
 
+// SetDefragLimits sets the memory in bytes that may be used to hold the
+// fragments of incomplete IP datagrams, and how long in capture time to wait
+// for the rest of a datagram before discarding its fragments.  The oldest
+// incomplete datagrams are discarded first when memory runs out.
+func (p *Pool) SetDefragLimits(maxMemory int, timeout time.Duration) {
+	p.defrag.setLimits(maxMemory, timeout)
+}
+
 // Run starts the Pool decoding packets from the configured PacketSource and
 // sending the results to the PacketHandler.
 //
+// If the PacketSource is a capture.ParallelSource, each of its sources is
+// read on a separate goroutine into a buffer of its own, which is exchanged
+// for the empty buffer of a ready worker once filled.  Sources waiting for
+// packets thus do not hold workers that busier sources could use.
+//
 // Packets are dropped if they arrive more rapidly than the Pool can handle
 // them.
 func (p *Pool) Run() {
+	if ps, ok := p.src.(capture.ParallelSource); ok {
+		var wg sync.WaitGroup
+		for _, src := range ps.Sources() {
+			wg.Add(1)
+			go func(src capture.PacketSource) {
+				defer wg.Done()
+				p.collectParallel(src)
+			}(src)
+		}
+		wg.Wait()
+	} else {
+		p.collect(p.src)
+	}
+
+	p.logger.Log("Reached EOF, waiting for workers to finish")
+	for i := 0; i < p.numWorkers; i++ {
+		(<-p.readyQ).close()
+	}
+	p.logger.Log("Decoder exiting")
+}
+
+// collect hands packets from src to workers as they become ready, until src
+// reaches EOF.
+func (p *Pool) collect(src capture.PacketSource) {
 	for {
 		select {
 		case nextWorker := <-p.readyQ:
-			err := p.sendToWorker(nextWorker)
+			err := p.sendToWorker(src, nextWorker)
 			if err == io.EOF {
-				p.logger.Log("Reached EOF, waiting for workers to finish")
-				nextWorker.close()
-				for i := 1; i < p.numWorkers; i++ {
-					(<-p.readyQ).close()
-				}
-				p.logger.Log("Decoder exiting")
+				// return the worker to the queue so it can be shut down
+				nextWorker.buf().Clear()
+				nextWorker.work()
 				return
 			}
 		default:
-			err := p.src.DiscardPacket()
+			err := src.DiscardPacket()
 			if err == pcap.NextErrorTimeoutExpired {
 				// loop again
 			} else if err == io.EOF {
@@ -76,7 +132,9 @@ func (p *Pool) Run() {
 				// shut them down and avoid a busy-wait loop.
 				time.Sleep(10 * time.Millisecond)
 			} else if err == nil {
+				p.statsLock.Lock()
 				p.stats.PacketsDropped++
+				p.statsLock.Unlock()
 			} else {
 				p.logger.Log("Error from DiscardPacket", err)
 			}
@@ -84,19 +142,79 @@ func (p *Pool) Run() {
 	}
 }
 
+// collectParallel hands batches of packets from src to workers as they are
+// collected, until src reaches EOF.  Batches collected while no worker is
+// ready are dropped.
+func (p *Pool) collectParallel(src capture.PacketSource) {
+	pb := capture.NewPacketBuffer(workerBatchSize, workerBatchBytes)
+	for {
+		err := src.CollectPackets(pb)
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.logger.Log("Error from CollectPackets", err)
+			continue
+		}
+		pb.LinkType = src.LinkType()
+		n := pb.PacketLen()
+		select {
+		case w := <-p.readyQ:
+			// the worker decodes the filled buffer while its empty one is
+			// filled next
+			pb, w.pb = w.pb, pb
+			w.work()
+			p.statsLock.Lock()
+			p.stats.PacketsCaptured += n
+			p.statsLock.Unlock()
+		default:
+			p.statsLock.Lock()
+			p.stats.PacketsDropped += n
+			p.statsLock.Unlock()
+		}
+	}
+}
+
 // Stats returns runtime statistics for a Pool.
 func (p *Pool) Stats() Stats {
-	return p.stats
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	s := p.stats
+	s.DecodeFailures = make(map[string]int, len(p.stats.DecodeFailures))
+	for layer, n := range p.stats.DecodeFailures {
+		s.DecodeFailures[layer] = n
+	}
+	s.Defrag = p.defrag.getStats()
+	return s
+}
+
+func (p *Pool) addDecodeStats(encapsulated EncapsulationStats, failures map[string]int, truncated int) {
+	p.statsLock.Lock()
+	p.stats.Encapsulated.add(encapsulated)
+	p.stats.PacketsTruncated += truncated
+	for layer, n := range failures {
+		if p.stats.DecodeFailures == nil {
+			p.stats.DecodeFailures = make(map[string]int)
+		}
+		p.stats.DecodeFailures[layer] += n
+	}
+	p.statsLock.Unlock()
 }
 
-func (p *Pool) sendToWorker(w *worker) error {
+func (p *Pool) sendToWorker(src capture.PacketSource, w *worker) error {
 	var err error
 	for {
 		// write packet data directly into the worker's working area
 		// to avoid an extra copy
-		err = p.src.CollectPackets(w.buf())
+		err = src.CollectPackets(w.buf())
 		if err != pcap.NextErrorTimeoutExpired {
+			w.buf().LinkType = src.LinkType()
+			p.statsLock.Lock()
 			p.stats.PacketsCaptured += w.buf().PacketLen()
+			p.statsLock.Unlock()
 			break
 		}
 	}
@@ -105,6 +223,13 @@ func (p *Pool) sendToWorker(w *worker) error {
 	}
 	if err != nil {
 		p.logger.Log("Error from CollectPackets", err)
+		// return the worker to the queue without work so it is not lost,
+		// dropping anything collected before the error
+		p.statsLock.Lock()
+		p.stats.PacketsDropped += w.buf().PacketLen()
+		p.statsLock.Unlock()
+		w.buf().Clear()
+		w.work()
 		return err
 	}
 	// tell worker how much of its working area contains valid new packets
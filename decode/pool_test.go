@@ -2,6 +2,7 @@ package decode
 
 import (
 	"github.com/box/memsniff/capture"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"io"
 	"runtime"
@@ -59,6 +60,10 @@ func (es emptySource) DiscardPacket() error {
 	return nil
 }
 
+func (es emptySource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
 func (es emptySource) Stats() (*pcap.Stats, error) {
 	return &pcap.Stats{}, nil
 }
@@ -82,3 +87,97 @@ func TestGoroutineCount(t *testing.T) {
 		t.Error("Pool left behind", afterRun-before, "goroutines")
 	}
 }
+
+// parallelSource is a capture.ParallelSource made of several emptySources.
+type parallelSource struct {
+	emptySource
+	n int
+}
+
+func (ps parallelSource) Sources() []capture.PacketSource {
+	sources := make([]capture.PacketSource, ps.n)
+	for i := range sources {
+		sources[i] = emptySource{}
+	}
+	return sources
+}
+
+// TestParallelSourceShutdown checks that Pool reads each source of a
+// ParallelSource and shuts down its workers once all of them reach EOF.
+func TestParallelSourceShutdown(t *testing.T) {
+	workers := 2
+	before := runtime.NumGoroutine()
+	p := NewPool(testLogger{t}, workers, parallelSource{n: 3}, nil)
+
+	p.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	afterRun := runtime.NumGoroutine()
+	if afterRun != before {
+		t.Error("Pool left behind", afterRun-before, "goroutines")
+	}
+}
+
+// idleSource is a capture.PacketSource that times out until done is closed.
+type idleSource struct {
+	emptySource
+	done chan struct{}
+}
+
+func (is idleSource) CollectPackets(pb *capture.PacketBuffer) error {
+	select {
+	case <-is.done:
+		return io.EOF
+	case <-time.After(time.Millisecond):
+		return pcap.NextErrorTimeoutExpired
+	}
+}
+
+// busySource is a capture.PacketSource that returns batches packets, one
+// at a time, then closes done.
+type busySource struct {
+	emptySource
+	batches *int
+	done    chan struct{}
+}
+
+func (bs busySource) CollectPackets(pb *capture.PacketBuffer) error {
+	if *bs.batches == 0 {
+		close(bs.done)
+		return io.EOF
+	}
+	*bs.batches--
+	// leave time for the previous batch to be decoded
+	time.Sleep(5 * time.Millisecond)
+	pb.Clear()
+	return pb.Append(capture.PacketData{})
+}
+
+// mixedSource is a capture.ParallelSource with a single busy source and
+// more idle sources than there are workers.
+type mixedSource struct {
+	emptySource
+	sources []capture.PacketSource
+}
+
+func (ms mixedSource) Sources() []capture.PacketSource {
+	return ms.sources
+}
+
+// TestIdleSources checks that sources waiting for packets do not keep
+// workers from a busy source.
+func TestIdleSources(t *testing.T) {
+	done := make(chan struct{})
+	batches := 20
+	src := mixedSource{sources: []capture.PacketSource{busySource{batches: &batches, done: done}}}
+	for i := 0; i < 4; i++ {
+		src.sources = append(src.sources, idleSource{done: done})
+	}
+	p := NewPool(testLogger{t}, 2, src, func([]*DecodedPacket) {})
+	p.Run()
+	// let the workers exit before other tests count goroutines
+	defer time.Sleep(100 * time.Millisecond)
+	if s := p.Stats(); s.PacketsCaptured != 20 || s.PacketsDropped != 0 {
+		t.Error("captured", s.PacketsCaptured, "packets and dropped", s.PacketsDropped, "expected 20 captured")
+	}
+}
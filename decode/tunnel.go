@@ -0,0 +1,188 @@
+package decode
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// GRE protocol types used by ERSPAN, which gopacket does not know about.
+const (
+	// ERSPAN types I and II
+	ethernetTypeERSPAN  layers.EthernetType = 0x88be
+	ethernetTypeERSPAN3 layers.EthernetType = 0x22eb
+)
+
+const (
+	vxlanHeaderLen      = 8
+	erspan2HeaderLen    = 8
+	erspan3HeaderLen    = 12
+	erspan3PlatformLen  = 8
+	erspanFrameEthernet = 0
+	mplsLabelLen        = 4
+	mplsPseudowireCWLen = 4
+)
+
+var (
+	errTruncatedVXLAN  = errors.New("VXLAN header truncated")
+	errTruncatedERSPAN = errors.New("ERSPAN header truncated")
+	errTruncatedMPLS   = errors.New("MPLS label stack truncated")
+)
+
+// EncapsulationStats counts packets decoded from inside each kind of tunnel.
+// A packet inside nested tunnels is counted once for each of them.
+type EncapsulationStats struct {
+	VXLAN int
+	// GRE counts packets in GRE tunnels other than ERSPAN.
+	GRE    int
+	ERSPAN int
+	MPLS   int
+}
+
+func (s *EncapsulationStats) add(o EncapsulationStats) {
+	s.VXLAN += o.VXLAN
+	s.GRE += o.GRE
+	s.ERSPAN += o.ERSPAN
+	s.MPLS += o.MPLS
+}
+
+// vxlan decodes the VXLAN header of an Ethernet frame tunneled over UDP.
+type vxlan struct {
+	layers.BaseLayer
+}
+
+func (v *vxlan) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeVXLAN
+}
+
+func (v *vxlan) NextLayerType() gopacket.LayerType {
+	return layers.LayerTypeEthernet
+}
+
+func (v *vxlan) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < vxlanHeaderLen {
+		df.SetTruncated()
+		return errTruncatedVXLAN
+	}
+	v.BaseLayer = layers.BaseLayer{Contents: data[:vxlanHeaderLen], Payload: data[vxlanHeaderLen:]}
+	return nil
+}
+
+// gre decodes a GRE header, along with the ERSPAN header that follows it
+// when the tunnel carries mirrored traffic.
+type gre struct {
+	layers.GRE
+	// whether the tunnel carries ERSPAN
+	erspan bool
+	next   gopacket.LayerType
+}
+
+func (g *gre) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := g.GRE.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	g.erspan = false
+	g.next = g.GRE.NextLayerType()
+	switch g.Protocol {
+	case ethernetTypeERSPAN:
+		g.erspan = true
+		g.next = layers.LayerTypeEthernet
+		// type I has no header of its own, and is told apart from type II
+		// by the absence of a GRE sequence number
+		if g.SeqPresent {
+			return g.skipERSPAN(erspan2HeaderLen, df)
+		}
+	case ethernetTypeERSPAN3:
+		g.erspan = true
+		payload := g.Payload
+		if len(payload) < erspan3HeaderLen {
+			df.SetTruncated()
+			return errTruncatedERSPAN
+		}
+		hdrLen := erspan3HeaderLen
+		if payload[11]&0x01 != 0 {
+			// optional platform specific subheader
+			hdrLen += erspan3PlatformLen
+		}
+		if frameType := (payload[10] >> 2) & 0x1f; frameType == erspanFrameEthernet {
+			g.next = layers.LayerTypeEthernet
+		} else if len(payload) > hdrLen {
+			g.next = ipLayerType(payload[hdrLen])
+		}
+		return g.skipERSPAN(hdrLen, df)
+	}
+	return nil
+}
+
+// skipERSPAN moves an ERSPAN header of length n from the GRE payload to its
+// contents.
+func (g *gre) skipERSPAN(n int, df gopacket.DecodeFeedback) error {
+	if len(g.Payload) < n {
+		df.SetTruncated()
+		return errTruncatedERSPAN
+	}
+	g.Contents = g.Contents[:len(g.Contents)+n]
+	g.Payload = g.Payload[n:]
+	return nil
+}
+
+func (g *gre) NextLayerType() gopacket.LayerType {
+	return g.next
+}
+
+// mpls decodes an MPLS label stack.  MPLS does not identify the protocol it
+// carries, so we guess from the first byte after the stack as routers do.
+type mpls struct {
+	layers.BaseLayer
+	next gopacket.LayerType
+}
+
+func (m *mpls) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (m *mpls) NextLayerType() gopacket.LayerType {
+	return m.next
+}
+
+func (m *mpls) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	n := 0
+	for {
+		if len(data) < n+mplsLabelLen {
+			df.SetTruncated()
+			return errTruncatedMPLS
+		}
+		bottom := data[n+2]&0x01 != 0
+		n += mplsLabelLen
+		if bottom {
+			break
+		}
+	}
+	m.next = layers.LayerTypeEthernet
+	if len(data) > n {
+		switch data[n] >> 4 {
+		case 4, 6:
+			m.next = ipLayerType(data[n])
+		case 0:
+			// Ethernet pseudowire control word
+			if len(data) >= n+mplsPseudowireCWLen {
+				n += mplsPseudowireCWLen
+			}
+		}
+	}
+	m.BaseLayer = layers.BaseLayer{Contents: data[:n], Payload: data[n:]}
+	return nil
+}
+
+// ipLayerType returns the IP layer type given by the version in the first
+// byte of an IP header.
+func ipLayerType(b byte) gopacket.LayerType {
+	switch b >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
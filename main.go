@@ -3,13 +3,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"sort"
 	"time"
 
 	"github.com/box/memsniff/analysis"
 	"github.com/box/memsniff/assembly"
+	"github.com/box/memsniff/assembly/reader"
 	"github.com/box/memsniff/capture"
 	"github.com/box/memsniff/decode"
 	"github.com/box/memsniff/log"
@@ -18,12 +23,24 @@ import (
 )
 
 var (
-	netInterface = flag.StringP("interface", "i", "", "network interface to sniff")
-	infile       = flag.StringP("read", "r", "", "file to read (- for stdin)")
-	bufferSize   = flag.IntP("buffersize", "b", 8, "MiB of kernel buffer for packet data")
-	ports        = flag.IntSliceP("ports", "p", []int{11211}, "memcached ports to listen on")
+	netInterfaces = flag.StringSliceP("interface", "i", []string{}, "network interfaces to sniff (repeat or separate with commas for several)")
+	infile        = flag.StringP("read", "r", "", "file, directory or glob of rotated files to read (- for stdin)")
+	bufferSize    = flag.IntP("buffersize", "b", 8, "MiB of kernel buffer for packet data")
+	ports         = flag.IntSliceP("ports", "p", []int{11211}, "memcached ports to listen on")
+	servers       = flag.StringSliceP("servers", "s", []string{}, "IP addresses or CIDR networks of memcached servers")
+	bpfFilter     = flag.String("bpf", "", "additional BPF expression that captured packets must match")
+	decap         = flag.Bool("decap", false, "also capture VXLAN, GRE, ERSPAN and MPLS tunnels and decode the traffic inside them")
+	fragMemory    = flag.Int("fragmentmemory", 4, "MiB of memory for holding fragments of incomplete IP datagrams")
+	fragTimeout   = flag.Int("fragmenttimeout", 30, "seconds to wait for the remaining fragments of an IP datagram")
+	afPacket      = flag.Bool("afpacket", false, "capture using memory-mapped AF_PACKET sockets instead of libpcap (Linux only)")
+	fanout        = flag.Int("fanout", 4, "number of AF_PACKET sockets per interface when using --afpacket")
+	snapLen       = flag.Int("snaplen", 0, "bytes to capture from the start of each packet, at least 256 (0 for whole packets)")
 
 	assemblyWorkers = flag.Int("assemblyworkers", 8, "number of TCP assembly workers")
+	reorderPackets  = flag.Int("reorderpackets", assembly.DefaultBuffering.ReorderPackets, "out-of-order packets to buffer per connection while waiting for a missing one")
+	assemblyMemory  = flag.Int("assemblymemory", assembly.DefaultBuffering.MaxMemory/1024/1024, "MiB of memory for buffering out-of-order packets across all connections")
+	bufferMemory    = flag.Int("buffermemory", reader.DefaultMemoryBudget/1024/1024, "MiB of memory for buffering connections' data beyond 32 KiB each, such as pipelined requests")
+	idleTimeout     = flag.Int("idletimeout", int(assembly.DefaultBuffering.IdleTimeout/time.Second), "seconds without packets before a connection is forgotten")
 	decodeWorkers   = flag.Int("decodeworkers", 8, "number of decode workers")
 	analysisWorkers = flag.Int("analysisworkers", 32, "number of analysis workers")
 	profiles        = flag.StringSlice("profile", []string{}, "profile types to store (one or more of cpu, heap, block)")
@@ -33,8 +50,19 @@ var (
 	interval   = flag.IntP("interval", "n", 1, "report top keys every this many seconds")
 	cumulative = flag.Bool("cumulative", false, "accumulate keys over all time instead of an interval")
 
-	noDelay = flag.Bool("nodelay", false, "replay from file at maximum speed instead of rate of original capture")
-	noGui   = flag.Bool("nogui", false, "disable interactive interface")
+	slabMinSpace     = flag.Int("slabminspace", analysis.DefaultSlabConfig.MinSpace, "smallest space for an item's key, value and flags, as set by memcached's -n")
+	slabFactor       = flag.Float64("slabfactor", analysis.DefaultSlabConfig.Factor, "growth factor of slab chunk sizes, as set by memcached's -f")
+	slabItemOverhead = flag.Int("itemoverhead", analysis.DefaultSlabConfig.ItemOverhead, "bytes of memcached's header for each item")
+	slabLargestChunk = flag.Int("slabchunkmax", analysis.DefaultSlabConfig.LargestChunk, "bytes in the chunks of memcached's largest slab class")
+
+	noDelay    = flag.Bool("nodelay", false, "replay from file at maximum speed instead of rate of original capture")
+	speed      = flag.Float64("speed", 1, "replay from file at this multiple of the original capture rate (0.1 to 100)")
+	replayFrom = flag.String("start", "", "replay from file starting at this offset (e.g. 5m30s) or RFC 3339 timestamp")
+	replayTo   = flag.String("end", "", "stop replaying from file at this offset (e.g. 10m) or RFC 3339 timestamp")
+	follow     = flag.Bool("follow", false, "keep reading from file as it grows, and from new files matching --read as they appear")
+	seekStep   = flag.Int("seekstep", 10, "seconds to skip forward or backward with the arrow keys when replaying from file")
+	noGui      = flag.Bool("nogui", false, "disable interactive interface")
+	jsonOut    = flag.String("json", "", "with --nogui, append a JSON report every interval to this file (- for stdout)")
 
 	displayVersion = flag.Bool("version", false, "display version information")
 )
@@ -55,39 +83,121 @@ func main() {
 	buffered := &log.BufferLogger{}
 	logger.SetLogger(buffered)
 
-	analysisPool := analysis.New(*analysisWorkers, *reportSize)
+	reportOut, err := openReportOut(*jsonOut)
+	if err != nil {
+		(&log.ConsoleLogger{}).Log(err)
+		os.Exit(1)
+	}
+	if reportOut != nil {
+		defer reportOut.Close()
+	}
+
+	analysisPool := analysis.New(*analysisWorkers, *reportSize, *netInterfaces)
 	if err := analysisPool.SetFilterPattern(*filter); err != nil {
 		(&log.ConsoleLogger{}).Log(err)
 		os.Exit(1)
 	}
+	err = analysisPool.SetSlabConfig(analysis.SlabConfig{
+		MinSpace:     *slabMinSpace,
+		Factor:       *slabFactor,
+		ItemOverhead: *slabItemOverhead,
+		LargestChunk: *slabLargestChunk,
+	})
+	if err != nil {
+		(&log.ConsoleLogger{}).Log(err)
+		os.Exit(1)
+	}
+
+	serverNets, err := capture.ParseServers(*servers)
+	if err != nil {
+		(&log.ConsoleLogger{}).Log(err)
+		os.Exit(1)
+	}
 
-	packetSource, err := capture.New(*netInterface, *infile, *bufferSize, *noDelay, *ports)
+	start, err := capture.ParseTimeBound(*replayFrom)
+	if err != nil {
+		(&log.ConsoleLogger{}).Log(err)
+		os.Exit(1)
+	}
+	end, err := capture.ParseTimeBound(*replayTo)
+	if err != nil {
+		(&log.ConsoleLogger{}).Log(err)
+		os.Exit(1)
+	}
+	var replaySpeed float64
+	if flag.CommandLine.Changed("speed") {
+		replaySpeed = *speed
+	}
+
+	packetSource, err := capture.New(capture.Config{
+		Interfaces:  *netInterfaces,
+		InFile:      *infile,
+		Follow:      *follow,
+		BufferSize:  *bufferSize,
+		NoDelay:     *noDelay,
+		Speed:       replaySpeed,
+		Start:       start,
+		End:         end,
+		Ports:       *ports,
+		Servers:     serverNets,
+		Filter:      *bpfFilter,
+		Decapsulate: *decap,
+		AFPacket:    *afPacket,
+		Fanout:      *fanout,
+		SnapLen:     *snapLen,
+		Logger:      logger,
+	})
 	if err != nil {
 		(&log.ConsoleLogger{}).Log(err)
 		os.Exit(2)
 	}
 
-	decodePool := decode.NewPool(logger, *decodeWorkers, packetSource, packetHandler(analysisPool))
+	assemblyPool := assembly.New(logger, analysisPool, *ports, serverNets, assembly.Buffering{
+		ReorderPackets: *reorderPackets,
+		MaxMemory:      *assemblyMemory * 1024 * 1024,
+		IdleTimeout:    time.Duration(*idleTimeout) * time.Second,
+	}, *assemblyWorkers)
+	reader.SetMemoryBudget(*bufferMemory * 1024 * 1024)
+	decodePool := decode.NewPool(logger, *decodeWorkers, packetSource, assemblyPool.HandlePackets)
+	decodePool.SetDefragLimits(*fragMemory*1024*1024, time.Duration(*fragTimeout)*time.Second)
 	eofChan := make(chan struct{}, 1)
 	go func() {
 		decodePool.Run()
 		eofChan <- struct{}{}
 	}()
 
+	updateInterval := time.Duration(*interval) * time.Second
+	statProvider := statGenerator(packetSource, decodePool, assemblyPool, analysisPool)
 	if *noGui {
 		logger.SetLogger(log.ConsoleLogger{})
 		buffered.WriteTo(logger)
 
 		exitChan := make(chan os.Signal, 1)
 		signal.Notify(exitChan, os.Interrupt)
-		select {
-		case <-exitChan:
-		case <-eofChan:
+		ticker := time.NewTicker(updateInterval)
+	loop:
+		for {
+			select {
+			case <-exitChan:
+				break loop
+			case <-eofChan:
+				break loop
+			case <-ticker.C:
+				logChurn(statProvider().Churn)
+				if reportOut != nil {
+					writeReport(reportOut, analysisPool.Report(!*cumulative))
+				}
+			}
 		}
+		ticker.Stop()
 	} else {
-		updateInterval := time.Duration(*interval) * time.Second
-		statProvider := statGenerator(packetSource, decodePool, analysisPool)
-		cui := presentation.New(analysisPool, updateInterval, *cumulative, statProvider)
+		var replay presentation.ReplayController
+		if rc, ok := packetSource.(capture.ReplayController); ok {
+			replay = resettingReplay{rc, assemblyPool, analysisPool}
+		}
+		cui := presentation.New(analysisPool, updateInterval, *cumulative, statProvider,
+			replay, time.Duration(*seekStep)*time.Second, connectionLister(assemblyPool), latencySummarizer(assemblyPool),
+			pipelineSummarizer(assemblyPool), desyncCounter(assemblyPool))
 
 		logger.SetLogger(cui)
 		go buffered.WriteTo(cui)
@@ -101,37 +211,281 @@ func main() {
 	}
 }
 
+// resettingReplay clears the state built from the packets replayed so far
+// when seeking backward, since the packets replayed again would otherwise be
+// taken for retransmissions and counted twice.
+type resettingReplay struct {
+	capture.ReplayController
+	assemblyPool *assembly.Pool
+	analysisPool *analysis.Pool
+}
+
+func (r resettingReplay) Seek(d time.Duration) error {
+	if err := r.ReplayController.Seek(d); err != nil {
+		return err
+	}
+	if d < 0 {
+		// close the connections first, so that the events they flush
+		// are cleared too
+		r.assemblyPool.Reset()
+		r.analysisPool.Reset()
+	}
+	return nil
+}
+
 var stats presentation.Stats
 
-func statGenerator(captureProvider capture.StatProvider, decodePool *decode.Pool, analysisPool *analysis.Pool) presentation.StatProvider {
+func statGenerator(captureProvider capture.StatProvider, decodePool *decode.Pool, assemblyPool *assembly.Pool,
+	analysisPool *analysis.Pool) presentation.StatProvider {
 	return func() presentation.Stats {
 		captureStats, err := captureProvider.Stats()
 		if err == nil {
 			stats.PacketsEnteredFilter = captureStats.PacketsReceived
 			stats.PacketsDroppedKernel = captureStats.PacketsIfDropped + captureStats.PacketsDropped
 		}
+		if isp, ok := captureProvider.(capture.InterfaceStatProvider); ok {
+			interfaceStats, err := isp.InterfaceStats()
+			if err == nil {
+				stats.Interfaces = stats.Interfaces[:0]
+				for _, is := range interfaceStats {
+					stats.Interfaces = append(stats.Interfaces, presentation.InterfaceStats{
+						Name:            is.Name,
+						PacketsReceived: is.PacketsReceived,
+						PacketsDropped:  is.PacketsIfDropped + is.PacketsDropped,
+					})
+				}
+			}
+		}
+
+		if rp, ok := captureProvider.(capture.ReplayPositioner); ok {
+			stats.Replaying = true
+			stats.CaptureTime, stats.ReplayOffset = rp.ReplayPosition()
+		}
+		if rc, ok := captureProvider.(capture.ReplayController); ok {
+			stats.ReplayProgress = rc.Progress()
+		}
 
 		decodeStats := decodePool.Stats()
 		stats.PacketsCaptured = decodeStats.PacketsCaptured
 		stats.PacketsDroppedParser = decodeStats.PacketsDropped
+		stats.Tunnels = append(stats.Tunnels[:0],
+			presentation.TunnelStats{Name: "VXLAN", Packets: decodeStats.Encapsulated.VXLAN},
+			presentation.TunnelStats{Name: "GRE", Packets: decodeStats.Encapsulated.GRE},
+			presentation.TunnelStats{Name: "ERSPAN", Packets: decodeStats.Encapsulated.ERSPAN},
+			presentation.TunnelStats{Name: "MPLS", Packets: decodeStats.Encapsulated.MPLS})
+		stats.Fragments = presentation.FragmentStats{
+			Received:    decodeStats.Defrag.Fragments,
+			Reassembled: decodeStats.Defrag.Reassembled,
+			Expired:     decodeStats.Defrag.Expired,
+			Evicted:     decodeStats.Defrag.Evicted,
+		}
+		stats.PacketsTruncated = decodeStats.PacketsTruncated
+		stats.DecodeFailures = stats.DecodeFailures[:0]
+		for layer, n := range decodeStats.DecodeFailures {
+			stats.DecodeFailures = append(stats.DecodeFailures, presentation.DecodeFailureStats{Layer: layer, Packets: n})
+		}
+		sort.Slice(stats.DecodeFailures, func(i, j int) bool {
+			return stats.DecodeFailures[i].Layer < stats.DecodeFailures[j].Layer
+		})
+
+		assemblyStats := assemblyPool.Stats()
+		stats.PacketsDroppedAssembly = assemblyStats.PacketsDropped
+		stats.Assembly = presentation.AssemblyStats{
+			Flushed:        assemblyStats.Flushed,
+			Closed:         assemblyStats.Closed,
+			LostData:       assemblyStats.LostData,
+			Resyncs:        assemblyStats.Resyncs,
+			PacketsDropped: assemblyStats.PacketsDropped,
+			WorkerDrops:    stats.Assembly.WorkerDrops[:0],
+		}
+		for _, ws := range assemblyPool.WorkerStats() {
+			stats.Assembly.WorkerDrops = append(stats.Assembly.WorkerDrops, ws.PacketsDropped)
+		}
+
+		now := time.Now()
+		if stats.Replaying {
+			now = stats.CaptureTime
+		}
+		churn := assemblyPool.Churn(now)
+		stats.Churn = presentation.ChurnStats{Opens: churn.Opens, Closes: churn.Closes}
+		for _, cc := range churn.Clients {
+			stats.Churn.Clients = append(stats.Churn.Clients, presentation.ClientChurnStats{
+				Client:   cc.Client,
+				Opens:    cc.Opens,
+				Closes:   cc.Closes,
+				Baseline: cc.Baseline,
+				Spike:    cc.Spike,
+			})
+		}
+
+		health := assemblyPool.Health()
+		stats.TCPHealth = presentation.TCPHealthStats{TCPHealth: tcpHealth(health.Total)}
+		if len(health.Clients) > 0 {
+			stats.TCPHealth.WorstClient = presentation.EndpointHealthStats{
+				Endpoint:  health.Clients[0].Endpoint,
+				TCPHealth: tcpHealth(health.Clients[0].Health),
+			}
+		}
+		if len(health.Servers) > 0 {
+			stats.TCPHealth.WorstServer = presentation.EndpointHealthStats{
+				Endpoint:  health.Servers[0].Endpoint,
+				TCPHealth: tcpHealth(health.Servers[0].Health),
+			}
+		}
 
 		analysisStats := analysisPool.Stats()
 		stats.ResponsesParsed = int(analysisStats.EventsHandled)
 		stats.PacketsDroppedAnalysis = int(analysisStats.EventsDropped)
+		stats.GetsDroppedAffinity = int(analysisStats.RequestsDropped)
 
 		stats.PacketsPassedFilter = stats.PacketsDroppedKernel + stats.PacketsCaptured
-		stats.PacketsDroppedTotal = stats.PacketsDroppedKernel + stats.PacketsDroppedParser + stats.PacketsDroppedAnalysis
+		stats.PacketsDroppedTotal = stats.PacketsDroppedKernel + stats.PacketsDroppedParser +
+			stats.PacketsDroppedAssembly + stats.PacketsDroppedAnalysis
 
 		return stats
 	}
 }
 
-func packetHandler(analysisPool *analysis.Pool) func(dps []*decode.DecodedPacket) {
-	pool := assembly.New(logger, analysisPool, *ports, *assemblyWorkers)
-	return func(dps []*decode.DecodedPacket) {
-		err := pool.HandlePackets(dps)
-		if err != nil {
-			logger.Log(err)
+func tcpHealth(h assembly.Health) presentation.TCPHealth {
+	return presentation.TCPHealth{
+		Retransmits: h.Retransmits,
+		ZeroWindows: h.ZeroWindows,
+		Resets:      h.Resets,
+	}
+}
+
+// openReportOut opens the file named by path for JSON reports, returning nil
+// if path is empty.
+func openReportOut(path string) (io.WriteCloser, error) {
+	switch {
+	case path == "":
+		return nil, nil
+	case !*noGui:
+		return nil, errors.New("--json requires --nogui")
+	case path == "-":
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// writeReport writes rep to w as a single line of JSON.
+func writeReport(w io.Writer, rep analysis.Report) {
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		logger.Log("writing report:", err)
+	}
+}
+
+// logChurn reports connection churn when running without the interactive
+// interface.
+func logChurn(churn presentation.ChurnStats) {
+	if churn.Opens == 0 && churn.Closes == 0 {
+		return
+	}
+	logger.Log(fmt.Sprintf("Connections/s: %d opened %d closed", churn.Opens, churn.Closes))
+	for _, cc := range churn.Clients {
+		if cc.Spike {
+			logger.Log(fmt.Sprintf("Connection spike from %s: %d/s opened (usually %.1f/s)",
+				cc.Client, cc.Opens, cc.Baseline))
+		}
+	}
+}
+
+func connectionLister(assemblyPool *assembly.Pool) presentation.ConnectionProvider {
+	return func() []presentation.ConnectionStats {
+		conns := assemblyPool.Connections()
+		stats := make([]presentation.ConnectionStats, len(conns))
+		for i, c := range conns {
+			stats[i] = presentation.ConnectionStats{
+				Client:       c.Client,
+				Server:       c.Server,
+				Start:        c.Start,
+				LastActivity: c.LastActivity,
+				ClientBytes:  c.ClientBytes,
+				ServerBytes:  c.ServerBytes,
+				Requests:     c.Requests,
+				Desyncs:      c.Desyncs,
+				Retransmits:  c.Retransmits,
+				ZeroWindows:  c.ZeroWindows,
+				Resets:       c.Resets,
+			}
+		}
+		return stats
+	}
+}
+
+func latencySummarizer(assemblyPool *assembly.Pool) presentation.LatencyProvider {
+	return func() presentation.LatencyStats {
+		rep := assemblyPool.Latency()
+		stats := presentation.LatencyStats{
+			All:     clientLatency(rep.All),
+			Clients: make([]presentation.ClientLatencyStats, len(rep.Clients)),
+		}
+		for i, cl := range rep.Clients {
+			stats.Clients[i] = clientLatency(cl)
 		}
+		return stats
+	}
+}
+
+func clientLatency(cl assembly.ClientLatency) presentation.ClientLatencyStats {
+	return presentation.ClientLatencyStats{
+		Client:  cl.Client,
+		RTT:     presentation.PercentileStats(cl.RTT),
+		Request: presentation.PercentileStats(cl.Request),
+	}
+}
+
+func pipelineSummarizer(assemblyPool *assembly.Pool) presentation.PipelineProvider {
+	return func() presentation.PipelineStats {
+		rep := assemblyPool.Pipelining()
+		stats := presentation.PipelineStats{
+			All:     clientPipeline(rep.All),
+			Clients: make([]presentation.ClientPipelineStats, len(rep.Clients)),
+		}
+		for i, cp := range rep.Clients {
+			stats.Clients[i] = clientPipeline(cp)
+		}
+		return stats
+	}
+}
+
+func clientPipeline(cp assembly.ClientPipeline) presentation.ClientPipelineStats {
+	return presentation.ClientPipelineStats{
+		Client:      cp.Client,
+		KeysPerGet:  distribution(cp.KeysPerGet),
+		Outstanding: distribution(cp.Outstanding),
+	}
+}
+
+func distribution(d assembly.Distribution) presentation.DistributionStats {
+	stats := presentation.DistributionStats{
+		Count:   d.Count,
+		Mean:    d.Mean,
+		P50:     d.P50,
+		P99:     d.P99,
+		Max:     d.Max,
+		Buckets: make([]presentation.BucketStats, len(d.Buckets)),
+	}
+	for i, b := range d.Buckets {
+		stats.Buckets[i] = presentation.BucketStats(b)
+	}
+	return stats
+}
+
+func desyncCounter(assemblyPool *assembly.Pool) presentation.DiagnosticsProvider {
+	return func() presentation.DiagnosticsStats {
+		stats := presentation.DiagnosticsStats{
+			BufferMemory:       reader.MemoryBorrowed(),
+			BufferMemoryBudget: *bufferMemory * 1024 * 1024,
+		}
+		for _, dc := range assemblyPool.Desyncs().Causes {
+			stats.Desyncs = append(stats.Desyncs, presentation.DesyncStats{
+				Cause:   dc.Cause,
+				Count:   dc.Count,
+				Skipped: dc.Skipped,
+				Samples: dc.Samples,
+			})
+		}
+		return stats
 	}
 }
@@ -0,0 +1,52 @@
+package presentation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func renderAffinityHeader() {
+	renderText(0, 0, "Key")
+	renderText(4, 0, "Requested with")
+	renderText(8, 0, "Together")
+	renderText(9, 0, "Affinity")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderAffinity lists the pairs of keys most often requested together in
+// the current interval, followed by the clusters they form, in as much room as
+// fits above the footer.
+func (u *uiContext) renderAffinity(stats Stats) {
+	rep := u.prevReport.Affinity
+	renderAffinityHeader()
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	// split the room between pairs and clusters
+	pairsY := 2 + (lastY-2)/2
+	if len(rep.Clusters) == 0 {
+		pairsY = lastY
+	}
+	y := 2
+	for _, p := range rep.Pairs {
+		if y > pairsY {
+			break
+		}
+		renderText(0, y, p.Keys[0])
+		renderText(4, y, p.Keys[1])
+		renderText(8, y, strconv.Itoa(p.Together))
+		renderText(9, y, fmt.Sprintf("%.0f%%", p.Affinity*100))
+		y++
+	}
+	if len(rep.Clusters) == 0 {
+		return
+	}
+	y++
+	renderText(0, y, "Clusters of keys requested together")
+	for _, c := range rep.Clusters {
+		y++
+		if y > lastY {
+			break
+		}
+		renderText(0, y, fmt.Sprintf("%d keys, %d together: %s", len(c.Keys), c.Together, strings.Join(c.Keys, " ")))
+	}
+}
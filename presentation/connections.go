@@ -0,0 +1,151 @@
+package presentation
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// view is a page of the interactive interface.
+type view int
+
+const (
+	viewKeys view = iota
+	viewSizes
+	viewSlabs
+	viewConnections
+	viewLatency
+	viewPipeline
+	viewAffinity
+	viewDiagnostics
+	numViews
+)
+
+// connSort is an order in which connections can be listed.
+type connSort int
+
+const (
+	// most recently active first
+	sortByActivity connSort = iota
+	// most bytes in both directions first
+	sortByBytes
+	// most requests first
+	sortByRequests
+	// most retransmits, zero windows and resets first
+	sortByTrouble
+	numConnSorts
+)
+
+func (s connSort) String() string {
+	switch s {
+	case sortByActivity:
+		return "last activity"
+	case sortByBytes:
+		return "bytes"
+	case sortByRequests:
+		return "requests"
+	case sortByTrouble:
+		return "TCP trouble"
+	}
+	return "unknown"
+}
+
+func (s connSort) less(a, b ConnectionStats) bool {
+	switch s {
+	case sortByBytes:
+		return a.ClientBytes+a.ServerBytes > b.ClientBytes+b.ServerBytes
+	case sortByRequests:
+		return a.Requests > b.Requests
+	case sortByTrouble:
+		return a.Retransmits+a.ZeroWindows+a.Resets > b.Retransmits+b.ZeroWindows+b.Resets
+	}
+	return a.LastActivity.After(b.LastActivity)
+}
+
+// handleView switches to the next available view.
+func (u *uiContext) handleView() {
+	for {
+		u.view = (u.view + 1) % numViews
+		if u.hasView(u.view) {
+			return
+		}
+	}
+}
+
+// hasView returns true if the data for v is available.
+func (u *uiContext) hasView(v view) bool {
+	switch v {
+	case viewConnections:
+		return u.connections != nil
+	case viewLatency:
+		return u.latency != nil
+	case viewPipeline:
+		return u.pipeline != nil
+	case viewDiagnostics:
+		return u.diagnostics != nil
+	}
+	return true
+}
+
+// handleSort changes the order of the connection view.
+func (u *uiContext) handleSort() {
+	if u.view != viewConnections {
+		return
+	}
+	u.connSort = (u.connSort + 1) % numConnSorts
+	u.Log("Sorting connections by", u.connSort)
+}
+
+func renderConnectionHeader() {
+	renderText(0, 0, "Client")
+	renderText(2, 0, "Server")
+	renderText(4, 0, "Age")
+	renderText(5, 0, "Idle")
+	renderText(6, 0, "From client")
+	renderText(7, 0, "From server")
+	renderText(8, 0, "Requests")
+	renderText(9, 0, "Desyncs")
+	renderText(10, 0, "Retransmits")
+	renderText(11, 0, "Zero windows")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderConnections lists the open connections, as many as fit above the
+// footer.
+func (u *uiContext) renderConnections(stats Stats) {
+	conns := u.connections()
+	sort.Slice(conns, func(i, j int) bool {
+		return u.connSort.less(conns[i], conns[j])
+	})
+	now := time.Now()
+	if stats.Replaying {
+		now = stats.CaptureTime
+	}
+
+	renderConnectionHeader()
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	for i, c := range conns {
+		y := i + 2
+		if y > lastY {
+			break
+		}
+		renderText(0, y, c.Client)
+		renderText(2, y, c.Server)
+		renderText(4, y, formatAge(now.Sub(c.Start)))
+		renderText(5, y, formatAge(now.Sub(c.LastActivity)))
+		renderText(6, y, strconv.Itoa(c.ClientBytes))
+		renderText(7, y, strconv.Itoa(c.ServerBytes))
+		renderText(8, y, strconv.Itoa(c.Requests))
+		renderText(9, y, strconv.Itoa(c.Desyncs))
+		renderText(10, y, strconv.Itoa(c.Retransmits))
+		renderText(11, y, strconv.Itoa(c.ZeroWindows))
+	}
+}
+
+// formatAge formats a duration to the nearest second.
+func formatAge(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Truncate(time.Second).String()
+}
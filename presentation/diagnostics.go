@@ -0,0 +1,51 @@
+package presentation
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func renderDiagnosticsHeader() {
+	renderText(0, 0, "Desync cause")
+	renderText(2, 0, "Count")
+	renderText(3, 0, "Bytes skipped")
+	renderText(5, 0, "Recent samples")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderDiagnostics lists the times parsing lost track of conversations by
+// cause, with samples of the lines that could not be parsed, so that the
+// user can judge how far to trust the other views.
+func (u *uiContext) renderDiagnostics(stats Stats) {
+	ds := u.diagnostics()
+	renderDiagnosticsHeader()
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	var total int
+	for _, d := range ds.Desyncs {
+		total += d.Count
+	}
+	renderText(0, 2, fmt.Sprintf("%d desyncs while parsing %d values", total, stats.ResponsesParsed))
+	renderText(5, 2, fmt.Sprintf("Extra buffer memory: %d of %d bytes", ds.BufferMemory, ds.BufferMemoryBudget))
+
+	y := 4
+	for _, d := range ds.Desyncs {
+		if y > lastY {
+			break
+		}
+		renderText(0, y, d.Cause)
+		renderText(2, y, strconv.Itoa(d.Count))
+		renderText(3, y, strconv.Itoa(d.Skipped))
+		for i, sample := range d.Samples {
+			if y+i > lastY {
+				break
+			}
+			renderText(5, y+i, strconv.Quote(sample))
+		}
+		// one line for each sample, or for the cause if there are none
+		if len(d.Samples) > 0 {
+			y += len(d.Samples)
+		} else {
+			y++
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package presentation
+
+import (
+	"strconv"
+	"time"
+)
+
+func renderLatencyHeader() {
+	renderText(0, 0, "Client")
+	renderText(2, 0, "Handshakes")
+	renderText(3, 0, "RTT p50")
+	renderText(4, 0, "RTT p90")
+	renderText(5, 0, "RTT p99")
+	renderText(7, 0, "Requests")
+	renderText(8, 0, "Latency p50")
+	renderText(9, 0, "Latency p90")
+	renderText(10, 0, "Latency p99")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderLatency lists the latencies of all clients together, followed by as
+// many individual clients as fit above the footer.
+func (u *uiContext) renderLatency(stats Stats) {
+	ls := u.latency()
+	renderLatencyHeader()
+	all := ls.All
+	all.Client = "All clients"
+	renderClientLatency(2, all)
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	for i, cl := range ls.Clients {
+		y := i + 3
+		if y > lastY {
+			break
+		}
+		renderClientLatency(y, cl)
+	}
+}
+
+func renderClientLatency(y int, cl ClientLatencyStats) {
+	renderText(0, y, cl.Client)
+	renderPercentiles(2, y, cl.RTT)
+	renderPercentiles(7, y, cl.Request)
+}
+
+// renderPercentiles displays the count and percentiles of ps in four columns
+// starting at column.
+func renderPercentiles(column int, y int, ps PercentileStats) {
+	renderText(column, y, strconv.Itoa(ps.Count))
+	if ps.Count == 0 {
+		return
+	}
+	renderText(column+1, y, formatLatency(ps.P50))
+	renderText(column+2, y, formatLatency(ps.P90))
+	renderText(column+3, y, formatLatency(ps.P99))
+}
+
+// formatLatency formats a duration to the nearest microsecond.
+func formatLatency(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
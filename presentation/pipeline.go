@@ -0,0 +1,81 @@
+package presentation
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func renderPipelineHeader() {
+	renderText(0, 0, "Client")
+	renderText(2, 0, "Gets")
+	renderText(3, 0, "Keys mean")
+	renderText(4, 0, "Keys p50")
+	renderText(5, 0, "Keys p99")
+	renderText(6, 0, "Keys max")
+	renderText(7, 0, "Responses")
+	renderText(8, 0, "Depth mean")
+	renderText(9, 0, "Depth p50")
+	renderText(10, 0, "Depth p99")
+	renderText(11, 0, "Depth max")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderPipeline lists the keys per get and the pipelining depth of all
+// clients together, with their histograms, followed by as many individual
+// clients as fit above the footer.  Clients with deep pipelines or large
+// multi-gets hold up the requests queued behind them.
+func (u *uiContext) renderPipeline(stats Stats) {
+	ps := u.pipeline()
+	renderPipelineHeader()
+	all := ps.All
+	all.Client = "All clients"
+	renderClientPipeline(2, all)
+	renderText(0, 3, "Keys per get:"+formatBuckets(all.KeysPerGet.Buckets))
+	renderText(0, 4, "Requests outstanding:"+formatBuckets(all.Outstanding.Buckets))
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	for i, cp := range ps.Clients {
+		y := i + 6
+		if y > lastY {
+			break
+		}
+		renderClientPipeline(y, cp)
+	}
+}
+
+func renderClientPipeline(y int, cp ClientPipelineStats) {
+	renderText(0, y, cp.Client)
+	renderDistribution(2, y, cp.KeysPerGet)
+	renderDistribution(7, y, cp.Outstanding)
+}
+
+// renderDistribution displays the count, mean, percentiles and maximum of d
+// in five columns starting at column.
+func renderDistribution(column int, y int, d DistributionStats) {
+	renderText(column, y, strconv.Itoa(d.Count))
+	if d.Count == 0 {
+		return
+	}
+	renderText(column+1, y, fmt.Sprintf("%.1f", d.Mean))
+	renderText(column+2, y, strconv.Itoa(d.P50))
+	renderText(column+3, y, strconv.Itoa(d.P99))
+	renderText(column+4, y, strconv.Itoa(d.Max))
+}
+
+// formatBuckets formats the counts of the non-empty buckets of a histogram.
+func formatBuckets(buckets []BucketStats) string {
+	var txt string
+	for _, b := range buckets {
+		if b.Count == 0 {
+			continue
+		}
+		switch {
+		case b.Max == 0:
+			txt += fmt.Sprintf("  %d+: %d", b.Min, b.Count)
+		case b.Min >= b.Max:
+			txt += fmt.Sprintf("  %d: %d", b.Max, b.Count)
+		default:
+			txt += fmt.Sprintf("  %d-%d: %d", b.Min, b.Max, b.Count)
+		}
+	}
+	return txt
+}
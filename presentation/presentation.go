@@ -26,6 +26,22 @@ type uiContext struct {
 	prevReport   analysis.Report
 	cumulative   bool
 	paused       bool
+	// controls replay when reading from a file, otherwise nil
+	replay   ReplayController
+	seekStep time.Duration
+	// fires once the packets of a single step have been processed
+	stepDone <-chan time.Time
+	// lists open connections for the connection view, if not nil
+	connections ConnectionProvider
+	// summarizes latencies for the latency view, if not nil
+	latency LatencyProvider
+	// summarizes multi-gets and pipelining for the pipelining view, if not
+	// nil
+	pipeline PipelineProvider
+	// counts desyncs for the diagnostics view, if not nil
+	diagnostics DiagnosticsProvider
+	view        view
+	connSort    connSort
 }
 
 // Stats collects statistics on runtime performance to be displayed to the user.
@@ -40,17 +56,271 @@ type Stats struct {
 	PacketsDroppedKernel int
 	// count of packets dropped due to no decoder available
 	PacketsDroppedParser int
+	// count of packets dropped due to assembly queues being full
+	PacketsDroppedAssembly int
 	// count of packets dropped due to analysis queue being full
 	PacketsDroppedAnalysis int
 	PacketsDroppedTotal    int
 	ResponsesParsed        int
+	// count of get requests left out of the key affinity due to its queue
+	// being full
+	GetsDroppedAffinity int
+	// per-interface statistics when capturing from several interfaces
+	Interfaces []InterfaceStats
+	// count of packets decoded from inside each kind of tunnel
+	Tunnels []TunnelStats
+	// count of packets that could not be decoded, by the layer that failed
+	DecodeFailures []DecodeFailureStats
+	// counts of IP fragments and the datagrams reassembled from them
+	Fragments FragmentStats
+	// count of TCP packets cut short by the snap length
+	PacketsTruncated int
+	// connections opened and closed in the most recent second
+	Churn ChurnStats
+	// signs of TCP trouble since capture started
+	TCPHealth TCPHealthStats
+	// trouble following TCP streams since capture started
+	Assembly AssemblyStats
+	// true when replaying from a file, in which case CaptureTime and
+	// ReplayOffset give the position of the most recently replayed packet
+	Replaying    bool
+	CaptureTime  time.Time
+	ReplayOffset time.Duration
+	// fraction of the file replayed so far, or -1 if unknown
+	ReplayProgress float64
+}
+
+// InterfaceStats collects capture statistics for a single network interface.
+type InterfaceStats struct {
+	Name string
+	// count of packets that passed the BPF on this interface
+	PacketsReceived int
+	// count of packets dropped by the kernel on this interface
+	PacketsDropped int
+}
+
+// TunnelStats counts packets decoded from inside a single kind of tunnel.
+type TunnelStats struct {
+	Name    string
+	Packets int
+}
+
+// DecodeFailureStats counts packets that could not be decoded because of a
+// single layer.
+type DecodeFailureStats struct {
+	Layer   string
+	Packets int
+}
+
+// AssemblyStats counts trouble reassembling and parsing TCP streams.
+type AssemblyStats struct {
+	// streams on which missing data was skipped after going idle
+	Flushed int
+	// idle streams closed
+	Closed int
+	// gaps in streams where data was lost
+	LostData int
+	// times parsing lost track of a conversation and resumed at the next
+	// command
+	Resyncs int
+	// count of packets dropped due to assembly queues being full, in total
+	// and by worker
+	PacketsDropped int
+	WorkerDrops    []int
+}
+
+// FragmentStats counts IP fragments and the datagrams reassembled from them.
+type FragmentStats struct {
+	Received    int
+	Reassembled int
+	// fragments discarded when the rest of their datagram did not arrive
+	// in time
+	Expired int
+	// fragments discarded to stay within the memory limit
+	Evicted int
+}
+
+// ChurnStats counts the connections opened and closed during a single second.
+type ChurnStats struct {
+	Opens  int
+	Closes int
+	// clients that opened or closed connections, most opens first
+	Clients []ClientChurnStats
+}
+
+// ClientChurnStats counts the connections opened and closed by a single
+// client during a single second.
+type ClientChurnStats struct {
+	Client string
+	Opens  int
+	Closes int
+	// usual count of connections opened per second
+	Baseline float64
+	// true if Opens is well above Baseline
+	Spike bool
+}
+
+// TCPHealthStats counts signs of trouble in TCP packets, which point to
+// network or host problems rather than memcached itself.
+type TCPHealthStats struct {
+	TCPHealth
+	// the client and server sending the most troubled packets, if any
+	WorstClient EndpointHealthStats
+	WorstServer EndpointHealthStats
+}
+
+// TCPHealth counts signs of trouble in TCP packets.
+type TCPHealth struct {
+	Retransmits int
+	ZeroWindows int
+	Resets      int
+}
+
+// EndpointHealthStats counts signs of trouble in the TCP packets sent by a
+// single client or server.
+type EndpointHealthStats struct {
+	Endpoint string
+	TCPHealth
 }
 
 // StatProvider returns a snapshot of current runtime statistics.
 type StatProvider func() Stats
 
-// New returns a UIHandler that is ready to run
-func New(analysisPool *analysis.Pool, interval time.Duration, cumulative bool, statProvider StatProvider) UIHandler {
+// ConnectionStats describes the activity on a single client connection.
+type ConnectionStats struct {
+	// endpoints of the connection, as address:port
+	Client string
+	Server string
+	// capture times of the first and most recent packets seen
+	Start        time.Time
+	LastActivity time.Time
+	// payload bytes sent by each side
+	ClientBytes int
+	ServerBytes int
+	Requests    int
+	// count of times parsing lost track of the conversation
+	Desyncs int
+	// signs of TCP trouble in either direction
+	Retransmits int
+	ZeroWindows int
+	Resets      int
+}
+
+// ConnectionProvider returns a snapshot of the open client connections.
+type ConnectionProvider func() []ConnectionStats
+
+// LatencyStats summarizes the network round trip times and memcached request
+// latencies of all clients and of each client.
+type LatencyStats struct {
+	All ClientLatencyStats
+	// clients with the slowest requests first
+	Clients []ClientLatencyStats
+}
+
+// ClientLatencyStats summarizes the latencies of a single client.
+type ClientLatencyStats struct {
+	Client string
+	// round trip times measured from TCP handshakes
+	RTT PercentileStats
+	// time from each request to the start of its response
+	Request PercentileStats
+}
+
+// PercentileStats summarizes a set of durations.
+type PercentileStats struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// LatencyProvider returns a snapshot of the latencies measured so far.
+type LatencyProvider func() LatencyStats
+
+// BucketStats counts the values from Min to Max inclusive, or from Min up if
+// Max is zero.
+type BucketStats struct {
+	Min   int
+	Max   int
+	Count int
+}
+
+// DistributionStats summarizes a histogram of counts, with approximate
+// percentiles.
+type DistributionStats struct {
+	Count   int
+	Mean    float64
+	P50     int
+	P99     int
+	Max     int
+	Buckets []BucketStats
+}
+
+// ClientPipelineStats describes the multi-gets and pipelining of a single
+// client.
+type ClientPipelineStats struct {
+	Client string
+	// keys in each get request
+	KeysPerGet DistributionStats
+	// requests outstanding on a connection when each response started
+	Outstanding DistributionStats
+}
+
+// PipelineStats describes the multi-gets and pipelining of all clients and
+// of each client.
+type PipelineStats struct {
+	All ClientPipelineStats
+	// the most deeply pipelined clients first
+	Clients []ClientPipelineStats
+}
+
+// PipelineProvider returns a snapshot of the multi-gets and pipelining seen
+// so far.
+type PipelineProvider func() PipelineStats
+
+// DesyncStats counts the times parsing lost track of conversations for a
+// single cause.
+type DesyncStats struct {
+	Cause string
+	Count int
+	// bytes lost or discarded before parsing resumed
+	Skipped int
+	// the most recent lines or requests being parsed when the conversation
+	// was lost, oldest first
+	Samples []string
+}
+
+// DiagnosticsStats describes how well conversations have been followed.
+type DiagnosticsStats struct {
+	Desyncs []DesyncStats
+	// bytes buffered by connections beyond what each is guaranteed, and
+	// the most that may be
+	BufferMemory       int
+	BufferMemoryBudget int
+}
+
+// DiagnosticsProvider returns a snapshot of the diagnostics so far.
+type DiagnosticsProvider func() DiagnosticsStats
+
+// ReplayController controls the replay of a capture file.
+type ReplayController interface {
+	// SetPaused stops or restarts the replay clock.
+	SetPaused(paused bool)
+	// Step advances the replay clock by d while paused.
+	Step(d time.Duration)
+	// Seek moves the replay position forward or backward by d.
+	Seek(d time.Duration) error
+}
+
+// New returns a UIHandler that is ready to run.  If replay is not nil, the
+// user may pause, step and seek through the capture file, moving by seekStep
+// at a time.  If connections, latency, pipeline or diagnostics is not nil, the
+// user may switch to a view of open connections, of latencies by client, of
+// multi-gets and pipelining by client or of the times parsing lost track of
+// conversations.
+func New(analysisPool *analysis.Pool, interval time.Duration, cumulative bool, statProvider StatProvider,
+	replay ReplayController, seekStep time.Duration, connections ConnectionProvider, latency LatencyProvider,
+	pipeline PipelineProvider, diagnostics DiagnosticsProvider) UIHandler {
 	return &uiContext{
 		analysis:     analysisPool,
 		interval:     interval,
@@ -59,6 +329,12 @@ func New(analysisPool *analysis.Pool, interval time.Duration, cumulative bool, s
 		prevReport:   analysis.Report{},
 		cumulative:   cumulative,
 		paused:       false,
+		replay:       replay,
+		seekStep:     seekStep,
+		connections:  connections,
+		latency:      latency,
+		pipeline:     pipeline,
+		diagnostics:  diagnostics,
 	}
 }
 
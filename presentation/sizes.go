@@ -0,0 +1,90 @@
+package presentation
+
+import (
+	"strconv"
+
+	"github.com/box/memsniff/analysis"
+)
+
+// sparkLevels draws the counts of a histogram relative to its largest.
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+func renderSizesHeader() {
+	renderText(0, 0, "Values")
+	renderText(3, 0, "Gets")
+	renderText(4, 0, "Get sizes")
+	renderText(7, 0, "Sets")
+	renderText(8, 0, "Set sizes")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderSizes displays histograms of value sizes for all values, for the
+// busiest key groups and for the busiest keys, in as much room as fits above
+// the footer.  Each histogram is drawn with a character for each bucket.
+func (u *uiContext) renderSizes(stats Stats) {
+	rep := u.prevReport
+	renderSizesHeader()
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	renderText(0, 2, "Sizes doubling from up to 64 B to over 1 MiB")
+	renderValueSizes(3, "All values", rep.Sizes)
+
+	y := 5
+	renderText(0, y, "Key groups")
+	for _, g := range rep.Groups {
+		y++
+		if y > lastY {
+			return
+		}
+		name := g.Group
+		if name == analysis.OtherGroup {
+			name = "(no prefix)"
+		}
+		renderValueSizes(y, name, g.ValueSizes)
+	}
+
+	y += 2
+	if y > lastY {
+		return
+	}
+	renderText(0, y, "Keys")
+	seen := make(map[string]bool)
+	for _, kr := range rep.Keys {
+		// keys whose size changed are reported once for each size
+		if seen[kr.Name] {
+			continue
+		}
+		seen[kr.Name] = true
+		y++
+		if y > lastY {
+			return
+		}
+		renderValueSizes(y, kr.Name, kr.Sizes)
+	}
+}
+
+func renderValueSizes(y int, name string, vs analysis.ValueSizes) {
+	renderText(0, y, name)
+	renderText(3, y, strconv.Itoa(vs.Gets.Count()))
+	renderText(4, y, sparkline(vs.Gets))
+	renderText(7, y, strconv.Itoa(vs.Sets.Count()))
+	renderText(8, y, sparkline(vs.Sets))
+}
+
+// sparkline draws the buckets of h, leaving empty buckets blank.
+func sparkline(h analysis.SizeHistogram) string {
+	var max int
+	for _, n := range h {
+		if n > max {
+			max = n
+		}
+	}
+	line := make([]rune, len(h))
+	for i, n := range h {
+		if n == 0 {
+			line[i] = ' '
+			continue
+		}
+		line[i] = sparkLevels[(n*len(sparkLevels)-1)/max]
+	}
+	return string(line)
+}
@@ -0,0 +1,79 @@
+package presentation
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/box/memsniff/analysis"
+)
+
+func (u *uiContext) renderSlabsHeader() {
+	renderText(0, 0, "Class")
+	renderText(1, 0, "Chunk size")
+	renderText(3, 0, "Keys")
+	if u.cumulative {
+		renderText(4, 0, "Requests")
+		renderText(6, 0, "Bytes")
+	} else {
+		renderText(4, 0, "Requests/s")
+		renderText(6, 0, "Bytes/s")
+	}
+	renderText(8, 0, "Memory")
+	renderText(10, 0, "Wasted")
+	renderLine(0, 12, 1, '-')
+}
+
+// renderSlabs lists the memcached slab classes that would store the keys seen,
+// with the memory their chunks leave unused and the growth factor that would
+// waste the least, in as much room as fits above the footer.
+func (u *uiContext) renderSlabs(stats Stats) {
+	rep := u.prevReport.Slabs
+	u.renderSlabsHeader()
+	lastY := yFromBottom(statusLines(u.prevReport, stats) + logLines)
+	cfg := rep.Config
+	var memory int
+	for _, c := range rep.Classes {
+		memory += c.Memory
+	}
+	renderText(0, 2, fmt.Sprintf("Growth factor %.2f, minimum space %d B, item header %d B: %d of %d bytes wasted (%s)",
+		cfg.Factor, cfg.MinSpace, cfg.ItemOverhead, rep.Wasted, memory, percent(rep.Wasted, memory)))
+	if rep.SuggestedFactor != cfg.Factor {
+		renderText(0, 3, fmt.Sprintf("Growth factor %.2f would waste %d bytes (%s)",
+			rep.SuggestedFactor, rep.SuggestedWasted, percent(rep.SuggestedWasted, memory)))
+	}
+
+	y := 5
+	for _, c := range rep.Classes {
+		if y > lastY {
+			return
+		}
+		u.renderSlabClass(y, strconv.Itoa(c.ID), strconv.Itoa(c.ChunkSize), c)
+		y++
+	}
+	if rep.Large.Keys > 0 && y <= lastY {
+		u.renderSlabClass(y, "Large", ">"+strconv.Itoa(cfg.LargestChunk), rep.Large)
+	}
+}
+
+func (u *uiContext) renderSlabClass(y int, id, chunkSize string, c analysis.SlabClass) {
+	requests, traffic := float64(c.Requests), float64(c.Traffic)
+	if !u.cumulative {
+		requests /= u.interval.Seconds()
+		traffic /= u.interval.Seconds()
+	}
+	renderText(0, y, id)
+	renderText(1, y, chunkSize)
+	renderText(3, y, strconv.Itoa(c.Keys))
+	renderText(4, y, strconv.FormatFloat(requests, 'f', 0, 64))
+	renderText(6, y, strconv.FormatFloat(traffic, 'f', 0, 64))
+	renderText(8, y, strconv.Itoa(c.Memory))
+	renderText(10, y, fmt.Sprintf("%d (%s)", c.Wasted, percent(c.Wasted, c.Memory)))
+}
+
+// percent formats n as a percentage of total.
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.0f%%", float64(n)*100/float64(total))
+}
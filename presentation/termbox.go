@@ -7,13 +7,16 @@ import (
 	"github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	numColumns  = 12
-	statusLines = 1
-	logLines    = 4
+	numColumns = 12
+	logLines   = 4
+	// how long to wait for the packets of a single replay step to be
+	// processed before displaying the results
+	stepSettleTime = 250 * time.Millisecond
 )
 
 var (
@@ -49,6 +52,12 @@ func (u *uiContext) eventLoop() error {
 				return err
 			}
 
+		case <-u.stepDone:
+			u.stepDone = nil
+			if err := u.showStep(); err != nil {
+				return err
+			}
+
 		case msg := <-u.msgChan:
 			u.handleNewMessage(msg)
 
@@ -83,6 +92,27 @@ func (u *uiContext) handleEvent(ev termbox.Event) error {
 		if ev.Ch == 'p' {
 			u.handlePause()
 		}
+		if ev.Ch == 'n' {
+			u.handleStep()
+		}
+		if ev.Key == termbox.KeyTab {
+			u.handleView()
+			if err := u.render(); err != nil {
+				return err
+			}
+		}
+		if ev.Ch == 's' {
+			u.handleSort()
+			if err := u.render(); err != nil {
+				return err
+			}
+		}
+		if ev.Key == termbox.KeyArrowRight {
+			u.handleSeek(u.seekStep)
+		}
+		if ev.Key == termbox.KeyArrowLeft {
+			u.handleSeek(-u.seekStep)
+		}
 		if ev.Ch == 'q' || ev.Key == termbox.KeyCtrlC {
 			return errQuitRequested
 		}
@@ -105,6 +135,15 @@ func (u *uiContext) handleEvent(ev termbox.Event) error {
 
 func (u *uiContext) handlePause() {
 	u.paused = !u.paused
+	if u.replay != nil {
+		u.replay.SetPaused(u.paused)
+		if u.paused {
+			u.Log("Replay paused")
+		} else {
+			u.Log("Replay resumed")
+		}
+		return
+	}
 	if u.paused {
 		u.Log("Updates paused")
 	} else {
@@ -112,6 +151,40 @@ func (u *uiContext) handlePause() {
 	}
 }
 
+// handleStep replays a single interval of a paused capture file, and
+// displays the results once they have been processed.
+func (u *uiContext) handleStep() {
+	if u.replay == nil || !u.paused || u.stepDone != nil {
+		return
+	}
+	if !u.cumulative {
+		// discard anything left over from before the step
+		u.analysis.Report(true)
+	}
+	u.replay.Step(u.interval)
+	u.stepDone = time.After(stepSettleTime)
+}
+
+func (u *uiContext) showStep() error {
+	u.prevReport = u.analysis.Report(!u.cumulative)
+	return u.render()
+}
+
+func (u *uiContext) handleSeek(d time.Duration) {
+	if u.replay == nil {
+		return
+	}
+	if err := u.replay.Seek(d); err != nil {
+		u.Log("Seek failed:", err)
+		return
+	}
+	if d < 0 {
+		u.Log("Skipped back", -d)
+	} else {
+		u.Log("Skipped forward", d)
+	}
+}
+
 func (u *uiContext) handleNewMessage(msg string) {
 	if len(u.messages) < logLines {
 		u.messages = append(u.messages, msg)
@@ -128,8 +201,53 @@ func renderHeader() {
 	renderLine(0, 12, 1, '-')
 }
 
-func renderReport(rep analysis.Report) {
-	lastY := yFromBottom(statusLines + logLines)
+// statusLines returns the number of lines used by the footer for rep and
+// stats.
+func statusLines(rep analysis.Report, stats Stats) int {
+	n := 1
+	if len(rep.Interfaces) > 1 {
+		n++
+	}
+	if hasDecodeStats(stats) {
+		n++
+	}
+	if hasChurn(stats) {
+		n++
+	}
+	if stats.TCPHealth.TCPHealth != (TCPHealth{}) {
+		n++
+	}
+	if hasAssemblyStats(stats.Assembly) {
+		n++
+	}
+	if stats.GetsDroppedAffinity > 0 {
+		n++
+	}
+	if stats.Replaying {
+		n++
+	}
+	return n
+}
+
+// hasDecodeStats returns true if there is anything unusual to report about
+// packet decoding.
+func hasDecodeStats(stats Stats) bool {
+	return hasTunnels(stats) || stats.Fragments.Received > 0 || stats.PacketsTruncated > 0 ||
+		len(stats.DecodeFailures) > 0
+}
+
+// hasTunnels returns true if any packets have been decoded from tunnels.
+func hasTunnels(stats Stats) bool {
+	for _, ts := range stats.Tunnels {
+		if ts.Packets > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func renderReport(rep analysis.Report, stats Stats) {
+	lastY := yFromBottom(statusLines(rep, stats) + logLines)
 	for i, kr := range rep.Keys {
 		y := i + 2
 		if y > lastY {
@@ -142,20 +260,183 @@ func renderReport(rep analysis.Report) {
 	}
 }
 
-func (u *uiContext) renderMessages() {
+func (u *uiContext) renderMessages(stats Stats) {
 	for i, msg := range u.messages {
-		renderText(0, yFromBottom(i+statusLines), msg)
+		renderText(0, yFromBottom(i+statusLines(u.prevReport, stats)), msg)
 	}
 }
 
-func (u *uiContext) renderFooter(rep analysis.Report) {
+func (u *uiContext) renderFooter(rep analysis.Report, stats Stats) {
 	y := yFromBottom(0)
-	stats := u.statProvider()
-	renderText(0, y, rep.Timestamp.Format("15:04:05.000"))
+	if stats.Replaying {
+		renderText(0, y, stats.CaptureTime.Format("15:04:05.000"))
+		renderText(9, y, "Replay: +"+stats.ReplayOffset.Truncate(time.Millisecond).String())
+	} else {
+		renderText(0, y, rep.Timestamp.Format("15:04:05.000"))
+	}
 
 	renderText(2, y, dropLabel(stats))
 	renderText(4, y, fmt.Sprintf("Packets: %10d", stats.PacketsPassedFilter))
-	renderText(6, y, fmt.Sprintf("GET responses: %10d", stats.ResponsesParsed))
+	renderText(6, y, fmt.Sprintf("Values parsed: %10d", stats.ResponsesParsed))
+
+	line := 1
+	if len(rep.Interfaces) > 1 {
+		renderInterfaces(yFromBottom(line), rep.Interfaces, stats.Interfaces)
+		line++
+	}
+	if hasDecodeStats(stats) {
+		renderDecodeStats(yFromBottom(line), stats)
+		line++
+	}
+	if hasChurn(stats) {
+		renderChurn(yFromBottom(line), stats.Churn)
+		line++
+	}
+	if stats.TCPHealth.TCPHealth != (TCPHealth{}) {
+		renderTCPHealth(yFromBottom(line), stats.TCPHealth)
+		line++
+	}
+	if hasAssemblyStats(stats.Assembly) {
+		renderAssembly(yFromBottom(line), stats.Assembly)
+		line++
+	}
+	if stats.GetsDroppedAffinity > 0 {
+		renderText(0, yFromBottom(line), fmt.Sprintf("Gets dropped from affinity: %d", stats.GetsDroppedAffinity))
+		line++
+	}
+	if stats.Replaying {
+		u.renderProgress(yFromBottom(line), stats.ReplayProgress)
+	}
+}
+
+// renderProgress displays a bar showing how much of the capture file has
+// been replayed.
+func (u *uiContext) renderProgress(y int, progress float64) {
+	label := "Progress unknown"
+	if progress >= 0 {
+		label = fmt.Sprintf("%5.1f%%", progress*100)
+	}
+	if u.paused {
+		label += " (paused)"
+	}
+
+	w, _ := termbox.Size()
+	barWidth := w - len(label) - 3
+	if progress >= 0 && barWidth > 0 {
+		filled := int(progress * float64(barWidth))
+		termbox.SetCell(0, y, '[', termbox.ColorDefault, termbox.ColorDefault)
+		for x := 0; x < barWidth; x++ {
+			ch := ' '
+			if x < filled {
+				ch = '='
+			}
+			termbox.SetCell(x+1, y, ch, termbox.ColorDefault, termbox.ColorDefault)
+		}
+		termbox.SetCell(barWidth+1, y, ']', termbox.ColorDefault, termbox.ColorDefault)
+		for i, r := range label {
+			termbox.SetCell(barWidth+3+i, y, r, termbox.ColorDefault, termbox.ColorDefault)
+		}
+		return
+	}
+	renderText(0, y, label)
+}
+
+// renderInterfaces displays a summary of activity on each capture interface.
+func renderInterfaces(y int, reps []analysis.InterfaceReport, stats []InterfaceStats) {
+	span := numColumns / len(reps)
+	if span < 1 {
+		span = 1
+	}
+	for i, ir := range reps {
+		txt := fmt.Sprintf("%s: %d hits %d B", ir.Name, ir.RequestsEstimate, ir.TrafficEstimate)
+		if i < len(stats) {
+			txt += fmt.Sprintf(" (%d pkts, %d dropped)", stats[i].PacketsReceived, stats[i].PacketsDropped)
+		}
+		renderText(i*span, y, txt)
+	}
+}
+
+// renderDecodeStats displays counts of tunneled packets, IP fragments,
+// truncated packets and packets that could not be decoded, one after the
+// other on a single line.
+func renderDecodeStats(y int, stats Stats) {
+	var parts []string
+	if hasTunnels(stats) {
+		txt := "Tunneled packets:"
+		for _, ts := range stats.Tunnels {
+			txt += fmt.Sprintf(" %s %d", ts.Name, ts.Packets)
+		}
+		parts = append(parts, txt)
+	}
+	if fs := stats.Fragments; fs.Received > 0 {
+		parts = append(parts, fmt.Sprintf("IP fragments: %d (%d reassembled, %d expired, %d evicted)",
+			fs.Received, fs.Reassembled, fs.Expired, fs.Evicted))
+	}
+	if stats.PacketsTruncated > 0 {
+		parts = append(parts, fmt.Sprintf("Truncated packets: %d", stats.PacketsTruncated))
+	}
+	if len(stats.DecodeFailures) > 0 {
+		txt := "Decode failures:"
+		for _, fs := range stats.DecodeFailures {
+			txt += fmt.Sprintf(" %s %d", fs.Layer, fs.Packets)
+		}
+		parts = append(parts, txt)
+	}
+	renderText(0, y, strings.Join(parts, "  "))
+}
+
+// hasChurn returns true if any connections were opened or closed in the most
+// recent second.
+func hasChurn(stats Stats) bool {
+	return stats.Churn.Opens > 0 || stats.Churn.Closes > 0
+}
+
+// renderChurn displays the rate at which connections are opened and closed,
+// highlighting clients whose connect rate has spiked.
+func renderChurn(y int, churn ChurnStats) {
+	x := renderTextAt(0, y, fmt.Sprintf("Connections/s: %d opened %d closed", churn.Opens, churn.Closes), termbox.ColorDefault)
+	for _, cs := range churn.Clients {
+		if cs.Spike {
+			txt := fmt.Sprintf("  %s %d/s (usually %.1f/s)", cs.Client, cs.Opens, cs.Baseline)
+			x = renderTextAt(x, y, txt, termbox.ColorRed|termbox.AttrBold)
+		}
+	}
+}
+
+// renderTCPHealth displays the signs of TCP trouble, along with the client
+// and server sending the most troubled packets.
+func renderTCPHealth(y int, health TCPHealthStats) {
+	txt := "TCP: " + formatTCPHealth(health.TCPHealth)
+	if health.WorstServer.Endpoint != "" {
+		txt += fmt.Sprintf("  Worst server %s: %s", health.WorstServer.Endpoint, formatTCPHealth(health.WorstServer.TCPHealth))
+	}
+	if health.WorstClient.Endpoint != "" {
+		txt += fmt.Sprintf("  Worst client %s: %s", health.WorstClient.Endpoint, formatTCPHealth(health.WorstClient.TCPHealth))
+	}
+	renderText(0, y, txt)
+}
+
+func formatTCPHealth(h TCPHealth) string {
+	return fmt.Sprintf("%d retransmits %d zero windows %d resets", h.Retransmits, h.ZeroWindows, h.Resets)
+}
+
+// hasAssemblyStats returns true if reassembly has anything to report.
+func hasAssemblyStats(as AssemblyStats) bool {
+	return as.Flushed > 0 || as.Closed > 0 || as.LostData > 0 || as.Resyncs > 0 || as.PacketsDropped > 0
+}
+
+// renderAssembly displays the gaps and resyncs in TCP streams, the idle
+// streams flushed and the packets dropped by each assembly worker.
+func renderAssembly(y int, as AssemblyStats) {
+	txt := fmt.Sprintf("Streams: %d gaps %d resyncs %d idle flushed %d closed",
+		as.LostData, as.Resyncs, as.Flushed, as.Closed)
+	if as.PacketsDropped > 0 {
+		txt += "  Assembly queue drops by worker:"
+		for _, n := range as.WorkerDrops {
+			txt += " " + strconv.Itoa(n)
+		}
+	}
+	renderText(0, y, txt)
 }
 
 func dropLabel(s Stats) string {
@@ -166,19 +447,28 @@ func dropLabel(s Stats) string {
 		dropRate = float64(s.PacketsDroppedTotal) / float64(s.PacketsPassedFilter)
 	}
 
-	return fmt.Sprintf("Dropped: %d+%d+%d=%d (%5.2f%%)",
-		s.PacketsDroppedKernel, s.PacketsDroppedParser,
+	return fmt.Sprintf("Dropped: %d+%d+%d+%d=%d (%5.2f%%)",
+		s.PacketsDroppedKernel, s.PacketsDroppedParser, s.PacketsDroppedAssembly,
 		s.PacketsDroppedAnalysis, s.PacketsDroppedTotal, dropRate*100)
 }
 
 func renderText(column int, y int, txt string) {
-	x := columnX(column)
-	runes := []rune(txt)
+	renderTextColor(column, y, txt, termbox.ColorDefault)
+}
 
-	for _, r := range runes {
-		termbox.SetCell(x, y, r, termbox.ColorDefault, termbox.ColorDefault)
+// renderTextColor displays txt starting at column with foreground color fg.
+func renderTextColor(column int, y int, txt string, fg termbox.Attribute) {
+	renderTextAt(columnX(column), y, txt, fg)
+}
+
+// renderTextAt displays txt starting at x with foreground color fg, returning
+// the x coordinate after the end of the text.
+func renderTextAt(x int, y int, txt string, fg termbox.Attribute) int {
+	for _, r := range txt {
+		termbox.SetCell(x, y, r, fg, termbox.ColorDefault)
 		x += runewidth.RuneWidth(r)
 	}
+	return x
 }
 
 func renderLine(column int, span int, y int, ch rune) {
@@ -202,21 +492,47 @@ func yFromBottom(n int) int {
 }
 
 func (u *uiContext) update() error {
+	// Continue to clear the accumulated data every interval even when paused
+	// so we don't get a big burst of data on unpause.  While stepping through
+	// a replay, leave the data for showStep.
+	if u.stepDone == nil {
+		rep := u.analysis.Report(!u.cumulative)
+		if !u.paused {
+			u.prevReport = rep
+		}
+	}
+	return u.render()
+}
+
+// render draws the most recent report.
+func (u *uiContext) render() error {
 	err := termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
 	if err != nil {
 		return err
 	}
 
-	// Continue to clear the accumulated data every interval even when paused
-	// so we don't get a big burst of data on unpause.
-	rep := u.analysis.Report(!u.cumulative)
-	if !u.paused {
-		u.prevReport = rep
-	}
-	renderHeader()
-	renderReport(u.prevReport)
-	u.renderFooter(u.prevReport)
-	u.renderMessages()
+	stats := u.statProvider()
+	switch u.view {
+	case viewSizes:
+		u.renderSizes(stats)
+	case viewSlabs:
+		u.renderSlabs(stats)
+	case viewConnections:
+		u.renderConnections(stats)
+	case viewLatency:
+		u.renderLatency(stats)
+	case viewPipeline:
+		u.renderPipeline(stats)
+	case viewAffinity:
+		u.renderAffinity(stats)
+	case viewDiagnostics:
+		u.renderDiagnostics(stats)
+	default:
+		renderHeader()
+		renderReport(u.prevReport, stats)
+	}
+	u.renderFooter(u.prevReport, stats)
+	u.renderMessages(stats)
 
 	return termbox.Flush()
 }
@@ -6,6 +6,8 @@ import (
 	"io"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/box/memsniff/assembly/reader"
 	"github.com/box/memsniff/log"
@@ -15,6 +17,11 @@ import (
 const (
 	crlf       = "\r\n"
 	debuglevel = 0
+	// longest sample of an offending line reported with a desync
+	maxSampleLen = 80
+	// most requests counted behind the current one when measuring how
+	// deeply a client pipelines
+	maxPipelined = 1024
 )
 
 var (
@@ -27,6 +34,13 @@ type Consumer struct {
 	*model.Consumer
 	cmd  string
 	args []string
+	// capture time at which the current request arrived, or zero once the
+	// server has started to respond
+	requestTime time.Time
+	// true from reading a request until the server starts to respond
+	awaiting bool
+	// the line that could not be parsed, if any
+	sample string
 }
 
 func NewConsumer(logger log.Logger, handler model.EventHandler) *model.Consumer {
@@ -49,6 +63,13 @@ func (c *Consumer) run() {
 		default:
 			// data lost or protocol error, try to resync at the next command
 			c.log(2, "trying to resync after error:", err)
+			c.Desyncs++
+			if c.DesyncHandler != nil {
+				c.DesyncHandler(c.desync(err))
+			}
+			c.requestTime = time.Time{}
+			c.awaiting = false
+			c.sample = ""
 			c.ClientReader.Reset()
 			c.ServerReader.Reset()
 			c.State = c.readCommand
@@ -57,11 +78,45 @@ func (c *Consumer) run() {
 	}
 }
 
+// desync describes losing track of the conversation because of err.  It must
+// be called before the buffered data is discarded.
+func (c *Consumer) desync(err error) model.Desync {
+	d := model.Desync{
+		Cause:   model.DesyncProtocol,
+		Skipped: c.ClientReader.Buffered() + c.ServerReader.Buffered(),
+		Sample:  c.sample,
+	}
+	switch e := err.(type) {
+	case reader.ErrLostData:
+		d.Cause = model.DesyncLostData
+		if e.Lost > 0 {
+			d.Skipped += e.Lost
+		}
+	case reader.ErrTruncated:
+		d.Cause = model.DesyncTruncated
+		d.Skipped += e.Missing
+	case *strconv.NumError:
+		d.Cause = model.DesyncBadSize
+	default:
+		if err == io.ErrShortWrite || err == reader.ErrLineTooLong {
+			d.Cause = model.DesyncOverflow
+		}
+	}
+	if d.Sample == "" && c.cmd != "" {
+		d.Sample = strings.Join(append([]string{c.cmd}, c.args...), " ")
+	}
+	if len(d.Sample) > maxSampleLen {
+		d.Sample = d.Sample[:maxSampleLen]
+	}
+	return d
+}
+
 func (c *Consumer) peekMagicByte() error {
 	c.ServerReader.Truncate()
 	firstByte, err := c.ClientReader.PeekN(1)
 	if err != nil {
-		if _, ok := err.(reader.ErrLostData); ok {
+		switch err.(type) {
+		case reader.ErrLostData, reader.ErrTruncated:
 			// try again, making sure we read from the start of a client packet.
 			c.ClientReader.Truncate()
 			err = reader.ErrShortRead
@@ -79,14 +134,21 @@ func (c *Consumer) peekMagicByte() error {
 }
 
 func (c *Consumer) readCommand() error {
+	c.cmd = ""
 	c.args = c.args[:0]
-	c.ServerReader.Truncate()
 	c.log(3, "reading command")
 	pos, err := c.ClientReader.IndexAny(" \n")
 	if err != nil {
+		// the server has no request to respond to.  Responses to pipelined
+		// requests are kept until the requests have been read.
+		c.ServerReader.Truncate()
 		return err
 	}
 
+	var requestTime time.Time
+	if c.Clock != nil {
+		requestTime = c.RequestTime()
+	}
 	cmd, err := c.ClientReader.ReadN(pos + 1)
 	if err != nil {
 		return err
@@ -97,6 +159,9 @@ func (c *Consumer) readCommand() error {
 	if !asciiRe.MatchString(c.cmd) {
 		return errProtocolDesync
 	}
+	c.Requests++
+	c.awaiting = true
+	c.requestTime = requestTime
 
 	if c.commandState() != nil {
 		c.State = c.readArgs
@@ -122,9 +187,9 @@ func (c *Consumer) commandState() model.State {
 }
 
 func (c *Consumer) readArgs() error {
-	c.ServerReader.Truncate()
 	pos, err := c.ClientReader.IndexAny(" \n")
 	if err != nil {
+		c.ServerReader.Truncate()
 		return err
 	}
 	word, err := c.ClientReader.ReadN(pos + 1)
@@ -137,6 +202,9 @@ func (c *Consumer) readArgs() error {
 		return nil
 	}
 	c.log(3, "read arguments:", c.args)
+	if (c.cmd == "get" || c.cmd == "gets") && c.GetHandler != nil {
+		c.GetHandler(c.args)
+	}
 	c.State = c.commandState()
 	return nil
 }
@@ -151,12 +219,14 @@ func (c *Consumer) handleGet() error {
 		if err != nil {
 			return err
 		}
+		c.responded()
 		c.log(3, "server reply:", string(line))
 		fields := bytes.Split(line, []byte(" "))
 		if len(fields) >= 4 && bytes.Equal(fields[0], []byte("VALUE")) {
 			key := fields[1]
 			size, err := strconv.Atoi(string(fields[3]))
 			if err != nil {
+				c.sample = string(line)
 				return err
 			}
 			evt := model.Event{
@@ -187,6 +257,11 @@ func (c *Consumer) handleSet() error {
 	if err != nil {
 		return c.discardResponse()
 	}
+	c.addEvent(model.Event{
+		Type: model.EventSet,
+		Key:  c.args[0],
+		Size: size,
+	})
 	c.log(3, "discarding", size+len(crlf), "from client")
 	_, err = c.ClientReader.Discard(size + len(crlf))
 	if err != nil {
@@ -216,11 +291,70 @@ func (c *Consumer) discardResponse() error {
 	if err != nil {
 		return err
 	}
+	c.responded()
 	c.log(3, "discarded response from server:", string(line))
 	c.State = c.readCommand
 	return nil
 }
 
+// responded reports the latency of the current request and the requests
+// outstanding when the first line of its response has been read.
+func (c *Consumer) responded() {
+	if c.awaiting && c.PipelineHandler != nil {
+		c.PipelineHandler(1 + c.pipelined())
+	}
+	c.awaiting = false
+	if c.requestTime.IsZero() {
+		return
+	}
+	latency := c.Clock().Sub(c.requestTime)
+	c.requestTime = time.Time{}
+	if latency < 0 {
+		latency = 0
+	}
+	if c.LatencyHandler != nil {
+		c.LatencyHandler(latency)
+	}
+}
+
+// pipelined counts the complete requests buffered from the client behind the
+// current one, which were sent before its response arrived.
+func (c *Consumer) pipelined() int {
+	// stops at the first gap, if any
+	buf, _ := c.ClientReader.PeekN(c.ClientReader.Buffered())
+	n := 0
+	for n < maxPipelined {
+		eol := bytes.IndexByte(buf, '\n')
+		if eol < 0 {
+			break
+		}
+		fields := bytes.Fields(buf[:eol])
+		buf = buf[eol+1:]
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) >= 5 && isStorageCommand(string(fields[0])) {
+			// skip the data block, which must have arrived too
+			size, err := strconv.Atoi(string(fields[4]))
+			if err != nil || size < 0 || size+len(crlf) > len(buf) {
+				break
+			}
+			buf = buf[size+len(crlf):]
+		}
+		n++
+	}
+	return n
+}
+
+// isStorageCommand returns true if cmd is followed by a data block.
+func isStorageCommand(cmd string) bool {
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return true
+	}
+	return false
+}
+
 func (c *Consumer) addEvent(evt model.Event) {
 	c.Consumer.AddEvent(evt)
 }
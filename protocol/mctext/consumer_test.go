@@ -1,8 +1,12 @@
 package mctext
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/box/memsniff/assembly/reader"
 	"github.com/box/memsniff/log"
 	"github.com/box/memsniff/protocol/model"
 	"github.com/google/gopacket/tcpassembly"
@@ -93,3 +97,250 @@ func testReadText(t *testing.T, lines []string, expected []model.Event) {
 func reassemblyString(s string) []tcpassembly.Reassembly {
 	return []tcpassembly.Reassembly{{Bytes: []byte(s)}}
 }
+
+func TestRequestAndDesyncCounts(t *testing.T) {
+	r := NewConsumer(nil, func([]model.Event) {})
+	var desyncs []model.Desync
+	r.DesyncHandler = func(d model.Desync) { desyncs = append(desyncs, d) }
+	r.ClientStream().Reassembled(reassemblyString("get key1\r\n"))
+	r.ServerStream().Reassembled(reassemblyString("END\r\n"))
+	r.ClientStream().Reassembled(reassemblyString("set key1 0 0 5\r\nhello\r\n"))
+	r.ServerStream().Reassembled(reassemblyString("STORED\r\n"))
+	r.ClientStream().Reassembled(reassemblyString("\x01\x02 garbage\r\n"))
+	if r.Requests != 2 {
+		t.Error("counted", r.Requests, "requests, expected 2")
+	}
+	if r.Desyncs != 1 {
+		t.Error("counted", r.Desyncs, "desyncs, expected 1")
+	}
+	expected := model.Desync{Cause: model.DesyncProtocol, Skipped: 9, Sample: "\x01\x02"}
+	if len(desyncs) != 1 || desyncs[0] != expected {
+		t.Error("got desyncs", desyncs, "expected", expected)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	r := NewConsumer(nil, func([]model.Event) {})
+	var now time.Time
+	r.Clock = func() time.Time { return now }
+	var latencies []time.Duration
+	r.LatencyHandler = func(latency time.Duration) {
+		latencies = append(latencies, latency)
+	}
+
+	now = time.Unix(100, 0)
+	r.ClientStream().Reassembled(reassemblyString("get key1\r\n"))
+	now = now.Add(3 * time.Millisecond)
+	r.ServerStream().Reassembled(reassemblyString("VALUE key1 0 5\r\n"))
+	now = now.Add(time.Millisecond)
+	r.ServerStream().Reassembled(reassemblyString("hello\r\nEND\r\n"))
+	now = now.Add(time.Second)
+	r.ClientStream().Reassembled(reassemblyString("set key1 0 0 5\r\nhello\r\n"))
+	now = now.Add(2 * time.Millisecond)
+	r.ServerStream().Reassembled(reassemblyString("STORED\r\n"))
+
+	expected := []time.Duration{3 * time.Millisecond, 2 * time.Millisecond}
+	if len(latencies) != len(expected) {
+		t.Fatal("got latencies", latencies, "expected", expected)
+	}
+	for i, l := range expected {
+		if latencies[i] != l {
+			t.Error("got latency", latencies[i], "expected", l)
+		}
+	}
+}
+
+func TestPipelinedLatency(t *testing.T) {
+	r := NewConsumer(nil, func([]model.Event) {})
+	var now time.Time
+	r.Clock = func() time.Time { return now }
+	var latencies []time.Duration
+	r.LatencyHandler = func(latency time.Duration) {
+		latencies = append(latencies, latency)
+	}
+
+	// the second and third requests are only read once the response to
+	// the first has been parsed
+	now = time.Unix(100, 0)
+	r.ClientStream().Reassembled(reassemblyString("get key1\r\nget "))
+	now = now.Add(time.Millisecond)
+	r.ClientStream().Reassembled(reassemblyString("key2\r\nget key3\r\n"))
+	now = now.Add(9 * time.Millisecond)
+	r.ServerStream().Reassembled(reassemblyString("END\r\nEND\r\nEND\r\n"))
+
+	expected := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 9 * time.Millisecond}
+	if len(latencies) != len(expected) {
+		t.Fatal("got latencies", latencies, "expected", expected)
+	}
+	for i, l := range expected {
+		if latencies[i] != l {
+			t.Error("got latency", latencies[i], "expected", l)
+		}
+	}
+}
+
+// TestPipelinedLatencyTruncated checks that payload beyond the snap length
+// does not throw off the times at which pipelined requests arrived.
+func TestPipelinedLatencyTruncated(t *testing.T) {
+	r := NewConsumer(nil, func([]model.Event) {})
+	var now time.Time
+	r.Clock = func() time.Time { return now }
+	var latencies []time.Duration
+	r.LatencyHandler = func(latency time.Duration) {
+		latencies = append(latencies, latency)
+	}
+
+	now = time.Unix(100, 0)
+	r.ClientStream().Reassembled(reassemblyString("get key1\r\n"))
+	now = now.Add(time.Millisecond)
+	r.ClientStream().Reassembled(reassemblyString("get key2\r\n"))
+	now = now.Add(time.Millisecond)
+	r.ClientStream().Reassembled([]tcpassembly.Reassembly{
+		{Bytes: []byte("set foo 0 0 20\r\n0123456789")},
+		{Bytes: reader.Filler(10)},
+		{Bytes: []byte("\r\n")},
+	})
+	now = now.Add(8 * time.Millisecond)
+	r.ServerStream().Reassembled(reassemblyString("END\r\nEND\r\n"))
+
+	expected := []time.Duration{10 * time.Millisecond, 9 * time.Millisecond}
+	if len(latencies) != len(expected) {
+		t.Fatal("got latencies", latencies, "expected", expected)
+	}
+	for i, l := range expected {
+		if latencies[i] != l {
+			t.Error("got latency", latencies[i], "expected", l)
+		}
+	}
+}
+
+func TestDesyncCauses(t *testing.T) {
+	reader.SetMemoryBudget(0)
+	defer reader.SetMemoryBudget(reader.DefaultMemoryBudget)
+	for _, tc := range []struct {
+		client   []tcpassembly.Reassembly
+		server   []tcpassembly.Reassembly
+		expected model.Desync
+	}{
+		{
+			client:   reassemblyString("get key1\r\n"),
+			server:   reassemblyString("VALUE key1 0 1x\r\n"),
+			expected: model.Desync{Cause: model.DesyncBadSize, Sample: "VALUE key1 0 1x"},
+		},
+		{
+			client: reassemblyString("get key1\r\n"),
+			server: []tcpassembly.Reassembly{
+				{Bytes: []byte("VALUE key1 0 5\r\nhel")},
+				{Skip: 100, Bytes: []byte("lo\r\nEND\r\n")},
+			},
+			// the value is discarded into the gap, leaving 96 bytes of it
+			// and the rest of the response to skip
+			expected: model.Desync{Cause: model.DesyncLostData, Skipped: 96 + 9, Sample: "get key1"},
+		},
+		{
+			// pipelined requests fill the buffer while awaiting the
+			// first response
+			client:   reassemblyString("get key1\r\n" + strings.Repeat("get key2\r\n", 4000)),
+			server:   reassemblyString("END\r\n"),
+			expected: model.Desync{Cause: model.DesyncOverflow, Skipped: reader.BufferSize - 10},
+		},
+	} {
+		r := NewConsumer(nil, func([]model.Event) {})
+		var desyncs []model.Desync
+		r.DesyncHandler = func(d model.Desync) { desyncs = append(desyncs, d) }
+		r.ClientStream().Reassembled(tc.client)
+		r.ServerStream().Reassembled(tc.server)
+		if len(desyncs) != 1 || desyncs[0] != tc.expected {
+			t.Error("got desyncs", desyncs, "expected", tc.expected)
+		}
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	var events []model.Event
+	r := NewConsumer(nil, func(evts []model.Event) { events = append(events, evts...) })
+	var desyncs []model.Desync
+	r.DesyncHandler = func(d model.Desync) { desyncs = append(desyncs, d) }
+
+	// a multi-get response far larger than a reader's buffer, arriving in
+	// large segments
+	r.ClientStream().Reassembled(reassemblyString("get key1 key2 key3\r\n"))
+	value := strings.Repeat("x", 200*1024)
+	response := "VALUE key1 0 204800\r\n" + value + "\r\n" +
+		"VALUE key2 0 204800\r\n" + value + "\r\n" +
+		"VALUE key3 0 5\r\nhello\r\nEND\r\n"
+	for len(response) > 64*1024 {
+		r.ServerStream().Reassembled(reassemblyString(response[:64*1024]))
+		response = response[64*1024:]
+	}
+	r.ServerStream().Reassembled(reassemblyString(response))
+
+	// pipelined sets with more data than a reader's buffer, sent before
+	// the first response
+	set := "set key4 0 0 20480\r\n" + strings.Repeat("y", 20*1024) + "\r\n"
+	r.ClientStream().Reassembled(reassemblyString(set + set + set))
+	if n := reader.MemoryBorrowed(); n == 0 {
+		t.Error("no memory borrowed while awaiting pipelined responses")
+	}
+	for i := 0; i < 3; i++ {
+		r.ServerStream().Reassembled(reassemblyString("STORED\r\n"))
+	}
+	if n := reader.MemoryBorrowed(); n != 0 {
+		t.Error("borrowed memory not returned:", n)
+	}
+	r.ClientStream().Reassembled(reassemblyString("get key5\r\n"))
+	r.ServerStream().Reassembled(reassemblyString("END\r\n"))
+	r.FlushEvents()
+
+	if len(desyncs) != 0 {
+		t.Error("got desyncs", desyncs)
+	}
+	if r.Requests != 5 {
+		t.Error("counted", r.Requests, "requests, expected 5")
+	}
+	expected := []model.Event{
+		{model.EventGetHit, "key1", 204800},
+		{model.EventGetHit, "key2", 204800},
+		{model.EventGetHit, "key3", 5},
+		{model.EventSet, "key4", 20480},
+		{model.EventSet, "key4", 20480},
+		{model.EventSet, "key4", 20480},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Error("got events", events, "expected", expected)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	var events []model.Event
+	r := NewConsumer(nil, func(evts []model.Event) { events = append(events, evts...) })
+	var keys, outstanding []int
+	r.GetHandler = func(args []string) { keys = append(keys, len(args)) }
+	r.PipelineHandler = func(n int) { outstanding = append(outstanding, n) }
+
+	// a multi-get, then a set and two gets pipelined behind it, with the
+	// responses arriving together
+	r.ClientStream().Reassembled(reassemblyString("get key1 key2 key3\r\n"))
+	r.ServerStream().Reassembled(reassemblyString("VALUE key1 0 1\r\na\r\nEND\r\n"))
+	r.ClientStream().Reassembled(reassemblyString("set key4 0 0 5\r\nhello\r\nget key4\r\ngets key5 key6\r\n"))
+	r.ServerStream().Reassembled(reassemblyString("STORED\r\nVALUE key4 0 5\r\nhello\r\nEND\r\nEND\r\n"))
+	r.FlushEvents()
+
+	if r.Requests != 4 || r.Desyncs != 0 {
+		t.Error("counted", r.Requests, "requests and", r.Desyncs, "desyncs, expected 4 and 0")
+	}
+	if expected := []int{3, 1, 2}; !reflect.DeepEqual(keys, expected) {
+		t.Error("got keys per get", keys, "expected", expected)
+	}
+	if expected := []int{1, 3, 2, 1}; !reflect.DeepEqual(outstanding, expected) {
+		t.Error("got outstanding requests", outstanding, "expected", expected)
+	}
+	expected := []model.Event{
+		{model.EventGetHit, "key1", 1},
+		{model.EventSet, "key4", 5},
+		{model.EventGetHit, "key4", 5},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Error("got events", events, "expected", expected)
+	}
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"io"
 	"sync"
+	"time"
 
 	"github.com/box/memsniff/assembly/reader"
 	"github.com/box/memsniff/log"
@@ -19,8 +20,14 @@ const (
 	EventGetHit
 	// EventGetMiss is a data retrieval that did not result in data.
 	EventGetMiss
+	// EventSet is a storage command, such as set or add, sending data.
+	EventSet
 )
 
+// maxChunk is the most data given to a reader before the consumer is run, so
+// that large values are discarded as they arrive instead of being buffered.
+const maxChunk = 8 * 1024
+
 var (
 	bufferPool = sync.Pool{New: func() interface{} { return reader.New() }}
 	eofSource  = &DummySource{}
@@ -78,6 +85,9 @@ type Reader interface {
 
 	// Truncate discards all buffered data from the reader, leaving other state intact.
 	Truncate()
+
+	// Buffered returns the number of bytes of data buffered.
+	Buffered() int
 }
 
 // ConsumerSource buffers tcpassembly.Stream data and exposes it as a closeable Reader.
@@ -104,7 +114,67 @@ type Consumer struct {
 	Run   func()
 	State State
 
+	// Requests counts the client requests read so far.
+	Requests int
+	// Desyncs counts the times the conversation could not be followed and
+	// parsing had to resume at the next command.
+	Desyncs int
+
+	// Clock returns the capture time of the data being consumed.  If nil,
+	// request latency is not measured.
+	Clock func() time.Time
+	// LatencyHandler receives the time from each request to the start of
+	// its response, if not nil.
+	LatencyHandler func(latency time.Duration)
+	// DesyncHandler receives a description of each desync, if not nil.
+	DesyncHandler func(d Desync)
+	// GetHandler receives the keys of each get request, if not nil.  keys
+	// is only valid until GetHandler returns.
+	GetHandler func(keys []string)
+	// PipelineHandler receives the number of requests outstanding when the
+	// response to each request starts, counting that request and those sent
+	// after it, if not nil.
+	PipelineHandler func(outstanding int)
+
 	eventBuf []Event
+	// capture times of the client data not yet read, oldest first, while
+	// Clock is set
+	arrivals []arrival
+	// bytes of client data reassembled while Clock is set, not counting
+	// filler for data beyond the snap length
+	clientBytes int64
+}
+
+// arrival records the capture time of a piece of client data, which ends
+// before the end'th byte reassembled.
+type arrival struct {
+	end int64
+	at  time.Time
+}
+
+// RequestTime returns the capture time at which the next unread byte from the
+// client arrived, forgetting the times of client data already read.  This is
+// the time a request was sent even if it was pipelined behind others, and
+// only read once their responses had been parsed.  RequestTime must only be
+// called while Clock is set.
+func (c *Consumer) RequestTime() time.Time {
+	next := c.clientBytes - int64(c.ClientReader.Buffered())
+	for len(c.arrivals) > 0 && c.arrivals[0].end <= next {
+		c.arrivals = c.arrivals[1:]
+	}
+	if len(c.arrivals) == 0 {
+		return c.Clock()
+	}
+	return c.arrivals[0].at
+}
+
+// arrived records the capture time of n bytes of client data.
+func (c *Consumer) arrived(n int) {
+	if c.Clock == nil || n == 0 {
+		return
+	}
+	c.clientBytes += int64(n)
+	c.arrivals = append(c.arrivals, arrival{c.clientBytes, c.Clock()})
 }
 
 func New(logger log.Logger, handler EventHandler) *Consumer {
@@ -169,8 +239,14 @@ type ClientStream Consumer
 func (cs *ClientStream) Reassembled(rs []tcpassembly.Reassembly) {
 	for _, r := range rs {
 		// (*Consumer)(cs).log("reassembling from client", r.Skip, len(r.Bytes))
-		cs.ClientReader.Reassembled([]tcpassembly.Reassembly{r})
-		(*Consumer)(cs).Run()
+		inChunks(r, func(chunk tcpassembly.Reassembly) {
+			// Buffered does not count filler, so neither do arrivals
+			if !reader.IsFiller(chunk.Bytes) {
+				(*Consumer)(cs).arrived(len(chunk.Bytes))
+			}
+			cs.ClientReader.Reassembled([]tcpassembly.Reassembly{chunk})
+			(*Consumer)(cs).Run()
+		})
 	}
 }
 
@@ -190,8 +266,10 @@ type ServerStream Consumer
 func (ss *ServerStream) Reassembled(rs []tcpassembly.Reassembly) {
 	for _, r := range rs {
 		// (*Consumer)(ss).log("reassembling from server", r.Skip, len(r.Bytes))
-		ss.ServerReader.Reassembled([]tcpassembly.Reassembly{r})
-		(*Consumer)(ss).Run()
+		inChunks(r, func(chunk tcpassembly.Reassembly) {
+			ss.ServerReader.Reassembled([]tcpassembly.Reassembly{chunk})
+			(*Consumer)(ss).Run()
+		})
 	}
 }
 
@@ -204,3 +282,17 @@ func (ss *ServerStream) ReassemblyComplete() {
 		ss.ServerReader = eofSource
 	}
 }
+
+// inChunks calls fn with r split into pieces of at most maxChunk bytes.
+func inChunks(r tcpassembly.Reassembly, fn func(tcpassembly.Reassembly)) {
+	for len(r.Bytes) > maxChunk {
+		chunk := r
+		chunk.Bytes = r.Bytes[:maxChunk]
+		chunk.End = false
+		fn(chunk)
+		r.Bytes = r.Bytes[maxChunk:]
+		r.Skip = 0
+		r.Start = false
+	}
+	fn(r)
+}
@@ -0,0 +1,49 @@
+package model
+
+// DesyncCause is the reason a conversation could not be followed.
+type DesyncCause int
+
+const (
+	// DesyncLostData is a gap in the TCP stream due to missing packets.
+	DesyncLostData DesyncCause = iota
+	// DesyncProtocol is data that does not follow the protocol, such as a
+	// command that is not a word.
+	DesyncProtocol
+	// DesyncBadSize is a value size that could not be parsed.
+	DesyncBadSize
+	// DesyncOverflow is more data buffered than a reader can hold, or a
+	// line longer than a reader's buffer.
+	DesyncOverflow
+	// DesyncTruncated is a line or value cut short because packets were
+	// captured with a snap length too small to hold it.
+	DesyncTruncated
+	// NumDesyncCauses is the number of causes above.
+	NumDesyncCauses
+)
+
+func (c DesyncCause) String() string {
+	switch c {
+	case DesyncLostData:
+		return "lost data"
+	case DesyncProtocol:
+		return "protocol desync"
+	case DesyncBadSize:
+		return "unparsable size"
+	case DesyncOverflow:
+		return "buffer overflow"
+	case DesyncTruncated:
+		return "truncated"
+	}
+	return "unknown"
+}
+
+// Desync describes a single time a conversation could not be followed and
+// parsing had to resume at the next command.
+type Desync struct {
+	Cause DesyncCause
+	// Skipped is the number of bytes lost or discarded before resuming.
+	Skipped int
+	// Sample is the line or request being parsed when the conversation
+	// was lost, if any.
+	Sample string
+}
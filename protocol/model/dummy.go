@@ -43,3 +43,7 @@ func (s *DummySource) Close() error {
 func (s *DummySource) Reset() {}
 
 func (s *DummySource) Truncate() {}
+
+func (s *DummySource) Buffered() int {
+	return 0
+}